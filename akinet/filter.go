@@ -0,0 +1,397 @@
+package akinet
+
+import (
+	"mime"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+
+	"github.com/akitasoftware/akita-libs/trackers"
+)
+
+// A TrafficFilter decides whether a ParsedNetworkTraffic should be kept (true)
+// or dropped (false).
+type TrafficFilter func(ParsedNetworkTraffic) bool
+
+// Keeps all traffic.
+func KeepAll(ParsedNetworkTraffic) bool {
+	return true
+}
+
+// Keeps traffic that satisfies all of the given filters.
+func AndFilter(filters ...TrafficFilter) TrafficFilter {
+	return func(t ParsedNetworkTraffic) bool {
+		for _, f := range filters {
+			if !f(t) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Keeps traffic that satisfies at least one of the given filters.
+func OrFilter(filters ...TrafficFilter) TrafficFilter {
+	return func(t ParsedNetworkTraffic) bool {
+		for _, f := range filters {
+			if f(t) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Keeps traffic that does not satisfy the given filter.
+func NotFilter(f TrafficFilter) TrafficFilter {
+	return func(t ParsedNetworkTraffic) bool {
+		return !f(t)
+	}
+}
+
+// Keeps HTTP requests whose host matches the given pattern. The host's port,
+// if any, is ignored, and matching is case-insensitive. A pattern of the form
+// "*.example.com" matches example.com and all of its subdomains.
+func HostFilter(pattern string) TrafficFilter {
+	pattern = strings.ToLower(pattern)
+	return func(t ParsedNetworkTraffic) bool {
+		req, ok := t.Content.(HTTPRequest)
+		if !ok {
+			return false
+		}
+		return hostMatches(pattern, stripPort(req.Host))
+	}
+}
+
+// Keeps HTTP requests whose URL path starts with the given prefix.
+func PathPrefixFilter(prefix string) TrafficFilter {
+	return func(t ParsedNetworkTraffic) bool {
+		req, ok := t.Content.(HTTPRequest)
+		if !ok || req.URL == nil {
+			return false
+		}
+		return strings.HasPrefix(req.URL.Path, prefix)
+	}
+}
+
+// Keeps HTTP requests with the given method. Matching is case-insensitive.
+func MethodFilter(method string) TrafficFilter {
+	return func(t ParsedNetworkTraffic) bool {
+		req, ok := t.Content.(HTTPRequest)
+		if !ok {
+			return false
+		}
+		return strings.EqualFold(req.Method, method)
+	}
+}
+
+// Keeps traffic whose source or destination port is the given port.
+func PortFilter(port int) TrafficFilter {
+	return func(t ParsedNetworkTraffic) bool {
+		return t.SrcPort == port || t.DstPort == port
+	}
+}
+
+// Keeps traffic observed on the given network interface.
+func InterfaceFilter(iface string) TrafficFilter {
+	return func(t ParsedNetworkTraffic) bool {
+		return t.Interface == iface
+	}
+}
+
+// Keeps traffic with the given direction.
+func DirectionFilter(d NetTrafficDirection) TrafficFilter {
+	return func(t ParsedNetworkTraffic) bool {
+		return t.Direction == d
+	}
+}
+
+// Keeps HTTP requests and responses whose media type matches the given
+// pattern, ignoring any parameters. Matching is case-insensitive. A pattern of
+// the form "image/*" matches all subtypes.
+//
+// Note that FilterTraffic decides the fate of a response from its request, so
+// when used there, this selects exchanges by the request's content type.
+func ContentTypeFilter(pattern string) TrafficFilter {
+	pattern = strings.ToLower(pattern)
+	return func(t ParsedNetworkTraffic) bool {
+		var contentType string
+		switch c := t.Content.(type) {
+		case HTTPRequest:
+			contentType = c.Header.Get("Content-Type")
+		case HTTPResponse:
+			contentType = c.Header.Get("Content-Type")
+		default:
+			return false
+		}
+
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return false
+		}
+
+		if strings.HasSuffix(pattern, "/*") {
+			return strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))
+		}
+		return mediaType == pattern
+	}
+}
+
+// Keeps HTTP requests to known tracker domains. See trackers.IsTrackerDomain.
+func TrackerFilter(t ParsedNetworkTraffic) bool {
+	req, ok := t.Content.(HTTPRequest)
+	if !ok {
+		return false
+	}
+	return trackers.IsTrackerDomain(req.Host)
+}
+
+// Strips the port, if any, from a Host header value. Bare IPv6 addresses such
+// as "::1" have no port and are returned as is.
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+func hostMatches(pattern, host string) bool {
+	if suffix := strings.TrimPrefix(pattern, "*."); suffix != pattern {
+		return host == suffix || strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+// Parses a filter expression. The grammar is
+//
+//	expr := term | expr "and" expr | expr "or" expr | "not" expr | "(" expr ")"
+//	term := "host:" PATTERN | "path:" PREFIX | "method:" METHOD | "port:" PORT
+//	      | "iface:" NAME | "direction:" ("inbound" | "outbound" | "unknown")
+//	      | "content-type:" PATTERN | "tracker"
+//
+// "not" binds tighter than "and", which binds tighter than "or". Keywords are
+// case-insensitive. For example:
+//
+//	method:POST and (host:*.example.com or port:8080) and not tracker
+//
+// An empty expression keeps all traffic.
+func ParseTrafficFilter(expr string) (TrafficFilter, error) {
+	p := &filterParser{tokens: tokenizeFilter(expr)}
+	if len(p.tokens) == 0 {
+		return KeepAll, nil
+	}
+
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, errors.Errorf("unexpected %q in filter expression", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+func tokenizeFilter(expr string) []string {
+	var tokens []string
+	var cur strings.Builder
+	flush := func() {
+		if cur.Len() > 0 {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		}
+	}
+	for _, r := range expr {
+		switch {
+		case unicode.IsSpace(r):
+			flush()
+		case r == '(' || r == ')':
+			flush()
+			tokens = append(tokens, string(r))
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) peekKeyword(keyword string) bool {
+	return p.pos < len(p.tokens) && strings.EqualFold(p.tokens[p.pos], keyword)
+}
+
+func (p *filterParser) parseOr() (TrafficFilter, error) {
+	f, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	filters := []TrafficFilter{f}
+	for p.peekKeyword("or") {
+		p.pos++
+		f, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return OrFilter(filters...), nil
+}
+
+func (p *filterParser) parseAnd() (TrafficFilter, error) {
+	f, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	filters := []TrafficFilter{f}
+	for p.peekKeyword("and") {
+		p.pos++
+		f, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return AndFilter(filters...), nil
+}
+
+func (p *filterParser) parseUnary() (TrafficFilter, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("unexpected end of filter expression")
+	}
+
+	switch tok := p.tokens[p.pos]; {
+	case strings.EqualFold(tok, "not"):
+		p.pos++
+		f, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return NotFilter(f), nil
+	case tok == "(":
+		p.pos++
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.pos >= len(p.tokens) || p.tokens[p.pos] != ")" {
+			return nil, errors.New("missing ')' in filter expression")
+		}
+		p.pos++
+		return f, nil
+	default:
+		p.pos++
+		return parseFilterTerm(tok)
+	}
+}
+
+func parseFilterTerm(tok string) (TrafficFilter, error) {
+	if strings.EqualFold(tok, "tracker") {
+		return TrackerFilter, nil
+	}
+
+	field, value, ok := strings.Cut(tok, ":")
+	if !ok || value == "" {
+		return nil, errors.Errorf("invalid filter term %q, expected FIELD:VALUE", tok)
+	}
+
+	switch strings.ToLower(field) {
+	case "host":
+		return HostFilter(value), nil
+	case "path":
+		return PathPrefixFilter(value), nil
+	case "method":
+		return MethodFilter(value), nil
+	case "port":
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 0 || port > 65535 {
+			return nil, errors.Errorf("invalid port %q in filter expression", value)
+		}
+		return PortFilter(port), nil
+	case "iface":
+		return InterfaceFilter(value), nil
+	case "direction":
+		switch strings.ToLower(value) {
+		case "inbound":
+			return DirectionFilter(DirectionInbound), nil
+		case "outbound":
+			return DirectionFilter(DirectionOutbound), nil
+		case "unknown":
+			return DirectionFilter(DirectionUnknown), nil
+		}
+		return nil, errors.Errorf("invalid direction %q in filter expression", value)
+	case "content-type":
+		return ContentTypeFilter(value), nil
+	}
+	return nil, errors.Errorf("unknown filter field %q", field)
+}
+
+// The maximum number of outstanding request decisions remembered by
+// FilterTraffic for pairing with responses.
+const maxPendingFilterDecisions = 10000
+
+// Returns a channel carrying the traffic from in that is kept by the given
+// filter. The buffers held by dropped traffic are released.
+//
+// Since attributes such as host, path and method are only available on HTTP
+// requests, an HTTP response is kept or dropped according to the decision made
+// for its request (matched by stream key). The filter is never evaluated
+// against such responses, so response-side predicates such as
+// ContentTypeFilter only see the request: a GET request without a body is
+// dropped by "content-type:application/json" along with its JSON response.
+// Responses whose request was not seen are evaluated against the filter
+// directly.
+func FilterTraffic(in <-chan ParsedNetworkTraffic, keep TrafficFilter) <-chan ParsedNetworkTraffic {
+	out := make(chan ParsedNetworkTraffic)
+
+	go func() {
+		defer close(out)
+
+		// Maps stream keys of HTTP requests to whether they were kept.
+		requestDecisions := make(map[string]bool)
+
+		for t := range in {
+			var kept bool
+			switch c := t.Content.(type) {
+			case HTTPRequest:
+				kept = keep(t)
+				if len(requestDecisions) >= maxPendingFilterDecisions {
+					// Responses for some requests were never seen. Start over rather than
+					// grow without bound.
+					requestDecisions = make(map[string]bool)
+				}
+				requestDecisions[c.GetStreamKey()] = kept
+			case HTTPResponse:
+				key := c.GetStreamKey()
+				if decision, ok := requestDecisions[key]; ok {
+					kept = decision
+					delete(requestDecisions, key)
+				} else {
+					kept = keep(t)
+				}
+			default:
+				kept = keep(t)
+			}
+
+			if kept {
+				out <- t
+			} else if t.Content != nil {
+				t.Content.ReleaseBuffers()
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,168 @@
+package akinet
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/akitasoftware/akita-libs/buffer_pool"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTrafficFilter(t *testing.T) {
+	req := ParsedNetworkTraffic{
+		SrcPort:   51234,
+		DstPort:   8080,
+		Interface: "eth0",
+		Direction: DirectionInbound,
+		Content: HTTPRequest{
+			Method: "POST",
+			URL:    &url.URL{Path: "/api/v1/users"},
+			Host:   "API.example.com:8080",
+			Header: http.Header{"Content-Type": {"application/json; charset=utf-8"}},
+		},
+	}
+	tracker := ParsedNetworkTraffic{
+		DstPort: 443,
+		Content: HTTPRequest{
+			Method: "GET",
+			URL:    &url.URL{Path: "/collect"},
+			Host:   "www.google-analytics.com",
+		},
+	}
+
+	testCases := []struct {
+		expr         string
+		keepReq      bool
+		keepTracker  bool
+		expectsError bool
+	}{
+		{expr: "", keepReq: true, keepTracker: true},
+		{expr: "host:api.example.com", keepReq: true},
+		{expr: "host:*.example.com", keepReq: true},
+		{expr: "host:example.com", keepReq: false},
+		{expr: "path:/api", keepReq: true},
+		{expr: "method:post", keepReq: true},
+		{expr: "port:443", keepTracker: true},
+		{expr: "iface:eth0", keepReq: true},
+		{expr: "direction:inbound", keepReq: true},
+		{expr: "direction:unknown", keepTracker: true},
+		{expr: "content-type:application/*", keepReq: true},
+		{expr: "tracker", keepTracker: true},
+		{expr: "not tracker", keepReq: true},
+		{expr: "method:GET or port:8080", keepReq: true, keepTracker: true},
+		{expr: "method:GET and port:8080"},
+		{expr: "NOT (method:GET OR path:/api)"},
+		{expr: "port:80 or port:8080 and method:GET"},
+		{expr: "host", expectsError: true},
+		{expr: "port:http", expectsError: true},
+		{expr: "direction:sideways", expectsError: true},
+		{expr: "color:blue", expectsError: true},
+		{expr: "(method:GET", expectsError: true},
+		{expr: "method:GET)", expectsError: true},
+		{expr: "method:GET and", expectsError: true},
+	}
+
+	for _, tc := range testCases {
+		f, err := ParseTrafficFilter(tc.expr)
+		if tc.expectsError {
+			assert.Error(t, err, tc.expr)
+			continue
+		}
+		if assert.NoError(t, err, tc.expr) {
+			assert.Equal(t, tc.keepReq, f(req), tc.expr)
+			assert.Equal(t, tc.keepTracker, f(tracker), tc.expr)
+		}
+	}
+}
+
+func TestFilterTraffic(t *testing.T) {
+	pool, err := buffer_pool.MakeBufferPool(1024, 64)
+	assert.NoError(t, err)
+	newBuffer := func() buffer_pool.Buffer {
+		b := pool.NewBuffer()
+		_, err := b.Write([]byte("body"))
+		assert.NoError(t, err)
+		return b
+	}
+
+	keptID := uuid.New()
+	droppedID := uuid.New()
+	keptReq := HTTPRequest{StreamID: keptID, Host: "example.com", buffer: newBuffer()}
+	keptResp := HTTPResponse{StreamID: keptID, buffer: newBuffer()}
+	droppedReq := HTTPRequest{StreamID: droppedID, Host: "segment.io", buffer: newBuffer()}
+	droppedResp := HTTPResponse{StreamID: droppedID, buffer: newBuffer()}
+
+	in := make(chan ParsedNetworkTraffic)
+	go func() {
+		defer close(in)
+		in <- ParsedNetworkTraffic{Content: keptReq}
+		in <- ParsedNetworkTraffic{Content: droppedReq}
+		in <- ParsedNetworkTraffic{Content: droppedResp}
+		in <- ParsedNetworkTraffic{Content: keptResp}
+		in <- ParsedNetworkTraffic{Content: AkitaPrince("prince")}
+	}()
+
+	var out []ParsedNetworkContent
+	for t := range FilterTraffic(in, NotFilter(TrackerFilter)) {
+		out = append(out, t.Content)
+	}
+
+	assert.Equal(t, []ParsedNetworkContent{keptReq, keptResp, AkitaPrince("prince")}, out)
+
+	// Buffers for dropped traffic should have been released.
+	assert.Equal(t, 8, keptReq.buffer.Len()+keptResp.buffer.Len())
+	assert.Equal(t, 0, droppedReq.buffer.Len()+droppedResp.buffer.Len())
+}
+
+func TestFilterTrafficPairsResponsesByRequest(t *testing.T) {
+	pool, err := buffer_pool.MakeBufferPool(1024, 64)
+	assert.NoError(t, err)
+
+	jsonHeader := http.Header{"Content-Type": {"application/json"}}
+	getID := uuid.New()
+	postID := uuid.New()
+	orphanID := uuid.New()
+	getReq := HTTPRequest{StreamID: getID, Method: "GET", buffer: pool.NewBuffer()}
+	getResp := HTTPResponse{StreamID: getID, Header: jsonHeader, buffer: pool.NewBuffer()}
+	postReq := HTTPRequest{StreamID: postID, Method: "POST", Header: jsonHeader, buffer: pool.NewBuffer()}
+	postResp := HTTPResponse{StreamID: postID, Header: http.Header{"Content-Type": {"text/html"}}, buffer: pool.NewBuffer()}
+	orphanResp := HTTPResponse{StreamID: orphanID, Header: jsonHeader, buffer: pool.NewBuffer()}
+
+	in := make(chan ParsedNetworkTraffic)
+	go func() {
+		defer close(in)
+		in <- ParsedNetworkTraffic{Content: getReq}
+		in <- ParsedNetworkTraffic{Content: postReq}
+		in <- ParsedNetworkTraffic{Content: getResp}
+		in <- ParsedNetworkTraffic{Content: postResp}
+		in <- ParsedNetworkTraffic{Content: orphanResp}
+	}()
+
+	var out []ParsedNetworkContent
+	for t := range FilterTraffic(in, ContentTypeFilter("application/json")) {
+		out = append(out, t.Content)
+	}
+
+	// Responses follow their requests, whatever their own content type. The
+	// response without a request is evaluated on its own.
+	assert.Equal(t, []ParsedNetworkContent{postReq, postResp, orphanResp}, out)
+}
+
+func TestStripPort(t *testing.T) {
+	testCases := map[string]string{
+		"example.com":       "example.com",
+		"Example.COM:8080":  "example.com",
+		"10.0.0.1":          "10.0.0.1",
+		"10.0.0.1:80":       "10.0.0.1",
+		"::1":               "::1",
+		"fe80::1:2":         "fe80::1:2",
+		"[::1]":             "::1",
+		"[fe80::1:2]:8080":  "fe80::1:2",
+		"[2001:DB8::1]:443": "2001:db8::1",
+	}
+	for host, expected := range testCases {
+		assert.Equal(t, expected, stripPort(host), host)
+	}
+}
@@ -0,0 +1,95 @@
+package http
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/buffer_pool"
+	"github.com/akitasoftware/akita-libs/test"
+)
+
+// Seed inputs for the fuzz targets, taken from the parser tests.
+var (
+	fuzzRequestSeeds = []string{
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"POST /upload HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello",
+		"PUT /x HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" + chunkedBody.String(),
+		"GET /a HTTP/1.0\r\nCookie: c1=1;c2=2\r\n\r\nGET /b HTTP/1.1\r\n\r\n",
+		"garbage GET / HTTP/1.1\r\n\r\n",
+		"GET /\r\n\r\n",
+	}
+
+	fuzzResponseSeeds = []string{
+		"HTTP/1.1 204 No Content\r\nX-Akita-Dog: prince\r\nSet-Cookie: c1=1\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello",
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n" + chunkedBody.String(),
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: deflate\r\n\r\n" + deflatedBody.String(),
+		strings.Join([]string{
+			"HTTP/1.1 200 OK\r\n",
+			fmt.Sprintf("Content-Length: %d\r\n", len(multipartFormData)),
+			"Content-Type: multipart/form-data;boundary=b9580db\r\n",
+			"\r\n",
+			multipartFormData,
+		}, ""),
+		"HTTP/1.0 500\r\n\r\n",
+	}
+
+	fuzzChunkSeeds = [][]byte{nil, {1}, {3, 0, 7}, {16}}
+)
+
+func FuzzHTTPRequestParser(f *testing.F) {
+	for _, seed := range fuzzRequestSeeds {
+		for _, chunks := range fuzzChunkSeeds {
+			f.Add([]byte(seed), chunks)
+		}
+	}
+
+	pool, err := buffer_pool.MakeBufferPool(1024*1024, 4*1024)
+	if err != nil {
+		f.Fatal(err)
+	}
+	factory := NewHTTPRequestParserFactory(pool)
+
+	f.Fuzz(func(t *testing.T, data []byte, chunkSizes []byte) {
+		test.CheckTCPParserFactory(t, factory, data, chunkSizes)
+	})
+}
+
+func FuzzHTTPResponseParser(f *testing.F) {
+	for _, seed := range fuzzResponseSeeds {
+		for _, chunks := range fuzzChunkSeeds {
+			f.Add([]byte(seed), chunks)
+		}
+	}
+
+	pool, err := buffer_pool.MakeBufferPool(1024*1024, 4*1024)
+	if err != nil {
+		f.Fatal(err)
+	}
+	factory := NewHTTPResponseParserFactory(pool)
+
+	f.Fuzz(func(t *testing.T, data []byte, chunkSizes []byte) {
+		test.CheckTCPParserFactory(t, factory, data, chunkSizes)
+	})
+}
+
+// Exercises the parser directly, without going through the factory, so that
+// inputs the factory would reject still reach the parser.
+func FuzzHTTPParse(f *testing.F) {
+	for _, seed := range append(fuzzRequestSeeds, fuzzResponseSeeds...) {
+		f.Add([]byte(seed), []byte{5}, true)
+		f.Add([]byte(seed), []byte{5}, false)
+	}
+
+	pool, err := buffer_pool.MakeBufferPool(1024*1024, 4*1024)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, chunkSizes []byte, isRequest bool) {
+		p := newHTTPParser(isRequest, akinet.TCPBidiID{}, 0, 0, pool)
+		test.CheckTCPParser(t, p, test.ChunkInput(data, chunkSizes))
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"io"
 	"net/http"
+	"strings"
 
 	"github.com/google/gopacket/reassembly"
 	"github.com/google/uuid"
@@ -21,6 +22,10 @@ var (
 	MaximumHTTPLength int64 = 1024 * 1024
 )
 
+// Seen by the parser goroutine when the HTTP request or response is longer
+// than the maximum length supported.
+var errHTTPLengthExceeded = errors.New("HTTP message exceeds maximum supported length")
+
 // Parses a single HTTP request or response.
 //
 // Internally, this uses Go's HTTP parser. Go's parser is a synchronous one; we
@@ -75,7 +80,7 @@ func (p *httpParser) Parse(input memview.MemView, isEnd bool) (result akinet.Par
 			totalBytesConsumed -= unused.Len()
 			err = nil
 		case httpPipeReaderError:
-			err = e.err
+			err = akinet.NewParseError(p.classifyError(e.err), p.Name(), e.err)
 		default:
 			err = errors.Wrap(err, "encountered unknown HTTP pipe reader error")
 		}
@@ -107,7 +112,10 @@ func (p *httpParser) Parse(input memview.MemView, isEnd bool) (result akinet.Par
 	// close the pipe anyway. This will leave the input stream in a state where it
 	// probably can't find the next header until the accumulated data in the
 	// reassembly buffer is all skipped.
-	if isEnd || p.totalBytesConsumed > p.maxHttpLength {
+	if p.totalBytesConsumed > p.maxHttpLength {
+		p.w.CloseWithError(errHTTPLengthExceeded)
+		err = <-p.readClosed
+	} else if isEnd {
 		p.w.Close()
 		err = <-p.readClosed
 	}
@@ -115,6 +123,42 @@ func (p *httpParser) Parse(input memview.MemView, isEnd bool) (result akinet.Par
 	return
 }
 
+// Determines why parsing failed with the given error from the parser
+// goroutine.
+func (p *httpParser) classifyError(err error) akinet.ParseErrorReason {
+	overLimit := errors.Is(err, errHTTPLengthExceeded)
+
+	// Bodies over the limit are truncated rather than failing the parse, so the
+	// limit can only be exceeded here while reading the headers.
+	var bodyErr httpBodyError
+	if errors.As(err, &bodyErr) {
+		return akinet.ParseErrorMalformed
+	}
+
+	switch {
+	case overLimit:
+		return akinet.ParseErrorHeaderTooLarge
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.ErrClosedPipe):
+		// The parser goroutine ran out of input while reading the headers.
+		return akinet.ParseErrorTruncated
+	}
+
+	// Go's HTTP library doesn't export its error types, so we fall back to
+	// matching on error messages.
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "unsupported transfer encoding"),
+		strings.Contains(msg, "too many transfer encodings"):
+		return akinet.ParseErrorUnsupportedEncoding
+	case strings.HasPrefix(msg, "malformed HTTP request"),
+		strings.HasPrefix(msg, "malformed HTTP response"),
+		strings.HasPrefix(msg, "malformed HTTP version"),
+		strings.HasPrefix(msg, "malformed HTTP status code"):
+		return akinet.ParseErrorInvalidStartLine
+	}
+	return akinet.ParseErrorMalformed
+}
+
 func newHTTPParser(isRequest bool, bidiID akinet.TCPBidiID, seq, ack reassembly.Sequence, pool buffer_pool.BufferPool) *httpParser {
 	// Unfortunately, go's http request parser blocks. So we need to run it in a
 	// separate goroutine. This needs to be addressed as part of
@@ -127,6 +171,7 @@ func newHTTPParser(isRequest bool, bidiID akinet.TCPBidiID, seq, ack reassembly.
 	go func() {
 		var req *http.Request
 		var resp *http.Response
+		var truncation akinet.ParseErrorReason
 		var err error
 		br := bufio.NewReader(r)
 
@@ -134,13 +179,14 @@ func newHTTPParser(isRequest bool, bidiID akinet.TCPBidiID, seq, ack reassembly.
 		//
 		// XXX This is used in a very non-local fashion. Consumers of the body are
 		// responsible for resetting the buffer, but there is no way to guarantee
-		// that this will happen.
+		// that this will happen. Set buffer_pool.TrackAllocations to find buffers
+		// that are never released.
 		body := pool.NewBuffer()
 
 		if isRequest {
-			req, err = readSingleHTTPRequest(br, body)
+			req, truncation, err = readSingleHTTPRequest(br, body)
 		} else {
-			resp, err = readSingleHTTPResponse(br, body)
+			resp, truncation, err = readSingleHTTPResponse(br, body)
 		}
 		if err != nil {
 			err = httpPipeReaderError{
@@ -165,14 +211,18 @@ func newHTTPParser(isRequest bool, bidiID akinet.TCPBidiID, seq, ack reassembly.
 			// TCP seq number on the first segment of the corresponding HTTP response.
 			// Hence we use it to differntiate differnt pairs of HTTP request and
 			// response on the same TCP stream.
-			c = akinet.FromStdRequest(uuid.UUID(bidiID), int(ack), req, body)
+			httpReq := akinet.FromStdRequest(uuid.UUID(bidiID), int(ack), req, body)
+			httpReq.BodyTruncation = truncation
+			c = httpReq
 		} else {
 			// Because HTTP requires the request to finish before sending a response,
 			// TCP ack number on the first segment of the HTTP request is equal to the
 			// TCP seq number on the first segment of the corresponding HTTP response.
 			// Hence we use it to differntiate differnt pairs of HTTP request and
 			// response on the same TCP stream.
-			c = akinet.FromStdResponse(uuid.UUID(bidiID), int(seq), resp, body)
+			httpResp := akinet.FromStdResponse(uuid.UUID(bidiID), int(seq), resp, body)
+			httpResp.BodyTruncation = truncation
+			c = httpResp
 		}
 		resultChan <- c
 	}()
@@ -189,63 +239,76 @@ func newHTTPParser(isRequest bool, bidiID akinet.TCPBidiID, seq, ack reassembly.
 // Reads a single HTTP request, only consuming the exact number of bytes that
 // form the request and its body, but there may be unused bytes left in the
 // bufio.Reader's buffer. The request body is written into the given buffer.
-func readSingleHTTPRequest(r *bufio.Reader, body buffer_pool.Buffer) (*http.Request, error) {
+func readSingleHTTPRequest(r *bufio.Reader, body buffer_pool.Buffer) (*http.Request, akinet.ParseErrorReason, error) {
 	req, err := http.ReadRequest(r)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	if req.Body == nil {
-		return req, nil
+		return req, "", nil
 	}
 
 	// Read the body to move the reader's position to the end of the body.
 	_, bodyErr := io.Copy(body, req.Body)
 	req.Body.Close()
 
-	switch {
-	case
-		errors.Is(bodyErr, io.ErrUnexpectedEOF),
-		errors.Is(bodyErr, buffer_pool.ErrEmptyPool):
-
-		// Let the next level try to handle a body that was truncated.
-		bodyErr = nil
+	truncation, bodyErr := checkBodyError(bodyErr)
+	if bodyErr != nil {
+		return nil, "", bodyErr
 	}
-
-	return req, bodyErr
+	return req, truncation, nil
 }
 
 // Reads a single HTTP response, only consuming the exact number of bytes that
 // form the response and its body, but there may be unused bytes left in the
 // bufio.Reader's buffer. The response body is written into the given buffer.
-func readSingleHTTPResponse(r *bufio.Reader, body buffer_pool.Buffer) (*http.Response, error) {
+func readSingleHTTPResponse(r *bufio.Reader, body buffer_pool.Buffer) (*http.Response, akinet.ParseErrorReason, error) {
 	// XXX BUG Because a nil http.Request is provided to ReadResponse, the http
 	// library assumes a GET request. If this is actually a response to a HEAD
 	// request and the Content-Length header is present, the library will treat
 	// the bytes after the end of the response as a response body.
 	resp, err := http.ReadResponse(r, nil)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	if resp.Body == nil {
-		return resp, nil
+		return resp, "", nil
 	}
 
 	// Read the body to move the reader's position to the end of the body.
 	_, bodyErr := io.Copy(body, resp.Body)
 	resp.Body.Close()
 
+	truncation, bodyErr := checkBodyError(bodyErr)
+	if bodyErr != nil {
+		return nil, "", bodyErr
+	}
+	return resp, truncation, nil
+}
+
+// Classifies an error from reading an HTTP body. Returns the reason the body
+// was truncated, if it was cut short in a way that the next level can handle,
+// or an error if the body could not be read. A body over the length limit is
+// kept truncated, whatever its framing.
+func checkBodyError(err error) (akinet.ParseErrorReason, error) {
 	switch {
+	case err == nil:
+		return "", nil
+	case errors.Is(err, errHTTPLengthExceeded):
+		return akinet.ParseErrorBodyOverLimit, nil
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		// Let the next level try to handle a body that was truncated.
+		return akinet.ParseErrorTruncated, nil
 	case
-		errors.Is(bodyErr, io.ErrUnexpectedEOF),
-		errors.Is(bodyErr, buffer_pool.ErrEmptyPool):
+		errors.Is(err, buffer_pool.ErrEmptyPool),
+		errors.Is(err, buffer_pool.ErrQuotaExceeded):
 
-		// Let the next level try to handle a body that was truncated.
-		bodyErr = nil
+		// The body was read in full, but not all of it could be stored.
+		return "", nil
 	}
-
-	return resp, bodyErr
+	return "", httpBodyError{err: err}
 }
 
 // Indicates the pipe reader has successfully completed parsing. The integer
@@ -256,6 +319,20 @@ func (httpPipeReaderDone) Error() string {
 	return "HTTP pipe reader success"
 }
 
+// Indicates that an error occurred while reading the body of an HTTP request
+// or response.
+type httpBodyError struct {
+	err error
+}
+
+func (e httpBodyError) Error() string {
+	return e.err.Error()
+}
+
+func (e httpBodyError) Unwrap() error {
+	return e.err
+}
+
 type httpPipeReaderError struct {
 	err         error // the actual err
 	unusedBytes int64 // number of bytes read from the pipe writer but were unused
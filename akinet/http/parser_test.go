@@ -603,3 +603,104 @@ func TestOversizedResponse(t *testing.T) {
 		t.Errorf("expected %d bytes consumed, but actually consumed %d bytes", expectedBytesConsumed, totalBytesConsumed)
 	}
 }
+
+func TestParseErrorReasons(t *testing.T) {
+	pool, err := buffer_pool.MakeBufferPool(1024*1024, 4*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name      string
+		isRequest bool
+		input     string
+		expected  akinet.ParseErrorReason
+	}{
+		{
+			name:      "truncated request headers",
+			isRequest: true,
+			input:     "GET / HTTP/1.1\r\nHost: exa",
+			expected:  akinet.ParseErrorTruncated,
+		},
+		{
+			name:      "malformed request line",
+			isRequest: true,
+			input:     "GET /\r\n\r\n",
+			expected:  akinet.ParseErrorInvalidStartLine,
+		},
+		{
+			name:     "malformed status code",
+			input:    "HTTP/1.1 2x0 OK\r\n\r\n",
+			expected: akinet.ParseErrorInvalidStartLine,
+		},
+		{
+			name:     "unsupported transfer encoding",
+			input:    "HTTP/1.1 200 OK\r\nTransfer-Encoding: deflate\r\n\r\nfoo",
+			expected: akinet.ParseErrorUnsupportedEncoding,
+		},
+	}
+
+	for _, c := range testCases {
+		p := newHTTPParser(c.isRequest, testBidiID, 522, 1203, pool)
+		_, _, _, err := p.Parse(memview.New([]byte(c.input)), true)
+		if err == nil {
+			t.Errorf("[%s] expected error, got none", c.name)
+			continue
+		}
+		if reason := akinet.GetParseErrorReason(err); reason != c.expected {
+			t.Errorf("[%s] expected reason %s, got %s: %v", c.name, c.expected, reason, err)
+		}
+	}
+}
+
+func TestOversizedHeaders(t *testing.T) {
+	pool, err := buffer_pool.MakeBufferPool(1024*1024, 4*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newHTTPParser(true, testBidiID, 522, 1203, pool)
+	p.maxHttpLength = 100
+
+	input := "GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("a", 200)
+	_, _, _, err = p.Parse(memview.New([]byte(input)), false)
+	if reason := akinet.GetParseErrorReason(err); reason != akinet.ParseErrorHeaderTooLarge {
+		t.Errorf("expected reason %s, got %s: %v", akinet.ParseErrorHeaderTooLarge, reason, err)
+	}
+}
+
+func TestOversizedChunkedBody(t *testing.T) {
+	pool, err := buffer_pool.MakeBufferPool(1024*1024, 4*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bodies over the limit are kept truncated, whatever their framing.
+	testCases := map[string]string{
+		"chunked":         "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nc8\r\n" + strings.Repeat("a", 200),
+		"close-delimited": "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\n" + strings.Repeat("a", 200),
+		"content-length":  "HTTP/1.1 200 OK\r\nContent-Length: 400\r\n\r\n" + strings.Repeat("a", 200),
+	}
+	for name, input := range testCases {
+		p := newHTTPParser(false, testBidiID, 522, 1203, pool)
+		p.maxHttpLength = 100
+
+		pnc, _, _, err := p.Parse(memview.New([]byte(input)), false)
+		if err != nil {
+			t.Errorf("[%s] got error: %v", name, err)
+			continue
+		}
+		response, ok := pnc.(akinet.HTTPResponse)
+		if !ok {
+			t.Errorf("[%s] expected an HTTP response, got %v", name, pnc)
+			continue
+		}
+		if response.BodyTruncation != akinet.ParseErrorBodyOverLimit {
+			t.Errorf("[%s] expected truncation %s, got %q", name, akinet.ParseErrorBodyOverLimit, response.BodyTruncation)
+		}
+		if n := response.Body.Len(); n == 0 || n > 200 {
+			t.Errorf("[%s] got body length %d", name, n)
+		}
+		response.ReleaseBuffers()
+	}
+}
@@ -0,0 +1,26 @@
+package http2
+
+import (
+	"testing"
+
+	"github.com/akitasoftware/akita-libs/test"
+)
+
+func FuzzHTTP2PrefaceParser(f *testing.F) {
+	seeds := [][]byte{
+		connectionPreface,
+		append([]byte("abcdefP"), connectionPreface...),
+		connectionPreface[:8],
+		[]byte("GET /bulk/this/out/some/so/its/long HTTP/1.1\r\n"),
+	}
+	for _, seed := range seeds {
+		for _, chunks := range [][]byte{nil, {1}, {8, 0, 16}} {
+			f.Add(seed, chunks)
+		}
+	}
+
+	factory := NewHTTP2PrefaceParserFactory()
+	f.Fuzz(func(t *testing.T, data []byte, chunkSizes []byte) {
+		test.CheckTCPParserFactory(t, factory, data, chunkSizes)
+	})
+}
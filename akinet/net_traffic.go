@@ -170,6 +170,10 @@ type HTTPRequest struct {
 	BodyDecompressed bool // true if the body is already decompressed
 	Cookies          []*http.Cookie
 
+	// If the body was cut short, the reason, such as ParseErrorBodyOverLimit.
+	// Empty if the body is complete.
+	BodyTruncation ParseErrorReason
+
 	// The buffer (if any) that owns the storage backing the request body.
 	buffer buffer_pool.Buffer
 }
@@ -201,6 +205,10 @@ type HTTPResponse struct {
 	BodyDecompressed bool // true if the body is already decompressed
 	Cookies          []*http.Cookie
 
+	// If the body was cut short, the reason, such as ParseErrorBodyOverLimit.
+	// Empty if the body is complete.
+	BodyTruncation ParseErrorReason
+
 	// The buffer (if any) that owns the storage backing the request body.
 	buffer buffer_pool.Buffer
 }
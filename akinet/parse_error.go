@@ -0,0 +1,77 @@
+package akinet
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Classifies why a TCPParser failed to parse its input.
+type ParseErrorReason string
+
+const (
+	// The input ended before a complete message was seen.
+	ParseErrorTruncated ParseErrorReason = "TRUNCATED"
+
+	// The HTTP request line or response status line was malformed.
+	ParseErrorInvalidStartLine ParseErrorReason = "INVALID_START_LINE"
+
+	// The message headers exceeded the maximum supported length.
+	ParseErrorHeaderTooLarge ParseErrorReason = "HEADER_TOO_LARGE"
+
+	// The message body exceeded the maximum supported length. The message is
+	// still parsed, with its body truncated, and this reason is recorded in its
+	// BodyTruncation field.
+	ParseErrorBodyOverLimit ParseErrorReason = "BODY_OVER_LIMIT"
+
+	// The message used a transfer or content encoding that is not supported.
+	ParseErrorUnsupportedEncoding ParseErrorReason = "UNSUPPORTED_ENCODING"
+
+	// The input ended before a complete TLS record was seen.
+	ParseErrorTLSRecordIncomplete ParseErrorReason = "TLS_RECORD_INCOMPLETE"
+
+	// The message was otherwise malformed.
+	ParseErrorMalformed ParseErrorReason = "MALFORMED"
+
+	// The error did not come from a TCPParser, or was not classified.
+	ParseErrorOther ParseErrorReason = "OTHER"
+)
+
+// Returned by TCPParser implementations when parsing fails.
+type ParseError struct {
+	Reason ParseErrorReason
+
+	// The name of the parser that failed.
+	Parser string
+
+	// The underlying error.
+	Err error
+}
+
+var _ error = (*ParseError)(nil)
+
+func NewParseError(reason ParseErrorReason, parser string, err error) *ParseError {
+	return &ParseError{
+		Reason: reason,
+		Parser: parser,
+		Err:    err,
+	}
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", e.Parser, e.Reason, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Returns the reason for the ParseError in the given error's chain, or
+// ParseErrorOther if there is none.
+func GetParseErrorReason(err error) ParseErrorReason {
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) {
+		return parseErr.Reason
+	}
+	return ParseErrorOther
+}
@@ -0,0 +1,217 @@
+package akinet
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/akitasoftware/go-utils/sets"
+	"github.com/pkg/errors"
+)
+
+// Describes how a TCPParserFactory is registered with a TCPParserRegistry.
+type TCPParserRegistration struct {
+	// Identifies the factory in the registry, e.g. "http1-request". Used for
+	// disabling the factory.
+	Name string
+
+	Factory TCPParserFactory
+
+	// Factories with higher priority are tried first. Ties are broken by
+	// registration order.
+	Priority int
+
+	// Ports on which this factory is tried before any factory without a hint
+	// for that port. For example, a Postgres parser factory might hint 5432.
+	PortHints []int
+
+	// If true, this factory is only tried on flows whose source or destination
+	// port is one of PortHints. Useful for protocols that are prone to false
+	// positives.
+	PortHintsOnly bool
+}
+
+// A set of TCPParserFactories registered by name. Produces a
+// TCPParserFactorySelector for each flow, ordered by priority and port hints.
+// Selectors are precomputed whenever the registry changes, and selectors for
+// pairs of hinted ports are cached on first use, so selection cost does not
+// grow with the number of port hints.
+//
+// Safe for concurrent use.
+type TCPParserRegistry struct {
+	mu sync.RWMutex
+
+	// In registration order.
+	registrations []TCPParserRegistration
+
+	// Names of registered factories.
+	names sets.Set[string]
+
+	// Names of factories that are not to be used.
+	disabled sets.Set[string]
+
+	// Registrations that are not disabled, sorted by descending priority.
+	enabled []TCPParserRegistration
+
+	// The selector for flows whose ports have no hints.
+	defaultSelector TCPParserFactorySelector
+
+	// Selectors for flows with a port that has hints.
+	selectorsByPort map[int]TCPParserFactorySelector
+
+	// Selectors for flows where both ports have hints, keyed by destination and
+	// source port. Filled in as flows are seen, and cleared when the registry
+	// changes. Bounded by the square of the number of hinted ports.
+	selectorsByPortPair map[[2]int]TCPParserFactorySelector
+}
+
+func NewTCPParserRegistry() *TCPParserRegistry {
+	return &TCPParserRegistry{
+		names:               sets.NewSet[string](),
+		disabled:            sets.NewSet[string](),
+		selectorsByPort:     make(map[int]TCPParserFactorySelector),
+		selectorsByPortPair: make(map[[2]int]TCPParserFactorySelector),
+	}
+}
+
+// Adds a factory to the registry. Returns an error if a factory with the same
+// name is already registered.
+func (r *TCPParserRegistry) Register(reg TCPParserRegistration) error {
+	if reg.Name == "" {
+		return errors.New("TCP parser factory registration has no name")
+	}
+	if reg.Factory == nil {
+		return errors.Errorf("TCP parser factory registration %q has no factory", reg.Name)
+	}
+	if reg.PortHintsOnly && len(reg.PortHints) == 0 {
+		return errors.Errorf("TCP parser factory registration %q is restricted to hinted ports but has no port hints", reg.Name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.names.Contains(reg.Name) {
+		return errors.Errorf("TCP parser factory %q is already registered", reg.Name)
+	}
+	r.names.Insert(reg.Name)
+	r.registrations = append(r.registrations, reg)
+	r.rebuild()
+	return nil
+}
+
+// Prevents the named factories from being selected. Names that are not
+// registered are remembered, so that factories can be disabled before they
+// are registered.
+func (r *TCPParserRegistry) Disable(names ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.disabled.Insert(names...)
+	r.rebuild()
+}
+
+// Reverses the effect of Disable for the named factories.
+func (r *TCPParserRegistry) Enable(names ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.disabled.Delete(names...)
+	r.rebuild()
+}
+
+// Returns the factories to try on a flow between the given ports, in order.
+// Factories hinted for the destination port come first, followed by those
+// hinted for the source port, followed by the rest. The result is a copy,
+// which the caller may modify.
+func (r *TCPParserRegistry) Selector(srcPort, dstPort int) TCPParserFactorySelector {
+	r.mu.RLock()
+	selector, ok := r.cachedSelector(srcPort, dstPort)
+	r.mu.RUnlock()
+
+	if !ok {
+		r.mu.Lock()
+		selector, ok = r.cachedSelector(srcPort, dstPort)
+		if !ok {
+			selector = r.buildSelector(dstPort, srcPort)
+			r.selectorsByPortPair[[2]int{dstPort, srcPort}] = selector
+		}
+		r.mu.Unlock()
+	}
+
+	return append(TCPParserFactorySelector(nil), selector...)
+}
+
+// Returns the precomputed or cached selector for a flow between the given
+// ports. Returns false if both ports have hints and their selector has not
+// been cached yet. Must be called with the lock held.
+func (r *TCPParserRegistry) cachedSelector(srcPort, dstPort int) (TCPParserFactorySelector, bool) {
+	dstSelector, dstHinted := r.selectorsByPort[dstPort]
+	srcSelector, srcHinted := r.selectorsByPort[srcPort]
+
+	switch {
+	case dstHinted && srcHinted && srcPort != dstPort:
+		selector, ok := r.selectorsByPortPair[[2]int{dstPort, srcPort}]
+		return selector, ok
+	case dstHinted:
+		return dstSelector, true
+	case srcHinted:
+		return srcSelector, true
+	default:
+		return r.defaultSelector, true
+	}
+}
+
+// Recomputes the selectors. Must be called with the lock held.
+func (r *TCPParserRegistry) rebuild() {
+	r.enabled = make([]TCPParserRegistration, 0, len(r.registrations))
+	for _, reg := range r.registrations {
+		if !r.disabled.Contains(reg.Name) {
+			r.enabled = append(r.enabled, reg)
+		}
+	}
+	sort.SliceStable(r.enabled, func(i, j int) bool {
+		return r.enabled[i].Priority > r.enabled[j].Priority
+	})
+
+	hintedPorts := sets.NewSet[int]()
+	for _, reg := range r.enabled {
+		hintedPorts.Insert(reg.PortHints...)
+	}
+
+	r.defaultSelector = r.buildSelector()
+	r.selectorsByPort = make(map[int]TCPParserFactorySelector, len(hintedPorts))
+	for port := range hintedPorts {
+		r.selectorsByPort[port] = r.buildSelector(port)
+	}
+	r.selectorsByPortPair = make(map[[2]int]TCPParserFactorySelector)
+}
+
+// Returns the enabled factories hinted for each of the given ports in turn,
+// followed by the remaining factories that are not restricted to their hinted
+// ports. Must be called with the lock held.
+func (r *TCPParserRegistry) buildSelector(ports ...int) TCPParserFactorySelector {
+	var result TCPParserFactorySelector
+	used := make([]bool, len(r.enabled))
+	for _, port := range ports {
+		for i, reg := range r.enabled {
+			if !used[i] && containsPort(reg.PortHints, port) {
+				result = append(result, reg.Factory)
+				used[i] = true
+			}
+		}
+	}
+	for i, reg := range r.enabled {
+		if !used[i] && !reg.PortHintsOnly {
+			result = append(result, reg.Factory)
+		}
+	}
+	return result
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
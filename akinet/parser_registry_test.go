@@ -0,0 +1,78 @@
+package akinet
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+type namedTestFactory string
+
+func (f namedTestFactory) Name() string {
+	return string(f)
+}
+
+func (namedTestFactory) Accepts(input memview.MemView, _ bool) (AcceptDecision, int64) {
+	return Reject, input.Len()
+}
+
+func (namedTestFactory) CreateParser(_ TCPBidiID, _, _ reassembly.Sequence) TCPParser {
+	return nil
+}
+
+func selectorNames(s TCPParserFactorySelector) []string {
+	result := make([]string, 0, len(s))
+	for _, f := range s {
+		result = append(result, f.Name())
+	}
+	return result
+}
+
+func TestTCPParserRegistry(t *testing.T) {
+	r := NewTCPParserRegistry()
+	registrations := []TCPParserRegistration{
+		{Name: "http", Factory: namedTestFactory("http"), Priority: 10},
+		{Name: "tls", Factory: namedTestFactory("tls"), PortHints: []int{443}},
+		{Name: "http2", Factory: namedTestFactory("http2"), Priority: 5},
+		{Name: "postgres", Factory: namedTestFactory("postgres"), PortHints: []int{5432}, PortHintsOnly: true},
+	}
+	for _, reg := range registrations {
+		assert.NoError(t, r.Register(reg))
+	}
+
+	assert.Error(t, r.Register(TCPParserRegistration{Name: "http", Factory: namedTestFactory("http")}))
+	assert.Error(t, r.Register(TCPParserRegistration{Name: "nofactory"}))
+	assert.Error(t, r.Register(TCPParserRegistration{Name: "nohints", Factory: namedTestFactory("nohints"), PortHintsOnly: true}))
+
+	assert.Equal(t, []string{"http", "http2", "tls"}, selectorNames(r.Selector(51234, 80)))
+	assert.Equal(t, []string{"tls", "http", "http2"}, selectorNames(r.Selector(51234, 443)))
+	assert.Equal(t, []string{"tls", "http", "http2"}, selectorNames(r.Selector(443, 51234)))
+	assert.Equal(t, []string{"postgres", "http", "http2", "tls"}, selectorNames(r.Selector(51234, 5432)))
+	assert.Equal(t, []string{"postgres", "tls", "http", "http2"}, selectorNames(r.Selector(443, 5432)))
+
+	r.Disable("http", "postgres")
+	assert.Equal(t, []string{"http2", "tls"}, selectorNames(r.Selector(51234, 5432)))
+
+	r.Enable("http")
+	assert.Equal(t, []string{"http", "http2", "tls"}, selectorNames(r.Selector(51234, 5432)))
+
+	// Selectors for pairs of hinted ports are cached, and the cache is cleared
+	// when the registry changes.
+	r.Enable("postgres")
+	assert.Equal(t, []string{"postgres", "tls", "http", "http2"}, selectorNames(r.Selector(443, 5432)))
+	assert.Len(t, r.selectorsByPortPair, 1)
+	r.Disable("http2")
+	assert.Empty(t, r.selectorsByPortPair)
+	assert.Equal(t, []string{"postgres", "tls", "http"}, selectorNames(r.Selector(443, 5432)))
+
+	// Callers can't modify the registry's selectors.
+	for _, ports := range [][2]int{{51234, 80}, {51234, 443}, {443, 5432}} {
+		selector := r.Selector(ports[0], ports[1])
+		expected := selectorNames(selector)
+		selector[0] = namedTestFactory("changed")
+		assert.Equal(t, expected, selectorNames(r.Selector(ports[0], ports[1])))
+	}
+}
@@ -0,0 +1,295 @@
+package akinet
+
+import (
+	"container/list"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/akitasoftware/akita-libs/client_telemetry"
+)
+
+type SamplerConfig struct {
+	// A number in the range [0,1], indicating the fraction of HTTP requests to
+	// keep before rate limiting is applied. This has the same meaning as
+	// daemon.LoggingOptions.SamplingRate: zero keeps no HTTP requests. Nil
+	// keeps every request.
+	SamplingRate *float32
+
+	// The maximum number of HTTP requests per minute to keep across all
+	// endpoints. Non-positive means unlimited. This has the same meaning as
+	// api_schema.PostClientPacketCaptureStatsRequest.AgentRateLimit.
+	RateLimit float64
+
+	// The maximum number of HTTP requests per minute to keep for any single
+	// endpoint, so that one busy endpoint cannot use up the global rate limit.
+	// Endpoints are identified by host, method and path, with numeric and UUID
+	// path segments treated as the same, so that /users/1 and /users/2 share a
+	// limit. Non-positive means unlimited.
+	PerEndpointRateLimit float64
+
+	// If non-nil, called once for every HTTP request dropped by a rate limit.
+	// The argument is a PacketCounts delta with the flow fields populated and
+	// HTTPRequestsRateLimited set to 1, suitable for passing to
+	// PacketCounts.Add.
+	CountRateLimited func(client_telemetry.PacketCounts)
+}
+
+// The maximum number of per-endpoint token buckets and outstanding request
+// decisions a Sampler remembers. When there are too many endpoints, the least
+// recently used one is forgotten.
+const maxSamplerEntries = 10000
+
+// Decides which HTTP requests to keep by applying a sampling rate, a global
+// rate limit, and a per-endpoint rate limit. The response for an HTTP request
+// is kept or dropped along with its request. All other traffic is kept.
+//
+// Safe for concurrent use.
+type Sampler struct {
+	config SamplerConfig
+
+	// The fraction of HTTP requests to keep, from config.SamplingRate.
+	samplingRate float32
+
+	mu sync.Mutex
+
+	global *tokenBucket
+
+	// Maps endpoint keys to their elements in endpointsByUse.
+	endpoints map[endpointKey]*list.Element
+
+	// Holds an *endpointBucket for each endpoint, most recently used first.
+	endpointsByUse *list.List
+
+	// Maps stream keys of HTTP requests to whether they were kept.
+	requestDecisions map[string]bool
+
+	now  func() time.Time
+	rand *rand.Rand
+}
+
+func NewSampler(config SamplerConfig) *Sampler {
+	samplingRate := float32(1)
+	if config.SamplingRate != nil {
+		samplingRate = *config.SamplingRate
+	}
+
+	s := &Sampler{
+		config:           config,
+		samplingRate:     samplingRate,
+		endpoints:        make(map[endpointKey]*list.Element),
+		endpointsByUse:   list.New(),
+		requestDecisions: make(map[string]bool),
+		now:              time.Now,
+		rand:             rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if config.RateLimit > 0 {
+		s.global = newTokenBucket(config.RateLimit, s.now())
+	}
+	return s
+}
+
+type endpointKey struct {
+	host   string
+	method string
+	path   string
+}
+
+type endpointBucket struct {
+	key    endpointKey
+	bucket *tokenBucket
+}
+
+// Returns the given URL path with numeric and UUID segments replaced by "{}".
+func normalizeEndpointPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if isIDSegment(segment) {
+			segments[i] = "{}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func isIDSegment(segment string) bool {
+	if segment == "" {
+		return false
+	}
+	if strings.Trim(segment, "0123456789") == "" {
+		return true
+	}
+	if len(segment) == 36 {
+		_, err := uuid.Parse(segment)
+		return err == nil
+	}
+	return false
+}
+
+// Returns true if the given traffic should be kept.
+func (s *Sampler) Keep(t ParsedNetworkTraffic) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch c := t.Content.(type) {
+	case HTTPRequest:
+		kept := s.keepRequest(t, c)
+		if len(s.requestDecisions) >= maxSamplerEntries {
+			// Responses for some requests were never seen. Start over rather than
+			// grow without bound.
+			s.requestDecisions = make(map[string]bool)
+		}
+		s.requestDecisions[c.GetStreamKey()] = kept
+		return kept
+	case HTTPResponse:
+		key := c.GetStreamKey()
+		if kept, ok := s.requestDecisions[key]; ok {
+			delete(s.requestDecisions, key)
+			return kept
+		}
+		return true
+	default:
+		return true
+	}
+}
+
+func (s *Sampler) keepRequest(t ParsedNetworkTraffic, req HTTPRequest) bool {
+	if s.samplingRate < 1 && s.rand.Float32() >= s.samplingRate {
+		return false
+	}
+
+	now := s.now()
+
+	var endpoint *tokenBucket
+	if s.config.PerEndpointRateLimit > 0 {
+		key := endpointKey{
+			host:   stripPort(req.Host),
+			method: req.Method,
+		}
+		if req.URL != nil {
+			key.path = normalizeEndpointPath(req.URL.Path)
+		}
+		endpoint = s.endpointBucket(key, now)
+	}
+
+	// Only take tokens if both buckets have one available, so that requests
+	// dropped by one limit don't count against the other.
+	if !endpoint.available(now) || !s.global.available(now) {
+		s.countRateLimited(t)
+		return false
+	}
+	endpoint.take()
+	s.global.take()
+	return true
+}
+
+// Returns the token bucket for the given endpoint, creating it if needed and
+// marking it as the most recently used.
+func (s *Sampler) endpointBucket(key endpointKey, now time.Time) *tokenBucket {
+	if elt, ok := s.endpoints[key]; ok {
+		s.endpointsByUse.MoveToFront(elt)
+		return elt.Value.(*endpointBucket).bucket
+	}
+
+	if len(s.endpoints) >= maxSamplerEntries {
+		oldest := s.endpointsByUse.Back()
+		s.endpointsByUse.Remove(oldest)
+		delete(s.endpoints, oldest.Value.(*endpointBucket).key)
+	}
+	b := &endpointBucket{
+		key:    key,
+		bucket: newTokenBucket(s.config.PerEndpointRateLimit, now),
+	}
+	s.endpoints[key] = s.endpointsByUse.PushFront(b)
+	return b.bucket
+}
+
+func (s *Sampler) countRateLimited(t ParsedNetworkTraffic) {
+	if s.config.CountRateLimited == nil {
+		return
+	}
+
+	s.config.CountRateLimited(client_telemetry.PacketCounts{
+		Interface:               t.Interface,
+		SrcHost:                 ipString(t.SrcIP),
+		DstHost:                 ipString(t.DstIP),
+		SrcPort:                 t.SrcPort,
+		DstPort:                 t.DstPort,
+		HTTPRequestsRateLimited: 1,
+	})
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// Returns a channel carrying the traffic from in that is kept by the given
+// sampler. The buffers held by dropped traffic are released.
+func SampleTraffic(in <-chan ParsedNetworkTraffic, s *Sampler) <-chan ParsedNetworkTraffic {
+	out := make(chan ParsedNetworkTraffic)
+
+	go func() {
+		defer close(out)
+		for t := range in {
+			if s.Keep(t) {
+				out <- t
+			} else if t.Content != nil {
+				t.Content.ReleaseBuffers()
+			}
+		}
+	}()
+
+	return out
+}
+
+// A token bucket that refills continuously at a fixed rate and holds up to one
+// second's worth of tokens (but at least one). A nil bucket always has tokens
+// available.
+type tokenBucket struct {
+	// Refill rate, in tokens per second.
+	rate float64
+
+	capacity float64
+	tokens   float64
+	lastFill time.Time
+}
+
+func newTokenBucket(perMinute float64, now time.Time) *tokenBucket {
+	rate := perMinute / 60
+	capacity := math.Max(1, rate)
+	return &tokenBucket{
+		rate:     rate,
+		capacity: capacity,
+		tokens:   capacity,
+		lastFill: now,
+	}
+}
+
+// Refills the bucket and returns whether a token is available.
+func (b *tokenBucket) available(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	if elapsed := now.Sub(b.lastFill); elapsed > 0 {
+		b.tokens = math.Min(b.capacity, b.tokens+elapsed.Seconds()*b.rate)
+		b.lastFill = now
+	}
+	return b.tokens >= 1
+}
+
+// Removes a token from the bucket. Callers must first check that a token is
+// available.
+func (b *tokenBucket) take() {
+	if b == nil {
+		return
+	}
+	b.tokens--
+}
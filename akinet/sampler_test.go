@@ -0,0 +1,167 @@
+package akinet
+
+import (
+	"fmt"
+	"math/rand"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/akitasoftware/akita-libs/client_telemetry"
+)
+
+func makeSamplerRequest(path string) (ParsedNetworkTraffic, ParsedNetworkTraffic) {
+	id := uuid.New()
+	req := ParsedNetworkTraffic{
+		Interface: "eth0",
+		DstPort:   80,
+		Content: HTTPRequest{
+			StreamID: id,
+			Method:   "GET",
+			Host:     "example.com",
+			URL:      &url.URL{Path: path},
+		},
+	}
+	resp := ParsedNetworkTraffic{
+		Interface: "eth0",
+		SrcPort:   80,
+		Content:   HTTPResponse{StreamID: id},
+	}
+	return req, resp
+}
+
+func TestSamplerRateLimits(t *testing.T) {
+	var counts client_telemetry.PacketCounts
+	s := NewSampler(SamplerConfig{
+		RateLimit:            180, // 3 per second
+		PerEndpointRateLimit: 120, // 2 per second
+		CountRateLimited:     counts.Add,
+	})
+	now := time.Unix(0, 0)
+	s.now = func() time.Time { return now }
+	s.global = newTokenBucket(180, now)
+
+	// The hot endpoint is limited to two requests per second, which leaves room
+	// for the cold endpoint.
+	var keptHot, keptCold int
+	for i := 0; i < 10; i++ {
+		req, resp := makeSamplerRequest("/hot")
+		kept := s.Keep(req)
+		assert.Equal(t, kept, s.Keep(resp), "response should follow request")
+		if kept {
+			keptHot++
+		}
+	}
+	req, _ := makeSamplerRequest("/cold")
+	if s.Keep(req) {
+		keptCold++
+	}
+	assert.Equal(t, 2, keptHot)
+	assert.Equal(t, 1, keptCold)
+
+	// The global limit is exhausted.
+	req, _ = makeSamplerRequest("/other")
+	assert.False(t, s.Keep(req))
+
+	assert.Equal(t, 9, counts.HTTPRequestsRateLimited)
+
+	// Tokens are refilled over time.
+	now = now.Add(time.Second)
+	req, _ = makeSamplerRequest("/hot")
+	assert.True(t, s.Keep(req))
+}
+
+func TestSamplerSamplingRate(t *testing.T) {
+	rate := float32(0.5)
+	s := NewSampler(SamplerConfig{SamplingRate: &rate})
+	s.rand = rand.New(rand.NewSource(1))
+	var kept int
+	for i := 0; i < 1000; i++ {
+		req, resp := makeSamplerRequest("/")
+		k := s.Keep(req)
+		assert.Equal(t, k, s.Keep(resp), "response should follow request")
+		if k {
+			kept++
+		}
+	}
+	assert.InDelta(t, 500, kept, 100)
+	assert.True(t, s.Keep(ParsedNetworkTraffic{Content: AkitaPrince("prince")}))
+
+	// An unset sampling rate keeps everything.
+	s = NewSampler(SamplerConfig{})
+	req, resp := makeSamplerRequest("/")
+	assert.True(t, s.Keep(req))
+	assert.True(t, s.Keep(resp))
+
+	// A sampling rate of zero keeps no HTTP requests.
+	rate = 0
+	s = NewSampler(SamplerConfig{SamplingRate: &rate})
+	req, resp = makeSamplerRequest("/")
+	assert.False(t, s.Keep(req))
+	assert.False(t, s.Keep(resp))
+	assert.True(t, s.Keep(ParsedNetworkTraffic{Content: AkitaPrince("prince")}))
+}
+
+func TestSamplerNormalizesEndpoints(t *testing.T) {
+	s := NewSampler(SamplerConfig{PerEndpointRateLimit: 60})
+	now := time.Unix(0, 0)
+	s.now = func() time.Time { return now }
+
+	// Requests for different IDs share one endpoint's limit.
+	req, _ := makeSamplerRequest("/users/1/orders")
+	assert.True(t, s.Keep(req))
+	req, _ = makeSamplerRequest("/users/2/orders")
+	assert.False(t, s.Keep(req))
+	req, _ = makeSamplerRequest("/users/" + uuid.New().String() + "/orders")
+	assert.False(t, s.Keep(req))
+	req, _ = makeSamplerRequest("/users/me/orders")
+	assert.True(t, s.Keep(req))
+	assert.Equal(t, 2, len(s.endpoints))
+}
+
+func TestSamplerEvictsLeastRecentlyUsedEndpoint(t *testing.T) {
+	s := NewSampler(SamplerConfig{PerEndpointRateLimit: 60})
+	now := time.Unix(0, 0)
+	s.now = func() time.Time { return now }
+
+	// Exhaust the hot endpoint's limit, then touch it again after filling the
+	// table, so that it survives eviction and stays limited.
+	req, _ := makeSamplerRequest("/hot")
+	assert.True(t, s.Keep(req))
+	for i := 0; i < maxSamplerEntries-1; i++ {
+		req, _ = makeSamplerRequest(fmt.Sprintf("/cold/x%d", i))
+		assert.True(t, s.Keep(req))
+		if i == 0 {
+			req, _ = makeSamplerRequest("/hot")
+			assert.False(t, s.Keep(req))
+		}
+	}
+	assert.Equal(t, maxSamplerEntries, len(s.endpoints))
+
+	req, _ = makeSamplerRequest("/new")
+	assert.True(t, s.Keep(req))
+	assert.Equal(t, maxSamplerEntries, len(s.endpoints))
+
+	// The least recently used endpoint was forgotten, not the hot one.
+	_, ok := s.endpoints[endpointKey{host: "example.com", method: "GET", path: "/cold/x0"}]
+	assert.False(t, ok)
+	req, _ = makeSamplerRequest("/hot")
+	assert.False(t, s.Keep(req))
+}
+
+func TestNormalizeEndpointPath(t *testing.T) {
+	testCases := map[string]string{
+		"":             "",
+		"/":            "/",
+		"/v1/users/42": "/v1/users/{}",
+		"/users/6ba7b810-9dad-11d1-80b4-00c04fd430c8/x": "/users/{}/x",
+		"/users/me":     "/users/me",
+		"/files/42.txt": "/files/42.txt",
+	}
+	for path, expected := range testCases {
+		assert.Equal(t, expected, normalizeEndpointPath(path), path)
+	}
+}
@@ -29,10 +29,12 @@ func (*tlsClientHelloParser) Name() string {
 
 func (parser *tlsClientHelloParser) Parse(input memview.MemView, isEnd bool) (result akinet.ParsedNetworkContent, unused memview.MemView, totalBytesConsumed int64, err error) {
 	result, numBytesConsumed, err := parser.parse(input)
-	// It's an error if we're at the end and we don't yet have a result.
-	if isEnd && result == nil && err == nil {
-		// We never got the full TLS record. This is an error.
-		err = errors.New("incomplete TLS record for Client Hello")
+	if err != nil {
+		err = akinet.NewParseError(akinet.ParseErrorMalformed, parser.Name(), err)
+	} else if isEnd && result == nil {
+		// It's an error if we're at the end and we don't yet have a result. We
+		// never got the full TLS record.
+		err = akinet.NewParseError(akinet.ParseErrorTLSRecordIncomplete, parser.Name(), errors.New("incomplete TLS record for Client Hello"))
 	}
 
 	totalBytesConsumed = parser.allInput.Len()
@@ -0,0 +1,123 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akitasoftware/akita-libs/test"
+)
+
+// Wraps a net.Conn, recording everything written to it.
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(b)
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *recordingConn) bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.written.Bytes()...)
+}
+
+// Performs a TLS handshake over an in-memory connection with the given
+// maximum version, returning the bytes sent by the client and the server.
+func recordHandshake(tb testing.TB, maxVersion uint16) (clientBytes, serverBytes []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com", "www.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	clientSide, serverSide := net.Pipe()
+	clientConn := &recordingConn{Conn: clientSide}
+	serverConn := &recordingConn{Conn: serverSide}
+
+	server := tls.Server(serverConn, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{certDER}, PrivateKey: key}},
+		MaxVersion:   maxVersion,
+		NextProtos:   []string{"http/1.1"},
+	})
+	client := tls.Client(clientConn, &tls.Config{
+		ServerName:         "example.com",
+		InsecureSkipVerify: true,
+		MaxVersion:         maxVersion,
+		NextProtos:         []string{"h2", "http/1.1"},
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Handshake()
+	}()
+	if err := client.Handshake(); err != nil {
+		tb.Fatal(err)
+	}
+
+	// Close the underlying connection rather than the TLS connection, since
+	// closing the TLS connection waits for the peer to read a close_notify.
+	clientSide.Close()
+	wg.Wait()
+
+	return clientConn.bytes(), serverConn.bytes()
+}
+
+var fuzzChunkSeeds = [][]byte{nil, {1}, {5, 0, 11}, {64}}
+
+func FuzzTLSClientParser(f *testing.F) {
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		clientBytes, _ := recordHandshake(f, version)
+		for _, chunks := range fuzzChunkSeeds {
+			f.Add(clientBytes, chunks)
+		}
+	}
+	f.Add(clientHelloHandshakeBytes, []byte{})
+
+	factory := NewTLSClientParserFactory()
+	f.Fuzz(func(t *testing.T, data []byte, chunkSizes []byte) {
+		test.CheckTCPParserFactory(t, factory, data, chunkSizes)
+	})
+}
+
+func FuzzTLSServerParser(f *testing.F) {
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		_, serverBytes := recordHandshake(f, version)
+		for _, chunks := range fuzzChunkSeeds {
+			f.Add(serverBytes, chunks)
+		}
+	}
+	f.Add(serverHelloHandshakeBytes, []byte{})
+
+	factory := NewTLSServerParserFactory()
+	f.Fuzz(func(t *testing.T, data []byte, chunkSizes []byte) {
+		test.CheckTCPParserFactory(t, factory, data, chunkSizes)
+	})
+}
@@ -30,10 +30,12 @@ func (*tlsServerHelloParser) Name() string {
 
 func (parser *tlsServerHelloParser) Parse(input memview.MemView, isEnd bool) (result akinet.ParsedNetworkContent, unused memview.MemView, totalBytesConsumed int64, err error) {
 	result, numBytesConsumed, err := parser.parse(input)
-	// It's an error if we're at the end and we don't yet have a result.
-	if isEnd && result == nil && err == nil {
-		// We never got the full TLS record. This is an error.
-		err = errors.New("incomplete TLS record for Server Hello")
+	if err != nil {
+		err = akinet.NewParseError(akinet.ParseErrorMalformed, parser.Name(), err)
+	} else if isEnd && result == nil {
+		// It's an error if we're at the end and we don't yet have a result. We
+		// never got the full TLS record.
+		err = akinet.NewParseError(akinet.ParseErrorTLSRecordIncomplete, parser.Name(), errors.New("incomplete TLS record for Server Hello"))
 	}
 
 	totalBytesConsumed = parser.allInput.Len()
@@ -171,15 +173,18 @@ func (parser *tlsServerHelloParser) parse(input memview.MemView) (result akinet.
 		// The last two bytes of the record header give the total length of the
 		// handshake message that appears after the record header.
 		handshakeMsgLen_bytes := buf.GetUint16(tlsRecordHeaderLength_bytes - 2)
-		handshakeMsgEndPos = int64(tlsRecordHeaderLength_bytes + handshakeMsgLen_bytes)
+		certMsgEndPos := int64(tlsRecordHeaderLength_bytes + handshakeMsgLen_bytes)
 
 		// Wait until we have the full handshake record.
-		if buf.Len() < handshakeMsgEndPos {
+		if buf.Len() < certMsgEndPos {
 			return nil, 0, nil
 		}
 
+		// The bytes consumed extend through the end of the second record.
+		handshakeMsgEndPos += certMsgEndPos
+
 		// Get a Memview of the handshake record.
-		buf = buf.SubView(tlsRecordHeaderLength_bytes, handshakeMsgEndPos)
+		buf = buf.SubView(tlsRecordHeaderLength_bytes, certMsgEndPos)
 		reader := buf.CreateReader()
 
 		// The first byte of the handshake message gives its type. Expect a
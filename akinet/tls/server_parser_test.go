@@ -0,0 +1,62 @@
+package tls
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"testing"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+// Parses a TLS 1.2 Server Hello, whose certificate arrives in a second TLS
+// record, fed to the parser in small chunks.
+func TestTLS12ServerHelloWithCertificateRecord(t *testing.T) {
+	_, serverBytes := recordHandshake(t, tls.VersionTLS12)
+
+	// The Server Hello and Certificate messages are in the first two records.
+	helloRecordLen := 5 + int64(binary.BigEndian.Uint16(serverBytes[3:5]))
+	certRecordLen := 5 + int64(binary.BigEndian.Uint16(serverBytes[helloRecordLen+3:helloRecordLen+5]))
+	if serverBytes[helloRecordLen+5] != 0x0b {
+		t.Fatalf("expected a certificate message in the second record, got type %d", serverBytes[helloRecordLen+5])
+	}
+	expectedConsumed := helloRecordLen + certRecordLen
+
+	for _, chunkSize := range []int{1, 7, len(serverBytes)} {
+		p := newTLSServerHelloParser(akinet.TCPBidiID{})
+
+		var result akinet.ParsedNetworkContent
+		var unused memview.MemView
+		var consumed int64
+		var err error
+		for start := 0; start < len(serverBytes) && result == nil; start += chunkSize {
+			end := start + chunkSize
+			if end > len(serverBytes) {
+				end = len(serverBytes)
+			}
+			result, unused, consumed, err = p.Parse(memview.New(serverBytes[start:end]), end == len(serverBytes))
+			if err != nil {
+				t.Fatalf("[chunk size %d] unexpected error: %v", chunkSize, err)
+			}
+		}
+
+		hello, ok := result.(akinet.TLSServerHello)
+		if !ok {
+			t.Fatalf("[chunk size %d] expected a TLSServerHello, got %T", chunkSize, result)
+		}
+		if hello.Version != akinet.TLS_v1_2 {
+			t.Errorf("[chunk size %d] expected version %s, got %s", chunkSize, akinet.TLS_v1_2, hello.Version)
+		}
+		if len(hello.DNSNames) != 2 || hello.DNSNames[0] != "example.com" || hello.DNSNames[1] != "www.example.com" {
+			t.Errorf("[chunk size %d] unexpected DNS names %v", chunkSize, hello.DNSNames)
+		}
+
+		// Both records are consumed, and nothing after them.
+		if consumed != expectedConsumed {
+			t.Errorf("[chunk size %d] expected %d bytes consumed, got %d", chunkSize, expectedConsumed, consumed)
+		}
+		if consumed+unused.Len() != p.allInput.Len() {
+			t.Errorf("[chunk size %d] %d bytes consumed and %d unused, but %d bytes input", chunkSize, consumed, unused.Len(), p.allInput.Len())
+		}
+	}
+}
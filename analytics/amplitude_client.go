@@ -24,6 +24,7 @@ func newAmplitudeClient(config Config) (amplitude.Client, amplitude.EventOptions
 	amplitudeConfig := amplitude.NewConfig(rawAmplitudeConfig.AmplitudeAPIKey)
 
 	amplitudeConfig.Logger = provideAmplitudeLogger(rawAmplitudeConfig.IsLoggingEnabled)
+	amplitudeConfig.ExecuteCallback = logAmplitudeFailure
 
 	if rawAmplitudeConfig.IsBatchingEnabled {
 		amplitudeConfig.UseBatch = rawAmplitudeConfig.IsBatchingEnabled
@@ -93,3 +94,73 @@ func (d disabledAmplitudeLogger) Warnf(format string, args ...any) {
 func (d disabledAmplitudeLogger) Errorf(format string, args ...interface{}) {
 	// Do nothing.
 }
+
+// Logs events that the Amplitude client fails to deliver. The Amplitude client
+// sends events in the background, after amplitudeSink.Send has returned, so
+// these failures are not seen by the delivery queue.
+func logAmplitudeFailure(result amplitude.ExecuteResult) {
+	if result.Code >= 200 && result.Code < 300 {
+		return
+	}
+	eventType := ""
+	if result.Event != nil {
+		eventType = result.Event.EventType
+	}
+	glog.Warningf("failed to deliver analytics event %q to Amplitude: %d %s", eventType, result.Code, result.Message)
+}
+
+// Sends events tracked on the default channel to Amplitude.
+//
+// The Amplitude client queues events and sends them in the background, so Send
+// always succeeds once the event is queued, not once Amplitude has received
+// it. The Amplitude client retries failed requests itself; events it gives up
+// on are logged by logAmplitudeFailure, but are not retried by the delivery
+// queue or counted in DeliveryStats.Failed.
+type amplitudeSink struct {
+	client            amplitude.Client
+	appInfo           amplitude.EventOptions
+	isInternalService bool
+}
+
+var _ Sink = (*amplitudeSink)(nil)
+
+func newAmplitudeSink(config Config) (Sink, error) {
+	client, appInfo, err := newAmplitudeClient(config)
+	if err != nil || client == nil {
+		return nil, err
+	}
+
+	return &amplitudeSink{
+		client:            client,
+		appInfo:           appInfo,
+		isInternalService: config.IsInternalService,
+	}, nil
+}
+
+func (s *amplitudeSink) Send(event SinkEvent) error {
+	if event.Channel != DefaultChannel {
+		return nil
+	}
+
+	// Added prefix to follow naming convention and differentiate between agent and internal service
+	name := "Insights - Agent - " + event.Name
+	if s.isInternalService {
+		name = "Insights - " + event.Name
+	}
+
+	eventOptions := s.appInfo
+	eventOptions.Time = event.Timestamp.UnixMilli()
+
+	s.client.Track(amplitude.Event{
+		UserID:          event.DistinctID,
+		EventType:       name,
+		EventProperties: event.Properties,
+		EventOptions:    eventOptions,
+	})
+	return nil
+}
+
+func (s *amplitudeSink) Close() error {
+	s.client.Shutdown()
+	return nil
+}
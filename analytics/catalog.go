@@ -0,0 +1,295 @@
+package analytics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iancoleman/strcase"
+	"github.com/pkg/errors"
+)
+
+// The type of an event property's value.
+type PropertyType string
+
+const (
+	StringProperty  PropertyType = "string"
+	IntegerProperty PropertyType = "integer"
+	NumberProperty  PropertyType = "number"
+	BooleanProperty PropertyType = "boolean"
+	TimeProperty    PropertyType = "time"
+	ListProperty    PropertyType = "list"
+	ObjectProperty  PropertyType = "object"
+	AnyProperty     PropertyType = "any"
+)
+
+// Returns true if the given value is of this type. Integers are accepted as
+// numbers, and whole floating-point numbers as integers, since numbers decoded
+// from JSON are always float64.
+func (t PropertyType) accepts(value any) bool {
+	if t == AnyProperty {
+		return true
+	}
+	if value == nil {
+		return false
+	}
+
+	v := reflect.ValueOf(value)
+	switch t {
+	case StringProperty:
+		return v.Kind() == reflect.String
+	case IntegerProperty:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return true
+		case reflect.Float32, reflect.Float64:
+			f := v.Float()
+			return f == math.Trunc(f) && !math.IsInf(f, 0)
+		}
+		return false
+	case NumberProperty:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			return true
+		}
+		return false
+	case BooleanProperty:
+		return v.Kind() == reflect.Bool
+	case TimeProperty:
+		_, ok := value.(time.Time)
+		return ok
+	case ListProperty:
+		return v.Kind() == reflect.Slice || v.Kind() == reflect.Array
+	case ObjectProperty:
+		return v.Kind() == reflect.Map || v.Kind() == reflect.Struct
+	}
+	return false
+}
+
+// Describes a property of an event.
+type PropertyDefinition struct {
+	// The property's key, in snake case.
+	Name string
+
+	Type PropertyType
+
+	// Whether every event must have this property.
+	Required bool
+
+	Description string
+}
+
+// Describes an event and the properties it may have.
+type EventDefinition struct {
+	// The event's name, without any vendor-specific prefix.
+	Name string
+
+	Description string
+
+	// The properties the event may have. Events with other properties are
+	// invalid.
+	Properties []PropertyDefinition
+}
+
+// Checks that the given properties satisfy this definition. Keys are converted
+// to snake case before they are checked.
+func (d *EventDefinition) Validate(properties map[string]any) error {
+	var problems []string
+
+	defined := make(map[string]PropertyDefinition, len(d.Properties))
+	for _, p := range d.Properties {
+		defined[p.Name] = p
+	}
+
+	present := make(map[string]struct{}, len(properties))
+	for key, value := range properties {
+		key = strcase.ToSnake(key)
+		present[key] = struct{}{}
+
+		p, ok := defined[key]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown property %q", key))
+			continue
+		}
+		if !p.Type.accepts(value) {
+			problems = append(problems, fmt.Sprintf("property %q should be of type %s, not %T", key, p.Type, value))
+		}
+	}
+
+	for _, p := range d.Properties {
+		if _, ok := present[p.Name]; p.Required && !ok {
+			problems = append(problems, fmt.Sprintf("missing required property %q", p.Name))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return &ValidationError{EventName: d.Name, Problems: problems}
+	}
+	return nil
+}
+
+// Returns a new event of this kind, or an error if the properties do not
+// satisfy the definition.
+func (d *EventDefinition) NewEvent(distinctID string, properties map[string]any) (*Event, error) {
+	if err := d.Validate(properties); err != nil {
+		return nil, err
+	}
+	return NewEvent(distinctID, d.Name, properties), nil
+}
+
+// Returned when an event does not satisfy its definition, or has no
+// definition.
+type ValidationError struct {
+	EventName string
+	Problems  []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid analytics event %q: %s", e.EventName, strings.Join(e.Problems, "; "))
+}
+
+// A registry of event definitions.
+type Catalog struct {
+	mu     sync.RWMutex
+	events map[string]*EventDefinition
+}
+
+// The catalog used by clients whose configuration does not specify one.
+var DefaultCatalog = NewCatalog()
+
+func NewCatalog() *Catalog {
+	return &Catalog{
+		events: make(map[string]*EventDefinition),
+	}
+}
+
+// Adds an event definition to the default catalog. Panics if the definition is
+// invalid or the event is already defined; intended for package-level
+// variables.
+func RegisterEvent(def EventDefinition) *EventDefinition {
+	return DefaultCatalog.MustRegister(def)
+}
+
+// Adds an event definition to the catalog. Returns an error if the definition
+// is invalid or an event with the same name is already defined.
+func (c *Catalog) Register(def EventDefinition) (*EventDefinition, error) {
+	if def.Name == "" {
+		return nil, errors.New("event name cannot be empty")
+	}
+
+	seen := make(map[string]struct{}, len(def.Properties))
+	for _, p := range def.Properties {
+		if p.Name != strcase.ToSnake(p.Name) {
+			return nil, errors.Errorf("property %q of event %q is not in snake case", p.Name, def.Name)
+		}
+		if _, ok := seen[p.Name]; ok {
+			return nil, errors.Errorf("property %q of event %q is defined more than once", p.Name, def.Name)
+		}
+		seen[p.Name] = struct{}{}
+		if !p.Type.isValid() {
+			return nil, errors.Errorf("property %q of event %q has unknown type %q", p.Name, def.Name, p.Type)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.events[def.Name]; ok {
+		return nil, errors.Errorf("event %q is already defined", def.Name)
+	}
+
+	// Copy the definition so that later changes by the caller have no effect.
+	def.Properties = append([]PropertyDefinition(nil), def.Properties...)
+	c.events[def.Name] = &def
+	return &def, nil
+}
+
+// Like Register, but panics on error.
+func (c *Catalog) MustRegister(def EventDefinition) *EventDefinition {
+	result, err := c.Register(def)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// Returns the definition of the named event, if any.
+func (c *Catalog) Lookup(name string) (*EventDefinition, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	def, ok := c.events[name]
+	return def, ok
+}
+
+// Checks that the event is defined and satisfies its definition.
+func (c *Catalog) Validate(event *Event) error {
+	def, ok := c.Lookup(event.name)
+	if !ok {
+		return &ValidationError{EventName: event.name, Problems: []string{"event is not defined"}}
+	}
+	return def.Validate(event.properties)
+}
+
+// Returns the catalog's definitions, sorted by name.
+func (c *Catalog) Definitions() []*EventDefinition {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	result := make([]*EventDefinition, 0, len(c.events))
+	for _, def := range c.events {
+		result = append(result, def)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// Writes a Markdown document describing every event in the catalog, for
+// people building dashboards.
+func (c *Catalog) WriteMarkdown(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("# Analytics events\n")
+	for _, def := range c.Definitions() {
+		fmt.Fprintf(&b, "\n## %s\n\n", def.Name)
+		if def.Description != "" {
+			fmt.Fprintf(&b, "%s\n\n", def.Description)
+		}
+		if len(def.Properties) == 0 {
+			b.WriteString("No properties.\n")
+			continue
+		}
+		b.WriteString("| Property | Type | Required | Description |\n")
+		b.WriteString("|---|---|---|---|\n")
+		for _, p := range def.Properties {
+			required := "no"
+			if p.Required {
+				required = "yes"
+			}
+			fmt.Fprintf(&b, "| `%s` | %s | %s | %s |\n", p.Name, p.Type, required, escapeMarkdownCell(p.Description))
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return errors.Wrap(err, "unable to write event catalog")
+}
+
+func escapeMarkdownCell(s string) string {
+	s = strings.ReplaceAll(s, "|", `\|`)
+	return strings.ReplaceAll(s, "\n", " ")
+}
+
+func (t PropertyType) isValid() bool {
+	switch t {
+	case StringProperty, IntegerProperty, NumberProperty, BooleanProperty,
+		TimeProperty, ListProperty, ObjectProperty, AnyProperty:
+		return true
+	}
+	return false
+}
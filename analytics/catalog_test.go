@@ -0,0 +1,117 @@
+package analytics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCatalog(t *testing.T) (*Catalog, *EventDefinition) {
+	catalog := NewCatalog()
+	def, err := catalog.Register(EventDefinition{
+		Name:        "Trace Started",
+		Description: "A user started capturing traffic.",
+		Properties: []PropertyDefinition{
+			{Name: "trace_name", Type: StringProperty, Required: true, Description: "The name of the trace."},
+			{Name: "packet_count", Type: IntegerProperty},
+			{Name: "filters", Type: ListProperty, Description: "BPF filters | if any"},
+		},
+	})
+	assert.NoError(t, err)
+	return catalog, def
+}
+
+func TestEventDefinitionValidate(t *testing.T) {
+	_, def := newTestCatalog(t)
+
+	assert.NoError(t, def.Validate(map[string]any{"traceName": "foo"}))
+	assert.NoError(t, def.Validate(map[string]any{"trace_name": "foo", "packet_count": float64(3), "filters": []string{"port 80"}}))
+
+	err := def.Validate(map[string]any{"trace_nmae": "foo", "packet_count": 1.5})
+	if assert.IsType(t, &ValidationError{}, err) {
+		assert.Equal(t, []string{
+			`missing required property "trace_name"`,
+			`property "packet_count" should be of type integer, not float64`,
+			`unknown property "trace_nmae"`,
+		}, err.(*ValidationError).Problems)
+	}
+
+	_, err = def.NewEvent("user", nil)
+	assert.Error(t, err)
+	event, err := def.NewEvent("user", map[string]any{"trace_name": "foo"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Trace Started", event.Name())
+}
+
+func TestCatalogRegister(t *testing.T) {
+	catalog, _ := newTestCatalog(t)
+
+	_, err := catalog.Register(EventDefinition{Name: "Trace Started"})
+	assert.Error(t, err, "duplicate event")
+	_, err = catalog.Register(EventDefinition{Name: "A", Properties: []PropertyDefinition{{Name: "traceName", Type: StringProperty}}})
+	assert.Error(t, err, "property not in snake case")
+	_, err = catalog.Register(EventDefinition{Name: "B", Properties: []PropertyDefinition{{Name: "x", Type: "str"}}})
+	assert.Error(t, err, "unknown type")
+
+	assert.Error(t, catalog.Validate(NewEvent("user", "Trace Stopped", nil)))
+}
+
+func TestCatalogWriteMarkdown(t *testing.T) {
+	catalog, _ := newTestCatalog(t)
+	catalog.MustRegister(EventDefinition{Name: "Login"})
+
+	var b strings.Builder
+	assert.NoError(t, catalog.WriteMarkdown(&b))
+	assert.Equal(t, `# Analytics events
+
+## Login
+
+No properties.
+
+## Trace Started
+
+A user started capturing traffic.
+
+| Property | Type | Required | Description |
+|---|---|---|---|
+| `+"`trace_name`"+` | string | yes | The name of the trace. |
+| `+"`packet_count`"+` | integer | no |  |
+| `+"`filters`"+` | list | no | BPF filters \| if any |
+`, b.String())
+}
+
+func TestClientValidatesEvents(t *testing.T) {
+	catalog, def := newTestCatalog(t)
+	recorder := NewRecordingSink()
+	client, err := NewClient(Config{
+		EventValidation: RejectInvalidEvents,
+		Catalog:         catalog,
+		Sinks:           []Sink{recorder},
+	})
+	assert.NoError(t, err)
+
+	assert.Error(t, client.TrackSegmentEvent(NewEvent("user", "Trace Started", map[string]any{"traceNmae": "foo"})))
+	assert.Error(t, client.TrackSegmentEvent(NewEvent("user", "Unknown", nil)))
+
+	// Tracking the same event twice sends the same name twice.
+	event, err := def.NewEvent("user", map[string]any{"trace_name": "foo"})
+	assert.NoError(t, err)
+	client.TrackEvent(event)
+	assert.NoError(t, client.TrackSegmentEvent(event))
+
+	events := recorder.Events()
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "Trace Started", events[0].Name)
+		assert.Equal(t, "Trace Started", events[1].Name)
+	}
+	assert.Equal(t, int64(2), client.DeliveryStats().Dropped)
+}
+
+func TestEventIsImmutable(t *testing.T) {
+	properties := map[string]any{"a": 1}
+	event := NewEvent("user", "Event", properties)
+	properties["a"] = 2
+	event.Properties()["a"] = 3
+	assert.Equal(t, map[string]any{"a": 1}, event.Properties())
+}
@@ -1,22 +1,36 @@
 package analytics
 
 import (
-	"github.com/amplitude/analytics-go/amplitude"
+	"context"
+	"sync/atomic"
+
+	"github.com/golang/glog"
 	"github.com/iancoleman/strcase"
 	"github.com/pkg/errors"
-	segmentAnalytics "github.com/segmentio/analytics-go/v3"
 )
 
 type Client interface {
-	// Sends the given tracking event to Amplitude (if enabled).
+	// Sends the given tracking event to Amplitude (if enabled) and to any
+	// other enabled sinks.
 	TrackEvent(event *Event)
 
 	// A shorthand wrapper method for TrackEvent that sends a tracking event with the given distinct id, name and properties.
 	Track(distinctID string, name string, properties map[string]any)
 
-	// Sends the given tracking event to Segment (if enabled).
+	// Sends the given tracking event to Segment (if enabled) and to any other
+	// enabled sinks.
 	TrackSegmentEvent(event *Event) error
 
+	// Waits until queued events have been delivered, or until the context is
+	// done. Returns the number of events that failed or were dropped since the
+	// last call to Flush.
+	Flush(ctx context.Context) (int, error)
+
+	// Returns counts of events by delivery outcome.
+	DeliveryStats() DeliveryStats
+
+	// Delivers queued events, waiting up to the queue's close timeout, and
+	// shuts down the sinks.
 	Close() error
 }
 
@@ -37,6 +51,15 @@ func (NullClient) TrackSegmentEvent(*Event) error {
 	return nil
 }
 
+func (NullClient) Flush(context.Context) (int, error) {
+	// Do nothing.
+	return 0, nil
+}
+
+func (NullClient) DeliveryStats() DeliveryStats {
+	return DeliveryStats{}
+}
+
 func (NullClient) Close() error {
 	// Do nothing.
 	return nil
@@ -46,32 +69,67 @@ type clientImpl struct {
 	// The analytics client configuration.
 	config Config
 
-	// The internal client used to send events to Amplitude.
-	amplitudeClient amplitude.Client
+	// The catalog to validate events against, or nil if validation is
+	// disabled.
+	catalog *Catalog
+
+	// Removes sensitive data from event properties.
+	scrubber *Scrubber
 
-	// This is included in all tracking events reported to Amplitude.
-	amplitudeAppInfo amplitude.EventOptions
+	// The destinations for tracked events.
+	sinks []namedSink
 
-	// The internal client used to send events to Segment.
-	segmentClient segmentAnalytics.Client
+	// Delivers events to the sinks in the background. Nil if the queue is
+	// disabled, in which case events are delivered synchronously.
+	queue *deliveryQueue
+
+	counters *deliveryCounters
 }
 
+// Returns a client that sends events to every sink enabled in the given
+// configuration, including those in config.Sinks.
 func NewClient(config Config) (Client, error) {
-	amplitudeClient, amplitudeAppInfo, err := newAmplitudeClient(config)
+	scrubber, err := NewScrubber(config.Scrubbing)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to create amplitude client")
+		return nil, errors.Wrap(err, "invalid scrubbing config")
+	}
+
+	var catalog *Catalog
+	switch config.EventValidation {
+	case NoEventValidation:
+	case WarnOnInvalidEvents, RejectInvalidEvents:
+		catalog = config.Catalog
+		if catalog == nil {
+			catalog = DefaultCatalog
+		}
+	default:
+		return nil, errors.Errorf("unknown event validation mode %q", config.EventValidation)
 	}
 
-	segmentClient, err := newSegmentClient(config)
+	sinks, err := newSinks(config)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to create segment client")
+		return nil, err
+	}
+
+	counters := &deliveryCounters{}
+	var queue *deliveryQueue
+	if config.IsQueueEnabled {
+		queue, err = newDeliveryQueue(config.QueueConfig, sinks, counters)
+		if err != nil {
+			for _, sink := range sinks {
+				sink.Close()
+			}
+			return nil, err
+		}
 	}
 
 	return &clientImpl{
-		config:           config,
-		amplitudeClient:  amplitudeClient,
-		amplitudeAppInfo: amplitudeAppInfo,
-		segmentClient:    segmentClient,
+		config:   config,
+		catalog:  catalog,
+		scrubber: scrubber,
+		sinks:    sinks,
+		queue:    queue,
+		counters: counters,
 	}, nil
 }
 
@@ -83,24 +141,50 @@ func convertToSnakeCase(properties map[string]any) map[string]any {
 	return snakeCaseProperties
 }
 
-func (c clientImpl) TrackEvent(event *Event) {
-	// Added prefix to follow naming convention and differentiate between agent and internal service
-	if c.config.IsInternalService {
-		event.name = "Insights - " + event.name
-	} else {
-		event.name = "Insights - Agent - " + event.name
+// Sends the event to every sink, or queues it for delivery if the queue is
+// enabled. Returns the first error encountered, after attempting delivery to
+// all sinks.
+func (c clientImpl) send(channel Channel, event *Event) error {
+	if c.catalog != nil {
+		if err := c.catalog.Validate(event); err != nil {
+			glog.Warning(err)
+			if c.config.EventValidation == RejectInvalidEvents {
+				atomic.AddInt64(&c.counters.dropped, 1)
+				return err
+			}
+		}
+	}
+
+	sinkEvent := SinkEvent{
+		Channel:    channel,
+		DistinctID: event.distinctID,
+		Name:       event.name,
+		// Postman's property naming convention in Amplitude and Segment is snake case. So convert event.properties keys to snake case.
+		Properties: c.scrubber.Scrub(event.name, convertToSnakeCase(event.properties)),
+		Timestamp:  event.timestamp,
 	}
 
-	// Postman's property naming convention in Amplitude is snake case. So convert event.properties keys to snake case.
-	properties := convertToSnakeCase(event.properties)
+	if c.queue != nil {
+		return c.queue.enqueue(sinkEvent)
+	}
 
-	if c.config.IsAmplitudeEnabled && c.amplitudeClient != nil {
-		c.amplitudeClient.Track(amplitude.Event{
-			UserID:          event.distinctID,
-			EventType:       event.name,
-			EventProperties: properties,
-			EventOptions:    c.amplitudeAppInfo,
-		})
+	var result error
+	for _, sink := range c.sinks {
+		if err := sink.Send(sinkEvent); err != nil && result == nil {
+			result = err
+		}
+	}
+	if result == nil {
+		atomic.AddInt64(&c.counters.delivered, 1)
+	} else {
+		atomic.AddInt64(&c.counters.failed, 1)
+	}
+	return result
+}
+
+func (c clientImpl) TrackEvent(event *Event) {
+	if err := c.send(DefaultChannel, event); err != nil {
+		glog.Errorf("failed to track analytics event %q: %v", event.name, err)
 	}
 }
 
@@ -109,38 +193,36 @@ func (c clientImpl) Track(distinctID string, name string, properties map[string]
 }
 
 func (c clientImpl) TrackSegmentEvent(event *Event) error {
-	var err error
+	return c.send(SegmentChannel, event)
+}
 
-	if c.config.IsInternalService {
-		event.name = "Insights " + event.name
-	} else {
-		event.name = "Insights Agent " + event.name
+func (c clientImpl) Flush(ctx context.Context) (int, error) {
+	var err error
+	if c.queue != nil {
+		err = c.queue.flush(ctx)
 	}
+	return c.counters.lossesSinceLastReport(), err
+}
 
-	// Postman's property naming convention in Segment is snake case. So convert event.properties keys to snake case.
-	properties := convertToSnakeCase(event.properties)
-
-	if c.config.IsSegmentEnabled && c.segmentClient != nil {
-		err = c.segmentClient.Enqueue(segmentAnalytics.Track{
-			UserId:     event.distinctID,
-			Event:      event.name,
-			Properties: properties,
-		})
+func (c clientImpl) DeliveryStats() DeliveryStats {
+	stats := c.counters.snapshot()
+	if c.queue != nil {
+		stats.Queued = c.queue.len()
 	}
-
-	return err
+	return stats
 }
 
+// Closes the queue, if any, then every sink. Returns the first error
+// encountered.
 func (c clientImpl) Close() error {
-	var err error
-
-	if c.amplitudeClient != nil {
-		c.amplitudeClient.Shutdown()
+	var result error
+	if c.queue != nil {
+		result = c.queue.close()
 	}
-
-	if c.segmentClient != nil {
-		err = c.segmentClient.Close()
+	for _, sink := range c.sinks {
+		if err := sink.Close(); err != nil && result == nil {
+			result = err
+		}
 	}
-
-	return err
+	return result
 }
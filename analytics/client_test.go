@@ -0,0 +1,104 @@
+package analytics
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordingSink(t *testing.T) {
+	recorder := NewRecordingSink()
+	client, err := NewClient(Config{Sinks: []Sink{recorder}})
+	assert.NoError(t, err)
+
+	client.Track("user", "Trace Started", map[string]any{"traceName": "foo"})
+	assert.NoError(t, client.TrackSegmentEvent(NewEvent("user", "Login", nil)))
+	assert.NoError(t, client.Close())
+
+	events := recorder.Events()
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, DefaultChannel, events[0].Channel)
+		assert.Equal(t, "user", events[0].DistinctID)
+		assert.Equal(t, "Trace Started", events[0].Name)
+		assert.Equal(t, map[string]any{"trace_name": "foo"}, events[0].Properties)
+		assert.False(t, events[0].Timestamp.IsZero())
+
+		assert.Equal(t, SegmentChannel, events[1].Channel)
+		assert.Equal(t, "Login", events[1].Name)
+	}
+	assert.True(t, recorder.IsClosed())
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	config := Config{
+		IsFileSinkEnabled: true,
+		FileSinkConfig:    FileSinkConfig{Path: path},
+	}
+
+	for i := 0; i < 2; i++ {
+		client, err := NewClient(config)
+		assert.NoError(t, err)
+		client.Track("user", "Event", map[string]any{"count": i})
+		assert.NoError(t, client.Close())
+	}
+
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	var events []SinkEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event SinkEvent
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "Event", events[0].Name)
+		assert.Equal(t, float64(0), events[0].Properties["count"])
+		assert.Equal(t, float64(1), events[1].Properties["count"])
+	}
+}
+
+func TestOTelSink(t *testing.T) {
+	var received otlpLogsRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("Authorization"))
+		body, _ := io.ReadAll(r.Body)
+		assert.NoError(t, json.Unmarshal(body, &received))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(Config{
+		App:           AppInfo{Name: "agent"},
+		IsOTelEnabled: true,
+		OTelConfig: OTelConfig{
+			Endpoint: server.URL,
+			Headers:  map[string]string{"Authorization": "secret"},
+		},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.TrackSegmentEvent(NewEvent("user", "Login", map[string]any{"attempts": 2})))
+	assert.NoError(t, client.Close())
+
+	if assert.Len(t, received.ResourceLogs, 1) {
+		logs := received.ResourceLogs[0]
+		assert.Equal(t, "agent", *logs.Resource.Attributes[0].Value.StringValue)
+		record := logs.ScopeLogs[0].LogRecords[0]
+		assert.Equal(t, "Login", *record.Body.StringValue)
+		assert.Contains(t, record.Attributes, otlpKeyValue{Key: "attempts", Value: toOTLPValue(2)})
+	}
+}
+
+func TestFileSinkRequiresPath(t *testing.T) {
+	_, err := NewClient(Config{IsFileSinkEnabled: true})
+	assert.Error(t, err)
+}
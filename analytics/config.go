@@ -19,8 +19,52 @@ type Config struct {
 
 	// Separate config for segment client
 	SegmentConfig SegmentConfig `yaml:"segment"`
+
+	// Toggle for writing events to a local file
+	IsFileSinkEnabled bool `yaml:"file_sink_enabled"`
+
+	// Separate config for the file sink
+	FileSinkConfig FileSinkConfig `yaml:"file_sink"`
+
+	// Toggle for exporting events to an OpenTelemetry collector
+	IsOTelEnabled bool `yaml:"otel_enabled"`
+
+	// Separate config for the OpenTelemetry sink
+	OTelConfig OTelConfig `yaml:"otel"`
+
+	// Toggle for delivering events in the background, with retries
+	IsQueueEnabled bool `yaml:"queue_enabled"`
+
+	// Separate config for the delivery queue
+	QueueConfig QueueConfig `yaml:"queue"`
+
+	// Controls the removal of sensitive data from event properties
+	Scrubbing ScrubbingConfig `yaml:"scrubbing"`
+
+	// Whether to check tracked events against the event catalog
+	EventValidation EventValidationMode `yaml:"event_validation"`
+
+	// The catalog to validate events against. Defaults to DefaultCatalog.
+	Catalog *Catalog `yaml:"-"`
+
+	// Additional sinks to send events to, such as a RecordingSink in tests
+	Sinks []Sink `yaml:"-"`
 }
 
+type EventValidationMode string
+
+const (
+	// Events are not validated.
+	NoEventValidation EventValidationMode = ""
+
+	// Invalid events are logged, then sent as usual.
+	WarnOnInvalidEvents EventValidationMode = "warn"
+
+	// Invalid events are logged and discarded. TrackSegmentEvent returns a
+	// ValidationError.
+	RejectInvalidEvents EventValidationMode = "reject"
+)
+
 // Data pertaining to the application such as name, version, and build
 // If set, the specified values will be added globally to each event context
 type AppInfo struct {
@@ -66,3 +110,76 @@ type SegmentConfig struct {
 	// Toggle for verbose logging
 	IsVerboseLoggingEnabled bool `yaml:"verbose_logging_enabled"`
 }
+
+type FileSinkConfig struct {
+	// The file to append events to, one JSON object per line. Created if it
+	// does not exist.
+	Path string `yaml:"path"`
+}
+
+type OTelConfig struct {
+	// The OTLP/HTTP logs endpoint, e.g. http://localhost:4318/v1/logs
+	Endpoint string `yaml:"endpoint"`
+
+	// Headers to include in each export request, e.g. for authentication
+	Headers map[string]string `yaml:"headers"`
+
+	// The timeout for each export request. Default 10s.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Controls how event properties are scrubbed before they are sent to any sink.
+// Property keys are matched after conversion to snake case. The zero value
+// disables scrubbing.
+type ScrubbingConfig struct {
+	// Properties whose keys match any of these regular expressions are removed.
+	// See DefaultSensitiveKeyPatterns.
+	DropKeyPatterns []string `yaml:"drop_key_patterns"`
+
+	// The values of properties whose keys match any of these regular expressions
+	// are replaced with a salted hash.
+	HashKeyPatterns []string `yaml:"hash_key_patterns"`
+
+	// Prepended to values before they are hashed
+	HashSalt string `yaml:"hash_salt"`
+
+	// Toggle for redacting emails, IP addresses and tokens in string values
+	RedactValues bool `yaml:"redact_values"`
+
+	// Maps event names, without vendor prefixes, to the only property keys
+	// allowed for those events. Events not listed are unrestricted, unless
+	// RequireAllowList is set.
+	AllowedProperties map[string][]string `yaml:"allowed_properties"`
+
+	// If set, all properties are removed from events not listed in
+	// AllowedProperties.
+	RequireAllowList bool `yaml:"require_allow_list"`
+
+	// String values longer than this many bytes are truncated. Zero means no
+	// limit.
+	MaxValueLength int `yaml:"max_value_length"`
+}
+
+type QueueConfig struct {
+	// The maximum number of events waiting to be delivered. When the queue is
+	// full, the oldest events are dropped. Default 1000.
+	MaxEvents int `yaml:"max_events"`
+
+	// If set, events that are still undelivered when the client is closed are
+	// saved in this directory and delivered by the next client that uses it.
+	// Must not be shared by clients that run at the same time.
+	Dir string `yaml:"dir"`
+
+	// The number of times to try delivering each event to each sink. Default 5.
+	MaxAttempts int `yaml:"max_attempts"`
+
+	// The delay before the first retry. Each subsequent delay is double the
+	// previous, up to MaxBackoff. Default 100ms.
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+
+	// The longest delay between retries. Default 5s.
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+
+	// How long Close waits for queued events to be delivered. Default 5s.
+	CloseTimeout time.Duration `yaml:"close_timeout"`
+}
@@ -1,6 +1,9 @@
 package analytics
 
-// Holds the name and properties of an analytics event.
+import "time"
+
+// Holds the name and properties of an analytics event. Events are immutable
+// once created, so the same event can safely be tracked more than once.
 type Event struct {
 	// The value used to uniquely identify the user who triggered the event.
 	distinctID string
@@ -10,14 +13,47 @@ type Event struct {
 
 	// Custom properties of the event.
 	properties map[string]any
+
+	// When the event occurred.
+	timestamp time.Time
 }
 
 // Returns a new event with the given name and properties.
 // The event is initialized with the current time as the timestamp.
+// The properties map is copied, so later changes to it do not affect the event.
 func NewEvent(distinctID string, name string, properties map[string]any) *Event {
 	return &Event{
 		distinctID: distinctID,
 		name:       name,
-		properties: properties,
+		properties: copyProperties(properties),
+		timestamp:  time.Now(),
+	}
+}
+
+func (e *Event) DistinctID() string {
+	return e.distinctID
+}
+
+func (e *Event) Name() string {
+	return e.name
+}
+
+// Returns a copy of the event's properties.
+func (e *Event) Properties() map[string]any {
+	return copyProperties(e.properties)
+}
+
+func (e *Event) Timestamp() time.Time {
+	return e.timestamp
+}
+
+func copyProperties(properties map[string]any) map[string]any {
+	if properties == nil {
+		return nil
+	}
+	result := make(map[string]any, len(properties))
+	for k, v := range properties {
+		result[k] = v
 	}
+	return result
 }
@@ -0,0 +1,51 @@
+package analytics
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Appends events to a local file, one JSON object per line. Useful where
+// events cannot be sent to a SaaS analytics vendor.
+type fileSink struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+var _ Sink = (*fileSink)(nil)
+
+func newFileSink(config Config) (Sink, error) {
+	if !config.IsFileSinkEnabled {
+		return nil, nil
+	}
+
+	if config.FileSinkConfig.Path == "" {
+		return nil, errors.New("unable to construct file analytics sink. path cannot be empty")
+	}
+
+	f, err := os.OpenFile(config.FileSinkConfig.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open analytics file %s", config.FileSinkConfig.Path)
+	}
+
+	return &fileSink{
+		file: f,
+		enc:  json.NewEncoder(f),
+	}, nil
+}
+
+func (s *fileSink) Send(event SinkEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return errors.Wrap(s.enc.Encode(event), "unable to write analytics event")
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,198 @@
+package analytics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultOTelTimeout = 10 * time.Second
+
+// Exports events as OpenTelemetry log records, using the OTLP/HTTP protocol
+// with JSON encoding. Each event becomes a log record whose body is the event
+// name and whose attributes are the event's properties.
+type otelSink struct {
+	endpoint string
+	headers  map[string]string
+	resource otlpResource
+	client   *http.Client
+}
+
+var _ Sink = (*otelSink)(nil)
+
+func newOTelSink(config Config) (Sink, error) {
+	if !config.IsOTelEnabled {
+		return nil, nil
+	}
+
+	if config.OTelConfig.Endpoint == "" {
+		return nil, errors.New("unable to construct OpenTelemetry analytics sink. endpoint cannot be empty")
+	}
+
+	timeout := config.OTelConfig.Timeout
+	if timeout <= 0 {
+		timeout = defaultOTelTimeout
+	}
+
+	serviceName := config.App.Name
+	if serviceName == "" {
+		serviceName = "akita"
+	}
+	resource := otlpResource{
+		Attributes: []otlpKeyValue{
+			{Key: "service.name", Value: otlpAnyValue{StringValue: &serviceName}},
+		},
+	}
+	if config.App.Version != "" {
+		version := config.App.Version
+		resource.Attributes = append(resource.Attributes, otlpKeyValue{Key: "service.version", Value: otlpAnyValue{StringValue: &version}})
+	}
+
+	return &otelSink{
+		endpoint: config.OTelConfig.Endpoint,
+		headers:  config.OTelConfig.Headers,
+		resource: resource,
+		client:   &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (s *otelSink) Send(event SinkEvent) error {
+	name := event.Name
+	record := otlpLogRecord{
+		TimeUnixNano: strconv.FormatInt(event.Timestamp.UnixNano(), 10),
+		Body:         otlpAnyValue{StringValue: &name},
+		Attributes:   otlpAttributes(event),
+	}
+
+	body, err := json.Marshal(otlpLogsRequest{
+		ResourceLogs: []otlpResourceLogs{{
+			Resource: s.resource,
+			ScopeLogs: []otlpScopeLogs{{
+				Scope:      otlpScope{Name: "github.com/akitasoftware/akita-libs/analytics"},
+				LogRecords: []otlpLogRecord{record},
+			}},
+		}},
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to encode OpenTelemetry log record")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "unable to create OpenTelemetry export request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "unable to export OpenTelemetry log record")
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("OpenTelemetry collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *otelSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// Converts the event's identifying fields and properties to OTLP attributes,
+// sorted by key.
+func otlpAttributes(event SinkEvent) []otlpKeyValue {
+	channel := string(event.Channel)
+	distinctID := event.DistinctID
+	result := []otlpKeyValue{
+		{Key: "event.channel", Value: otlpAnyValue{StringValue: &channel}},
+		{Key: "user.id", Value: otlpAnyValue{StringValue: &distinctID}},
+	}
+
+	keys := make([]string, 0, len(event.Properties))
+	for k := range event.Properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		result = append(result, otlpKeyValue{Key: k, Value: toOTLPValue(event.Properties[k])})
+	}
+	return result
+}
+
+func toOTLPValue(v any) otlpAnyValue {
+	switch v := v.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &v}
+	case bool:
+		return otlpAnyValue{BoolValue: &v}
+	case int:
+		s := strconv.FormatInt(int64(v), 10)
+		return otlpAnyValue{IntValue: &s}
+	case int32:
+		s := strconv.FormatInt(int64(v), 10)
+		return otlpAnyValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpAnyValue{IntValue: &s}
+	case float32:
+		f := float64(v)
+		return otlpAnyValue{DoubleValue: &f}
+	case float64:
+		return otlpAnyValue{DoubleValue: &v}
+	default:
+		s := fmt.Sprint(v)
+		return otlpAnyValue{StringValue: &s}
+	}
+}
+
+// The subset of the OTLP logs data model used by otelSink. See
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding.
+type otlpLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope       `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Body         otlpAnyValue   `json:"body"`
+	Attributes   []otlpKeyValue `json:"attributes"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
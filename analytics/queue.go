@@ -0,0 +1,436 @@
+package analytics
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+
+	"github.com/akitasoftware/akita-libs/batcher"
+)
+
+const (
+	defaultQueueMaxEvents      = 1000
+	defaultQueueMaxAttempts    = 5
+	defaultQueueInitialBackoff = 100 * time.Millisecond
+	defaultQueueMaxBackoff     = 5 * time.Second
+	defaultQueueCloseTimeout   = 5 * time.Second
+
+	// How long close waits, after the close timeout, for a sink that is still
+	// sending an event to return.
+	workerStopTimeout = time.Second
+)
+
+var errQueueClosed = errors.New("analytics client is closed")
+
+// Counts of events by delivery outcome since the client was created.
+type DeliveryStats struct {
+	// Events waiting in the delivery queue.
+	Queued int
+
+	// Events delivered to every sink.
+	Delivered int64
+
+	// Failed attempts that were retried.
+	Retries int64
+
+	// Events that at least one sink failed to accept after every attempt.
+	Failed int64
+
+	// Events discarded before they could be delivered, because the queue was
+	// full or the client was closed.
+	Dropped int64
+
+	// Events saved to disk on close, to be delivered by the next client.
+	Saved int64
+}
+
+type deliveryCounters struct {
+	delivered int64
+	retries   int64
+	failed    int64
+	dropped   int64
+	saved     int64
+
+	// The sum of failed and dropped as of the last call to Flush.
+	lastReportedLosses int64
+}
+
+func (c *deliveryCounters) snapshot() DeliveryStats {
+	return DeliveryStats{
+		Delivered: atomic.LoadInt64(&c.delivered),
+		Retries:   atomic.LoadInt64(&c.retries),
+		Failed:    atomic.LoadInt64(&c.failed),
+		Dropped:   atomic.LoadInt64(&c.dropped),
+		Saved:     atomic.LoadInt64(&c.saved),
+	}
+}
+
+// Returns the number of events failed or dropped since the last call.
+func (c *deliveryCounters) lossesSinceLastReport() int {
+	losses := atomic.LoadInt64(&c.failed) + atomic.LoadInt64(&c.dropped)
+	previous := atomic.SwapInt64(&c.lastReportedLosses, losses)
+	return int(losses - previous)
+}
+
+// An event waiting to be delivered, as saved to disk.
+type spooledEvent struct {
+	Event SinkEvent `json:"event"`
+
+	// The names of the sinks that have yet to receive the event.
+	Sinks []string `json:"sinks"`
+}
+
+type queueEntry struct {
+	event SinkEvent
+
+	// Indices into deliveryQueue.sinks of the sinks that have yet to accept the
+	// event. Protected by deliveryQueue.mu.
+	pending []int
+
+	attempts int
+
+	// When the entry may next be attempted, after a failed attempt. Protected by
+	// deliveryQueue.mu.
+	notBefore time.Time
+}
+
+// Delivers events to sinks in the background, so that tracking an event does
+// not wait on the network. Failed deliveries are retried with exponential
+// backoff; each sink receives each event at most once per successful attempt.
+// An event waiting to be retried does not hold up the events behind it. When
+// the queue is full, the oldest events are dropped.
+type deliveryQueue struct {
+	config   QueueConfig
+	sinks    []namedSink
+	counters *deliveryCounters
+
+	// Holds undelivered events between clients. Nil if the queue is not
+	// disk-backed.
+	spool *batcher.DiskBuffer[spooledEvent]
+
+	mu      sync.Mutex
+	entries []*queueEntry // oldest first; protected by mu
+	closed  bool          // protected by mu
+
+	// The entry being delivered, if any. Never evicted. Protected by mu.
+	inFlight *queueEntry
+
+	// Closed when the queue is empty and no delivery is in progress. Replaced
+	// when an event is added to an empty queue. Protected by mu.
+	idle chan struct{}
+
+	// Wakes the worker when an event is added. Has a buffer of one.
+	wake chan struct{}
+
+	stopWorker    context.CancelFunc
+	workerStopped chan struct{}
+}
+
+func newDeliveryQueue(config QueueConfig, sinks []namedSink, counters *deliveryCounters) (*deliveryQueue, error) {
+	if config.MaxEvents <= 0 {
+		config.MaxEvents = defaultQueueMaxEvents
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultQueueMaxAttempts
+	}
+	if config.InitialBackoff <= 0 {
+		config.InitialBackoff = defaultQueueInitialBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = defaultQueueMaxBackoff
+	}
+	if config.CloseTimeout <= 0 {
+		config.CloseTimeout = defaultQueueCloseTimeout
+	}
+
+	idle := make(chan struct{})
+	close(idle)
+	q := &deliveryQueue{
+		config:        config,
+		sinks:         sinks,
+		counters:      counters,
+		idle:          idle,
+		wake:          make(chan struct{}, 1),
+		workerStopped: make(chan struct{}),
+	}
+
+	if config.Dir != "" {
+		spool, err := batcher.NewDiskBuffer(batcher.DiskBufferConfig[spooledEvent]{
+			Dir: config.Dir,
+			// Events are only read back with Drain, which bypasses the consumer.
+			Consumer:  func([]spooledEvent) error { return nil },
+			BatchSize: config.MaxEvents,
+			OnDiscard: func(numItems int) {
+				atomic.AddInt64(&counters.dropped, int64(numItems))
+			},
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to open analytics queue directory")
+		}
+		q.spool = spool
+		q.restore(spool.Drain())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q.stopWorker = cancel
+	go q.run(ctx)
+
+	return q, nil
+}
+
+// Re-queues events saved by a previous client, for the sinks that are still
+// configured.
+func (q *deliveryQueue) restore(saved []spooledEvent) {
+	sinkIndices := make(map[string]int, len(q.sinks))
+	for i, sink := range q.sinks {
+		sinkIndices[sink.name] = i
+	}
+
+	for _, s := range saved {
+		var pending []int
+		for _, name := range s.Sinks {
+			if i, ok := sinkIndices[name]; ok {
+				pending = append(pending, i)
+			}
+		}
+		if len(pending) > 0 {
+			q.add(&queueEntry{event: s.Event, pending: pending})
+		}
+	}
+}
+
+// Queues the event for delivery to every sink.
+func (q *deliveryQueue) enqueue(event SinkEvent) error {
+	pending := make([]int, len(q.sinks))
+	for i := range pending {
+		pending[i] = i
+	}
+	return q.add(&queueEntry{event: event, pending: pending})
+}
+
+func (q *deliveryQueue) add(entry *queueEntry) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		atomic.AddInt64(&q.counters.dropped, 1)
+		return errQueueClosed
+	}
+
+	if len(q.entries) >= q.config.MaxEvents {
+		// Drop the oldest entry that isn't being delivered. If every entry is
+		// being delivered, drop the new one instead.
+		evicted := false
+		for i, e := range q.entries {
+			if e != q.inFlight {
+				q.entries = append(q.entries[:i], q.entries[i+1:]...)
+				evicted = true
+				break
+			}
+		}
+		atomic.AddInt64(&q.counters.dropped, 1)
+		if !evicted {
+			return nil
+		}
+	}
+
+	if len(q.entries) == 0 && q.inFlight == nil {
+		q.idle = make(chan struct{})
+	}
+	q.entries = append(q.entries, entry)
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Returns the number of events waiting to be delivered.
+func (q *deliveryQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+// Waits until every queued event has been delivered or given up on, or until
+// the context is done.
+func (q *deliveryQueue) flush(ctx context.Context) error {
+	q.mu.Lock()
+	idle := q.idle
+	q.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stops accepting events and waits up to the close timeout for queued events
+// to be delivered. Events still queued afterwards are saved to disk if the
+// queue is disk-backed, and dropped otherwise.
+//
+// If a sink is still sending an event shortly after the close timeout, close
+// returns without waiting for it. That event is saved or dropped with the
+// others, so a saved event may be delivered twice.
+func (q *deliveryQueue) close() error {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), q.config.CloseTimeout)
+	defer cancel()
+	q.flush(ctx)
+
+	q.stopWorker()
+	timer := time.NewTimer(workerStopTimeout)
+	select {
+	case <-q.workerStopped:
+		timer.Stop()
+	case <-timer.C:
+		glog.Warningf("analytics sink did not return within %v of the close timeout", workerStopTimeout)
+	}
+
+	q.mu.Lock()
+	remaining := make([]spooledEvent, len(q.entries))
+	for i, entry := range q.entries {
+		remaining[i].Event = entry.event
+		for _, sinkIndex := range entry.pending {
+			remaining[i].Sinks = append(remaining[i].Sinks, q.sinks[sinkIndex].name)
+		}
+	}
+	q.entries = nil
+	q.mu.Unlock()
+
+	if q.spool == nil {
+		atomic.AddInt64(&q.counters.dropped, int64(len(remaining)))
+		return nil
+	}
+
+	var result error
+	for i, s := range remaining {
+		if _, err := q.spool.Add(s); err != nil {
+			atomic.AddInt64(&q.counters.dropped, int64(len(remaining)-i))
+			result = errors.Wrap(err, "unable to save undelivered analytics events")
+			break
+		}
+		atomic.AddInt64(&q.counters.saved, 1)
+	}
+	if err := q.spool.Close(); err != nil && result == nil {
+		result = errors.Wrap(err, "unable to save undelivered analytics events")
+	}
+	return result
+}
+
+func (q *deliveryQueue) run(ctx context.Context) {
+	defer close(q.workerStopped)
+
+	for {
+		entry := q.next(ctx)
+		if entry == nil {
+			return
+		}
+
+		var stillPending []int
+		for _, sinkIndex := range entry.pending {
+			if err := q.sinks[sinkIndex].Send(entry.event); err != nil {
+				glog.V(1).Infof("failed to deliver analytics event %q to %s sink: %v", entry.event.Name, q.sinks[sinkIndex].name, err)
+				stillPending = append(stillPending, sinkIndex)
+			}
+		}
+		q.mu.Lock()
+		entry.pending = stillPending
+		q.mu.Unlock()
+		entry.attempts++
+
+		if len(stillPending) == 0 {
+			atomic.AddInt64(&q.counters.delivered, 1)
+			q.finish(entry)
+			continue
+		}
+		if entry.attempts >= q.config.MaxAttempts {
+			atomic.AddInt64(&q.counters.failed, 1)
+			q.finish(entry)
+			continue
+		}
+
+		atomic.AddInt64(&q.counters.retries, 1)
+		q.mu.Lock()
+		entry.notBefore = time.Now().Add(q.backoff(entry.attempts))
+		q.inFlight = nil
+		q.mu.Unlock()
+	}
+}
+
+// Waits for the oldest entry that is not backing off and marks it as in
+// flight. Returns nil if the context is done first.
+func (q *deliveryQueue) next(ctx context.Context) *queueEntry {
+	for {
+		q.mu.Lock()
+		now := time.Now()
+		var retryAt time.Time
+		for _, entry := range q.entries {
+			if !entry.notBefore.After(now) {
+				q.inFlight = entry
+				q.mu.Unlock()
+				return entry
+			}
+			if retryAt.IsZero() || entry.notBefore.Before(retryAt) {
+				retryAt = entry.notBefore
+			}
+		}
+		q.mu.Unlock()
+
+		// Wait for a new entry, or for the earliest backoff to end.
+		var timer *time.Timer
+		var retry <-chan time.Time
+		if !retryAt.IsZero() {
+			timer = time.NewTimer(retryAt.Sub(now))
+			retry = timer.C
+		}
+		select {
+		case <-q.wake:
+		case <-retry:
+		case <-ctx.Done():
+			return nil
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Removes a delivered or abandoned entry from the queue.
+func (q *deliveryQueue) finish(entry *queueEntry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, e := range q.entries {
+		if e == entry {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			break
+		}
+	}
+	q.inFlight = nil
+	if len(q.entries) == 0 {
+		close(q.idle)
+	}
+}
+
+// Returns how long to wait after the given failed attempt.
+func (q *deliveryQueue) backoff(attempt int) time.Duration {
+	delay := q.config.InitialBackoff
+	for i := 1; i < attempt && delay < q.config.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > q.config.MaxBackoff {
+		delay = q.config.MaxBackoff
+	}
+	return delay
+}
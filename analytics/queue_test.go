@@ -0,0 +1,224 @@
+package analytics
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// A sink that fails the first failures calls to Send, then records events.
+type flakySink struct {
+	RecordingSink
+
+	mu       sync.Mutex
+	failures int
+
+	// If non-nil, Send signals sending and then waits for block to be closed.
+	sending chan struct{}
+	block   chan struct{}
+}
+
+func (s *flakySink) Send(event SinkEvent) error {
+	if s.block != nil {
+		s.sending <- struct{}{}
+		<-s.block
+	}
+
+	s.mu.Lock()
+	if s.failures > 0 {
+		s.failures--
+		s.mu.Unlock()
+		return errors.New("unavailable")
+	}
+	s.mu.Unlock()
+	return s.RecordingSink.Send(event)
+}
+
+func queueConfig(dir string, sinks ...Sink) Config {
+	return Config{
+		IsQueueEnabled: true,
+		QueueConfig: QueueConfig{
+			Dir:            dir,
+			MaxEvents:      3,
+			MaxAttempts:    3,
+			InitialBackoff: time.Millisecond,
+			CloseTimeout:   50 * time.Millisecond,
+		},
+		Sinks: sinks,
+	}
+}
+
+func TestQueueRetries(t *testing.T) {
+	flaky := &flakySink{failures: 2}
+	healthy := NewRecordingSink()
+	client, err := NewClient(queueConfig("", flaky, healthy))
+	assert.NoError(t, err)
+
+	client.Track("user", "Event", nil)
+	dropped, err := client.Flush(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, dropped)
+
+	// Each sink receives the event exactly once.
+	assert.Len(t, flaky.Events(), 1)
+	assert.Len(t, healthy.Events(), 1)
+	assert.Equal(t, DeliveryStats{Delivered: 1, Retries: 2}, client.DeliveryStats())
+
+	// Give up after MaxAttempts.
+	flaky.failures = 3
+	client.Track("user", "Event", nil)
+	dropped, err = client.Flush(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, dropped)
+	assert.Equal(t, DeliveryStats{Delivered: 1, Retries: 4, Failed: 1}, client.DeliveryStats())
+
+	assert.NoError(t, client.Close())
+}
+
+func TestQueueDropsOldest(t *testing.T) {
+	sink := &flakySink{sending: make(chan struct{}, 10), block: make(chan struct{})}
+	client, err := NewClient(queueConfig("", sink))
+	assert.NoError(t, err)
+
+	client.Track("user", "a", nil)
+	<-sink.sending
+	for _, name := range []string{"b", "c", "d", "e"} {
+		client.Track("user", name, nil)
+	}
+	close(sink.block)
+
+	dropped, err := client.Flush(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, dropped)
+
+	var names []string
+	for _, event := range sink.Events() {
+		names = append(names, event.Name)
+	}
+	// The first event was being delivered when the queue overflowed.
+	assert.Equal(t, []string{"a", "d", "e"}, names)
+	assert.NoError(t, client.Close())
+}
+
+func TestQueueDropsNewEventWhenFull(t *testing.T) {
+	sink := &flakySink{sending: make(chan struct{}, 10), block: make(chan struct{})}
+	config := queueConfig("", sink)
+	config.QueueConfig.MaxEvents = 1
+	client, err := NewClient(config)
+	assert.NoError(t, err)
+
+	client.Track("user", "a", nil)
+	<-sink.sending
+
+	// The only queued event is being delivered, so the new one is dropped.
+	client.Track("user", "b", nil)
+	assert.Equal(t, 1, client.DeliveryStats().Queued)
+	close(sink.block)
+
+	dropped, err := client.Flush(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, dropped)
+	assert.Len(t, sink.Events(), 1)
+	assert.Equal(t, "a", sink.Events()[0].Name)
+	assert.NoError(t, client.Close())
+}
+
+// A sink that always fails to send events with the given name.
+type rejectingSink struct {
+	RecordingSink
+	reject string
+}
+
+func (s *rejectingSink) Send(event SinkEvent) error {
+	if event.Name == s.reject {
+		return errors.New("rejected")
+	}
+	return s.RecordingSink.Send(event)
+}
+
+func TestQueueRetryDoesNotStallLaterEvents(t *testing.T) {
+	sink := &rejectingSink{reject: "a"}
+	config := queueConfig("", sink)
+	config.QueueConfig.InitialBackoff = time.Hour
+	config.QueueConfig.MaxBackoff = time.Hour
+	client, err := NewClient(config)
+	assert.NoError(t, err)
+
+	client.Track("user", "a", nil)
+	client.Track("user", "b", nil)
+	client.Track("user", "c", nil)
+
+	// "a" is backing off, but the events behind it are delivered.
+	assert.Eventually(t, func() bool {
+		return len(sink.Events()) == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, "b", sink.Events()[0].Name)
+	assert.Equal(t, "c", sink.Events()[1].Name)
+	assert.Equal(t, 1, client.DeliveryStats().Queued)
+
+	assert.NoError(t, client.Close())
+	assert.Equal(t, int64(1), client.DeliveryStats().Dropped)
+}
+
+func TestQueueFlushTimeout(t *testing.T) {
+	sink := &flakySink{sending: make(chan struct{}, 10), block: make(chan struct{})}
+	client, err := NewClient(queueConfig("", sink))
+	assert.NoError(t, err)
+
+	client.Track("user", "Event", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = client.Flush(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, client.DeliveryStats().Queued)
+
+	close(sink.block)
+	assert.NoError(t, client.Close())
+}
+
+func TestQueueCloseWithStuckSink(t *testing.T) {
+	sink := &flakySink{sending: make(chan struct{}, 10), block: make(chan struct{})}
+	defer close(sink.block)
+	client, err := NewClient(queueConfig("", sink))
+	assert.NoError(t, err)
+
+	client.Track("user", "Event", nil)
+	<-sink.sending
+
+	start := time.Now()
+	assert.NoError(t, client.Close())
+	assert.Less(t, time.Since(start), 50*time.Millisecond+workerStopTimeout+time.Second)
+	assert.Equal(t, int64(1), client.DeliveryStats().Dropped)
+}
+
+func TestQueueSavesUndeliveredEvents(t *testing.T) {
+	dir := t.TempDir()
+
+	// Retry for longer than the close timeout.
+	config := queueConfig(dir, NewRecordingSink(), &flakySink{failures: 100})
+	config.QueueConfig.MaxAttempts = 100
+	config.QueueConfig.InitialBackoff = 20 * time.Millisecond
+	client, err := NewClient(config)
+	assert.NoError(t, err)
+	client.Track("user", "Event", map[string]any{"n": 1})
+	assert.NoError(t, client.Close())
+	assert.Equal(t, int64(1), client.DeliveryStats().Saved)
+
+	// The next client delivers the event only to the sink that didn't receive
+	// it.
+	first, second := NewRecordingSink(), NewRecordingSink()
+	client, err = NewClient(queueConfig(dir, first, second))
+	assert.NoError(t, err)
+	_, err = client.Flush(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, first.Events())
+	if assert.Len(t, second.Events(), 1) {
+		assert.Equal(t, "Event", second.Events()[0].Name)
+		assert.Equal(t, float64(1), second.Events()[0].Properties["n"])
+	}
+	assert.NoError(t, client.Close())
+}
@@ -0,0 +1,269 @@
+package analytics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	RedactedEmail = "<email>"
+	RedactedIP    = "<ip>"
+	RedactedToken = "<token>"
+
+	// Appended to string values that were truncated to MaxValueLength.
+	truncationMarker = "...<truncated>"
+)
+
+// Key patterns for properties that commonly hold credentials. Suitable for
+// ScrubbingConfig.DropKeyPatterns.
+var DefaultSensitiveKeyPatterns = []string{
+	`password`,
+	`passwd`,
+	`secret`,
+	`token`,
+	`api_?key`,
+	`authorization`,
+	`cookie`,
+	`credential`,
+	`private_?key`,
+}
+
+var (
+	emailRegexp = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	ipv4Regexp  = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+
+	// Matches candidate IPv6 addresses, which are confirmed with net.ParseIP so
+	// that times such as 12:34:56 are not mistaken for addresses.
+	ipv6Regexp = regexp.MustCompile(`[0-9A-Fa-f]*:[0-9A-Fa-f:]*:[0-9A-Fa-f]*`)
+
+	tokenRegexps = []*regexp.Regexp{
+		// Bearer and basic credentials in header values.
+		regexp.MustCompile(`(?i)\b(?:bearer|basic)\s+[A-Za-z0-9._~+/=\-]+`),
+		// JSON web tokens.
+		regexp.MustCompile(`\beyJ[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]*`),
+		// Postman API keys.
+		regexp.MustCompile(`\bPMAK-[A-Za-z0-9\-]+`),
+		// Long opaque strings, such as API keys and session IDs.
+		regexp.MustCompile(`\b[A-Za-z0-9+/_\-]{40,}={0,2}`),
+	}
+)
+
+// Removes potentially sensitive data from event properties before they are
+// sent to any sink. The zero value passes properties through unchanged.
+type Scrubber struct {
+	dropKeys          []*regexp.Regexp
+	hashKeys          []*regexp.Regexp
+	hashSalt          string
+	redactValues      bool
+	allowedProperties map[string]map[string]struct{}
+	requireAllowList  bool
+	maxValueLength    int
+}
+
+func NewScrubber(config ScrubbingConfig) (*Scrubber, error) {
+	dropKeys, err := compileKeyPatterns(config.DropKeyPatterns)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid drop key pattern")
+	}
+
+	hashKeys, err := compileKeyPatterns(config.HashKeyPatterns)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid hash key pattern")
+	}
+
+	var allowed map[string]map[string]struct{}
+	if config.AllowedProperties != nil {
+		allowed = make(map[string]map[string]struct{}, len(config.AllowedProperties))
+		for eventName, keys := range config.AllowedProperties {
+			set := make(map[string]struct{}, len(keys))
+			for _, key := range keys {
+				set[key] = struct{}{}
+			}
+			allowed[eventName] = set
+		}
+	}
+
+	return &Scrubber{
+		dropKeys:          dropKeys,
+		hashKeys:          hashKeys,
+		hashSalt:          config.HashSalt,
+		redactValues:      config.RedactValues,
+		allowedProperties: allowed,
+		requireAllowList:  config.RequireAllowList,
+		maxValueLength:    config.MaxValueLength,
+	}, nil
+}
+
+// Key patterns are matched case-insensitively against anywhere in the key.
+func compileKeyPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	result := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to compile %q", pattern)
+		}
+		result = append(result, re)
+	}
+	return result, nil
+}
+
+// Returns a scrubbed copy of the properties of the named event. Keys are
+// expected to be in snake case. The given map is not modified.
+//
+// Properties not on the event's allow-list are removed first, then properties
+// whose keys match a drop pattern. Values of properties whose keys match a
+// hash pattern are replaced with a salted hash. Remaining string values, at
+// any depth, have emails, IP addresses and tokens redacted and are truncated
+// to the maximum length. Typed maps, slices and structs are scrubbed in their
+// JSON form.
+func (s *Scrubber) Scrub(eventName string, properties map[string]any) map[string]any {
+	if properties == nil {
+		return nil
+	}
+
+	allowed, hasAllowList := s.allowedProperties[eventName]
+	if !hasAllowList && s.requireAllowList {
+		return map[string]any{}
+	}
+
+	result := make(map[string]any, len(properties))
+	for key, value := range properties {
+		if hasAllowList {
+			if _, ok := allowed[key]; !ok {
+				continue
+			}
+		}
+		if matchesAny(s.dropKeys, key) {
+			continue
+		}
+		if matchesAny(s.hashKeys, key) {
+			result[key] = s.hash(value)
+			continue
+		}
+		result[key] = s.scrubValue(value)
+	}
+	return result
+}
+
+func matchesAny(patterns []*regexp.Regexp, key string) bool {
+	for _, re := range patterns {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a hex-encoded salted SHA-256 hash of the value's string form, so
+// that values can still be correlated without being revealed.
+func (s *Scrubber) hash(value any) string {
+	h := sha256.Sum256([]byte(s.hashSalt + fmt.Sprint(value)))
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+func (s *Scrubber) scrubValue(value any) any {
+	switch v := value.(type) {
+	case string:
+		return s.scrubString(v)
+	case []string:
+		result := make([]string, len(v))
+		for i, elt := range v {
+			result[i] = s.scrubString(elt)
+		}
+		return result
+	case []any:
+		result := make([]any, len(v))
+		for i, elt := range v {
+			result[i] = s.scrubValue(elt)
+		}
+		return result
+	case map[string]any:
+		// Nested keys are subject to the drop and hash patterns, but not to the
+		// allow-list.
+		result := make(map[string]any, len(v))
+		for key, elt := range v {
+			if matchesAny(s.dropKeys, key) {
+				continue
+			}
+			if matchesAny(s.hashKeys, key) {
+				result[key] = s.hash(elt)
+				continue
+			}
+			result[key] = s.scrubValue(elt)
+		}
+		return result
+	case error:
+		return s.scrubString(v.Error())
+	case nil, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return value
+	default:
+		return s.scrubOther(value)
+	}
+}
+
+// Scrubs values of types not handled by scrubValue, such as typed maps,
+// slices and structs. These are converted to their JSON form, which is how
+// the sinks send them, so that nested keys and strings are scrubbed like any
+// others. Values that can't be converted are scrubbed as strings.
+func (s *Scrubber) scrubOther(value any) any {
+	switch reflect.ValueOf(value).Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct, reflect.Pointer, reflect.Interface:
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			break
+		}
+		var decoded any
+		if err := json.Unmarshal(encoded, &decoded); err != nil {
+			break
+		}
+		return s.scrubValue(decoded)
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return value
+	}
+	return s.scrubString(fmt.Sprint(value))
+}
+
+func (s *Scrubber) scrubString(v string) string {
+	if s.redactValues {
+		v = RedactString(v)
+	}
+	if s.maxValueLength > 0 && len(v) > s.maxValueLength {
+		cut := s.maxValueLength
+		// Don't split a multi-byte character.
+		for cut > 0 && !utf8.RuneStart(v[cut]) {
+			cut--
+		}
+		v = v[:cut] + truncationMarker
+	}
+	return v
+}
+
+// Replaces emails, IP addresses and tokens in the given string with
+// placeholders.
+func RedactString(v string) string {
+	for _, re := range tokenRegexps {
+		v = re.ReplaceAllString(v, RedactedToken)
+	}
+	v = emailRegexp.ReplaceAllString(v, RedactedEmail)
+	v = ipv4Regexp.ReplaceAllString(v, RedactedIP)
+	if strings.Contains(v, ":") {
+		v = ipv6Regexp.ReplaceAllStringFunc(v, func(candidate string) string {
+			if net.ParseIP(candidate) != nil {
+				return RedactedIP
+			}
+			return candidate
+		})
+	}
+	return v
+}
@@ -0,0 +1,137 @@
+package analytics
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactString(t *testing.T) {
+	testCases := map[string]string{
+		"contact jane.doe@example.com now":          "contact <email> now",
+		"from 10.0.0.1 to 192.168.1.255":            "from <ip> to <ip>",
+		"via fe80::1ff:fe23:4567:890a":              "via <ip>",
+		"at 12:34:56":                               "at 12:34:56",
+		"Authorization: Bearer abc.def-ghi":         "Authorization: <token>",
+		"key PMAK-0123456789abcdef-0123":            "key <token>",
+		"jwt eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.": "jwt <token>",
+		"id " + strings.Repeat("a1B2", 12):          "id <token>",
+		"GET /v1/services/svc_123":                  "GET /v1/services/svc_123",
+	}
+	for input, expected := range testCases {
+		assert.Equal(t, expected, RedactString(input), input)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	scrubber, err := NewScrubber(ScrubbingConfig{
+		DropKeyPatterns: DefaultSensitiveKeyPatterns,
+		HashKeyPatterns: []string{`^user_email$`},
+		HashSalt:        "salt",
+		RedactValues:    true,
+		AllowedProperties: map[string][]string{
+			"Login": {"method", "user_email"},
+		},
+		MaxValueLength: 10,
+	})
+	assert.NoError(t, err)
+
+	properties := map[string]any{
+		"method":       "password",
+		"user_email":   "jane@example.com",
+		"access_token": "xyz",
+		"count":        3,
+	}
+	scrubbed := scrubber.Scrub("Login", properties)
+	assert.Equal(t, 2, len(scrubbed))
+	assert.Equal(t, "password", scrubbed["method"])
+	assert.Equal(t, scrubber.hash("jane@example.com"), scrubbed["user_email"])
+	assert.True(t, strings.HasPrefix(scrubbed["user_email"].(string), "sha256:"))
+
+	// The input is not modified.
+	assert.Equal(t, 4, len(properties))
+
+	// Events without an allow-list keep non-sensitive properties.
+	scrubbed = scrubber.Scrub("Trace Started", map[string]any{
+		"api_key": "abc",
+		"count":   3,
+		"error":   errors.New("dial 10.1.2.3 failed"),
+		"nested": map[string]any{
+			"Password": "hunter2",
+			"host":     "10.1.2.3",
+		},
+		"paths": []string{"/a", strings.Repeat("x", 20)},
+	})
+	assert.Equal(t, map[string]any{
+		"count": 3,
+		"error": "dial <ip> " + truncationMarker,
+		"nested": map[string]any{
+			"host": "<ip>",
+		},
+		"paths": []string{"/a", "xxxxxxxxxx" + truncationMarker},
+	}, scrubbed)
+}
+
+func TestScrubTypedValues(t *testing.T) {
+	scrubber, err := NewScrubber(ScrubbingConfig{
+		DropKeyPatterns: DefaultSensitiveKeyPatterns,
+		RedactValues:    true,
+	})
+	assert.NoError(t, err)
+
+	type target struct {
+		Host     string `json:"host"`
+		Port     int    `json:"port"`
+		Password string `json:"password"`
+		internal string
+	}
+	type address string
+
+	scrubbed := scrubber.Scrub("Trace Started", map[string]any{
+		"headers": map[string]string{
+			"Authorization": "Bearer abc",
+			"X-Forwarded":   "10.1.2.3",
+		},
+		"target":  target{Host: "10.1.2.3", Port: 443, Password: "hunter2", internal: "x"},
+		"targets": []*target{{Host: "jane@example.com"}},
+		"address": address("10.1.2.3"),
+		"ports":   []int{80, 443},
+	})
+	assert.Equal(t, map[string]any{
+		"headers": map[string]any{"X-Forwarded": "<ip>"},
+		"target":  map[string]any{"host": "<ip>", "port": float64(443)},
+		"targets": []any{map[string]any{"host": "<email>", "port": float64(0)}},
+		"address": "<ip>",
+		"ports":   []any{float64(80), float64(443)},
+	}, scrubbed)
+}
+
+func TestScrubRequireAllowList(t *testing.T) {
+	scrubber, err := NewScrubber(ScrubbingConfig{
+		AllowedProperties: map[string][]string{"Login": {"method"}},
+		RequireAllowList:  true,
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string]any{}, scrubber.Scrub("Other", map[string]any{"method": "x"}))
+	assert.Equal(t, map[string]any{"method": "x"}, scrubber.Scrub("Login", map[string]any{"method": "x", "y": 1}))
+}
+
+func TestScrubInvalidPattern(t *testing.T) {
+	_, err := NewClient(Config{Scrubbing: ScrubbingConfig{DropKeyPatterns: []string{"("}}})
+	assert.Error(t, err)
+}
+
+func TestClientScrubsProperties(t *testing.T) {
+	recorder := NewRecordingSink()
+	client, err := NewClient(Config{
+		Scrubbing: ScrubbingConfig{DropKeyPatterns: DefaultSensitiveKeyPatterns},
+		Sinks:     []Sink{recorder},
+	})
+	assert.NoError(t, err)
+
+	client.Track("user", "Login", map[string]any{"apiKey": "abc", "method": "sso"})
+	assert.Equal(t, map[string]any{"method": "sso"}, recorder.Events()[0].Properties)
+}
@@ -33,6 +33,7 @@ func newSegmentClient(config Config) (analytics.Client, error) {
 	}
 
 	segmentConfig.Logger = provideSegmentLogger(rawSegmentConfig.IsLoggingEnabled)
+	segmentConfig.Callback = segmentCallback{}
 
 	if rawSegmentConfig.FlushInterval > 0 {
 		segmentConfig.Interval = rawSegmentConfig.FlushInterval
@@ -89,3 +90,68 @@ func (d disabledSegmentLogger) Errorf(format string, args ...any) {
 func (d disabledSegmentLogger) Logf(format string, args ...any) {
 	// Do nothing.
 }
+
+// Logs events that the Segment client gives up on. The Segment client sends
+// events in the background, after segmentSink.Send has returned, so these
+// failures are not seen by the delivery queue.
+type segmentCallback struct{}
+
+var _ analytics.Callback = segmentCallback{}
+
+func (segmentCallback) Success(analytics.Message) {}
+
+func (segmentCallback) Failure(msg analytics.Message, err error) {
+	if track, ok := msg.(analytics.Track); ok {
+		glog.Warningf("failed to deliver analytics event %q to Segment: %v", track.Event, err)
+		return
+	}
+	glog.Warningf("failed to deliver analytics message to Segment: %v", err)
+}
+
+// Sends events tracked on the Segment channel to Segment.
+//
+// The Segment client batches events and sends them in the background, so Send
+// succeeds once an event is in the Segment client's buffer, not once Segment
+// has received it. The Segment client retries failed batches itself; events it
+// gives up on are logged by segmentCallback, but are not retried by the
+// delivery queue or counted in DeliveryStats.Failed.
+type segmentSink struct {
+	client            analytics.Client
+	isInternalService bool
+}
+
+var _ Sink = (*segmentSink)(nil)
+
+func newSegmentSink(config Config) (Sink, error) {
+	client, err := newSegmentClient(config)
+	if err != nil || client == nil {
+		return nil, err
+	}
+
+	return &segmentSink{
+		client:            client,
+		isInternalService: config.IsInternalService,
+	}, nil
+}
+
+func (s *segmentSink) Send(event SinkEvent) error {
+	if event.Channel != SegmentChannel {
+		return nil
+	}
+
+	name := "Insights Agent " + event.Name
+	if s.isInternalService {
+		name = "Insights " + event.Name
+	}
+
+	return s.client.Enqueue(analytics.Track{
+		UserId:     event.DistinctID,
+		Event:      name,
+		Properties: event.Properties,
+		Timestamp:  event.Timestamp,
+	})
+}
+
+func (s *segmentSink) Close() error {
+	return s.client.Close()
+}
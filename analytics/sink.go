@@ -0,0 +1,163 @@
+package analytics
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Identifies which Client method an event was tracked with. Vendors have
+// different event naming conventions: events tracked with TrackEvent are sent
+// to Amplitude, and events tracked with TrackSegmentEvent are sent to Segment.
+type Channel string
+
+const (
+	DefaultChannel Channel = "default"
+	SegmentChannel Channel = "segment"
+)
+
+// An event as delivered to a Sink.
+type SinkEvent struct {
+	Channel Channel `json:"channel"`
+
+	// The value used to uniquely identify the user who triggered the event.
+	DistinctID string `json:"distinct_id"`
+
+	// The name of the event, without any vendor-specific prefix.
+	Name string `json:"name"`
+
+	// Custom properties of the event, with snake-case keys.
+	Properties map[string]any `json:"properties,omitempty"`
+
+	// When the event was tracked.
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// A destination for analytics events.
+type Sink interface {
+	// Delivers the given event. Sinks ignore events on channels they do not
+	// handle. A nil error means the event was accepted: sinks that batch events
+	// in the background, such as the Segment and Amplitude sinks, return nil
+	// once the event is buffered, and failures after that are not retried by
+	// the delivery queue.
+	Send(event SinkEvent) error
+
+	// Delivers any buffered events and releases the sink's resources.
+	Close() error
+}
+
+// Creates a sink from the client configuration. Returns a nil sink if the sink
+// is not enabled in the configuration.
+type SinkFactory func(config Config) (Sink, error)
+
+type registeredSink struct {
+	name    string
+	factory SinkFactory
+}
+
+var (
+	sinkRegistryMu sync.Mutex
+	sinkRegistry   []registeredSink
+)
+
+func init() {
+	RegisterSink("amplitude", newAmplitudeSink)
+	RegisterSink("segment", newSegmentSink)
+	RegisterSink("file", newFileSink)
+	RegisterSink("otel", newOTelSink)
+}
+
+// Makes a sink available to NewClient. Each client creates an instance of
+// every registered sink that is enabled in its configuration. Registering a
+// name again replaces the earlier factory.
+func RegisterSink(name string, factory SinkFactory) {
+	sinkRegistryMu.Lock()
+	defer sinkRegistryMu.Unlock()
+
+	for i, reg := range sinkRegistry {
+		if reg.name == name {
+			sinkRegistry[i].factory = factory
+			return
+		}
+	}
+	sinkRegistry = append(sinkRegistry, registeredSink{name: name, factory: factory})
+}
+
+// A sink and the name it was registered under. Names identify sinks in events
+// saved to disk by the delivery queue.
+type namedSink struct {
+	name string
+	Sink
+}
+
+// Creates the registered sinks that are enabled in the given configuration,
+// followed by the additional sinks given in the configuration.
+func newSinks(config Config) ([]namedSink, error) {
+	sinkRegistryMu.Lock()
+	registry := make([]registeredSink, len(sinkRegistry))
+	copy(registry, sinkRegistry)
+	sinkRegistryMu.Unlock()
+
+	var result []namedSink
+	for _, reg := range registry {
+		sink, err := reg.factory(config)
+		if err != nil {
+			for _, s := range result {
+				s.Close()
+			}
+			return nil, errors.Wrapf(err, "failed to create %s sink", reg.name)
+		}
+		if sink != nil {
+			result = append(result, namedSink{name: reg.name, Sink: sink})
+		}
+	}
+	for i, sink := range config.Sinks {
+		result = append(result, namedSink{name: fmt.Sprintf("sinks[%d]", i), Sink: sink})
+	}
+	return result, nil
+}
+
+// Records events in memory. Useful for tests.
+type RecordingSink struct {
+	mu     sync.Mutex
+	events []SinkEvent
+	closed bool
+}
+
+var _ Sink = (*RecordingSink)(nil)
+
+func NewRecordingSink() *RecordingSink {
+	return &RecordingSink{}
+}
+
+func (s *RecordingSink) Send(event SinkEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *RecordingSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+// Returns the events received so far.
+func (s *RecordingSink) Events() []SinkEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]SinkEvent, len(s.events))
+	copy(result, s.events)
+	return result
+}
+
+// Returns true if the sink has been closed.
+func (s *RecordingSink) IsClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
@@ -552,30 +552,9 @@ type PostClientPacketCaptureStatsRequest struct {
 	AgentRateLimit float64 `json:"agent_rate_limit,omitempty"`
 }
 
-type AgentResourceUsage struct {
-	// Peak usage data over the lifetime of the agent.
-	Peak AgentResourceUsageData `json:"peak"`
-
-	// Recent usage data over the interval defined by ObservedStartingAt and
-	// ObservedDurationInSeconds.
-	Recent AgentResourceUsageData `json:"recent"`
-
-	// Time window in which recent resource usage was observed.  This may be different
-	// than the window specified in PostClientPacketCaptureStatsRequest.
-	ObservedStartingAt        time.Time `json:"observed_starting_at"`
-	ObservedDurationInSeconds int       `json:"observed_duration_in_seconds"`
-}
-
-type AgentResourceUsageData struct {
-	// The number of CPU cores (or fractions thereof) the Akita agent used.
-	CoresUsed float64 `json:"cpus_used"`
-
-	// Akita agent CPU usage, as a percentage of total CPU availability.
-	RelativeCPU float64 `json:"relative_cpu"`
-
-	// Peak resident set size in kB.
-	VmHWM uint64 `json:"vm_hwm"`
-}
+// Defined in client_telemetry so that it can be exported as metrics.
+type AgentResourceUsage = client_telemetry.AgentResourceUsage
+type AgentResourceUsageData = client_telemetry.AgentResourceUsageData
 
 type PostInitialClientTelemetryRequest struct {
 	ClientID                  akid.ClientID `json:"client_id"`
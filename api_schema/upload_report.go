@@ -1,6 +1,11 @@
 package api_schema
 
-import "github.com/akitasoftware/akita-libs/akid"
+import (
+	"fmt"
+	"net"
+
+	"github.com/akitasoftware/akita-libs/akid"
+)
 
 type UploadReportsRequest struct {
 	ClientID       akid.ClientID          `json:"client_id"`
@@ -44,3 +49,165 @@ func (req *UploadReportsRequest) Clear() {
 func (req *UploadReportsRequest) SizeInBytes() int {
 	return req.reportsSize_bytes + 26 // AKIDs are 26 bytes long
 }
+
+// Partitions the reports in this request into requests whose SizeInBytes is
+// at most maxSize_bytes. Since SizeInBytes is an approximation, callers should
+// leave some headroom below the backend's actual limit.
+//
+// Related reports are kept in the same request where possible: a TCP
+// connection report, the TLS handshake report for the same connection, and the
+// witnesses exchanged over that connection. A group of related reports that is
+// too large on its own is spread across as few requests as possible. A single
+// report larger than the limit is put in a request by itself.
+//
+// The order of reports is preserved within each group. The original request is
+// not modified.
+func (req *UploadReportsRequest) Split(maxSize_bytes int) []*UploadReportsRequest {
+	// Measure the reports themselves, rather than trusting SizeInBytes, which
+	// does not count reports that were not added with the Add methods.
+	groups := req.relatedReportGroups()
+	current := &UploadReportsRequest{ClientID: req.ClientID}
+	total_bytes := current.SizeInBytes()
+	for _, group := range groups {
+		total_bytes += group.size_bytes()
+	}
+	if total_bytes <= maxSize_bytes {
+		current.addGroup(groups...)
+		return []*UploadReportsRequest{current}
+	}
+
+	var result []*UploadReportsRequest
+	startNew := func() {
+		if !current.IsEmpty() {
+			result = append(result, current)
+			current = &UploadReportsRequest{ClientID: req.ClientID}
+		}
+	}
+
+	for _, group := range groups {
+		if current.SizeInBytes()+group.size_bytes() > maxSize_bytes {
+			startNew()
+		}
+		if current.SizeInBytes()+group.size_bytes() <= maxSize_bytes {
+			current.addGroup(group)
+			continue
+		}
+
+		// The group doesn't fit in a request by itself. Add its reports one at a
+		// time.
+		for _, report := range group.reports() {
+			if !current.IsEmpty() && current.SizeInBytes()+report.SizeInBytes() > maxSize_bytes {
+				startNew()
+			}
+			report.addTo(current)
+		}
+	}
+	startNew()
+	return result
+}
+
+// A set of reports that should be uploaded together.
+type relatedReports struct {
+	tcpConnections []*TCPConnectionReport
+	tlsHandshakes  []*TLSHandshakeReport
+	witnesses      []*WitnessReport
+}
+
+func (g *relatedReports) size_bytes() int {
+	result := 0
+	for _, report := range g.reports() {
+		result += report.SizeInBytes()
+	}
+	return result
+}
+
+// Returns the group's reports, connection-level reports first.
+func (g *relatedReports) reports() []uploadableReport {
+	result := make([]uploadableReport, 0, len(g.tcpConnections)+len(g.tlsHandshakes)+len(g.witnesses))
+	for _, report := range g.tcpConnections {
+		result = append(result, report)
+	}
+	for _, report := range g.tlsHandshakes {
+		result = append(result, report)
+	}
+	for _, report := range g.witnesses {
+		result = append(result, report)
+	}
+	return result
+}
+
+func (req *UploadReportsRequest) addGroup(groups ...*relatedReports) {
+	for _, group := range groups {
+		for _, report := range group.reports() {
+			report.addTo(req)
+		}
+	}
+}
+
+// A report that can be added to an UploadReportsRequest.
+type uploadableReport interface {
+	SizeInBytes() int
+	addTo(req *UploadReportsRequest)
+}
+
+func (report *WitnessReport) addTo(req *UploadReportsRequest) {
+	req.AddWitnessReport(report)
+}
+
+func (report *TCPConnectionReport) addTo(req *UploadReportsRequest) {
+	req.AddTCPConnectionReport(report)
+}
+
+func (report *TLSHandshakeReport) addTo(req *UploadReportsRequest) {
+	req.AddTLSHandshakeReport(report)
+}
+
+// Groups the reports in this request by connection, in order of first
+// appearance. Witnesses are matched to TCP connections by their endpoints.
+func (req *UploadReportsRequest) relatedReportGroups() []*relatedReports {
+	var result []*relatedReports
+	byConnectionID := make(map[akid.ConnectionID]*relatedReports)
+	byEndpoints := make(map[string]*relatedReports)
+
+	for _, report := range req.TCPConnections {
+		group, ok := byConnectionID[report.ID]
+		if !ok {
+			group = &relatedReports{}
+			byConnectionID[report.ID] = group
+			result = append(result, group)
+		}
+		group.tcpConnections = append(group.tcpConnections, report)
+		byEndpoints[endpointsKey(report.SrcAddr, report.SrcPort, report.DestAddr, report.DestPort)] = group
+		byEndpoints[endpointsKey(report.DestAddr, report.DestPort, report.SrcAddr, report.SrcPort)] = group
+	}
+
+	for _, report := range req.TLSHandshakes {
+		group, ok := byConnectionID[report.ID]
+		if !ok {
+			group = &relatedReports{}
+			byConnectionID[report.ID] = group
+			result = append(result, group)
+		}
+		group.tlsHandshakes = append(group.tlsHandshakes, report)
+	}
+
+	for _, report := range req.Witnesses {
+		key := endpointsKey(report.OriginAddr, report.OriginPort, report.DestinationAddr, report.DestinationPort)
+		group, ok := byEndpoints[key]
+		if !ok {
+			// Witnesses in both directions between the same endpoints belong
+			// together.
+			group = &relatedReports{}
+			byEndpoints[key] = group
+			byEndpoints[endpointsKey(report.DestinationAddr, report.DestinationPort, report.OriginAddr, report.OriginPort)] = group
+			result = append(result, group)
+		}
+		group.witnesses = append(group.witnesses, report)
+	}
+
+	return result
+}
+
+func endpointsKey(srcAddr net.IP, srcPort uint16, destAddr net.IP, destPort uint16) string {
+	return fmt.Sprintf("%s:%d-%s:%d", srcAddr, srcPort, destAddr, destPort)
+}
@@ -0,0 +1,90 @@
+package api_schema
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// An HTTP Content-Encoding for upload request bodies.
+type ContentEncoding string
+
+const (
+	IdentityEncoding ContentEncoding = "identity"
+	GzipEncoding     ContentEncoding = "gzip"
+	ZstdEncoding     ContentEncoding = "zstd"
+)
+
+// Creates a writer that compresses everything written to w. The returned
+// writer must be closed to flush the compressed data.
+type CompressorFactory func(w io.Writer) (io.WriteCloser, error)
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[ContentEncoding]CompressorFactory{
+		GzipEncoding: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		ZstdEncoding: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+	}
+)
+
+// Makes the given content encoding available to EncodeBody, replacing any
+// existing factory for it. Gzip and zstd are built in.
+func RegisterCompressor(encoding ContentEncoding, factory CompressorFactory) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[encoding] = factory
+}
+
+// A serialized request body.
+type EncodedBody struct {
+	// The value for the Content-Encoding header.
+	Encoding ContentEncoding
+
+	Body []byte
+}
+
+// Returns the exact number of bytes that will be sent.
+func (b EncodedBody) Size() int {
+	return len(b.Body)
+}
+
+// Serializes the request as JSON and compresses it with the given encoding.
+func (req *UploadReportsRequest) EncodeBody(encoding ContentEncoding) (EncodedBody, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return EncodedBody{}, errors.Wrap(err, "unable to marshal upload request")
+	}
+
+	if encoding == IdentityEncoding || encoding == "" {
+		return EncodedBody{Encoding: IdentityEncoding, Body: body}, nil
+	}
+
+	compressorsMu.RLock()
+	factory, ok := compressors[encoding]
+	compressorsMu.RUnlock()
+	if !ok {
+		return EncodedBody{}, errors.Errorf("unsupported content encoding %q", encoding)
+	}
+
+	var buf bytes.Buffer
+	w, err := factory(&buf)
+	if err != nil {
+		return EncodedBody{}, errors.Wrapf(err, "unable to create %s compressor", encoding)
+	}
+	if _, err := w.Write(body); err != nil {
+		return EncodedBody{}, errors.Wrapf(err, "unable to compress upload request with %s", encoding)
+	}
+	if err := w.Close(); err != nil {
+		return EncodedBody{}, errors.Wrapf(err, "unable to compress upload request with %s", encoding)
+	}
+	return EncodedBody{Encoding: encoding, Body: buf.Bytes()}, nil
+}
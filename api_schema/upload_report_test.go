@@ -0,0 +1,182 @@
+package api_schema
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/akitasoftware/akita-libs/akid"
+)
+
+var (
+	clientAddr = net.ParseIP("10.0.0.1")
+	serverAddr = net.ParseIP("10.0.0.2")
+)
+
+// Returns a TCP connection report, a TLS handshake report, and a request and
+// response witness for a connection from the given client port.
+func connectionReports(clientPort uint16, witnessSize int) (*TCPConnectionReport, *TLSHandshakeReport, []*WitnessReport) {
+	id := akid.NewConnectionID(uuid.New())
+	conn := &TCPConnectionReport{
+		ID:       id,
+		SrcAddr:  clientAddr,
+		SrcPort:  clientPort,
+		DestAddr: serverAddr,
+		DestPort: 443,
+	}
+	tls := &TLSHandshakeReport{ID: id}
+	witnesses := []*WitnessReport{
+		{
+			OriginAddr:      clientAddr,
+			OriginPort:      clientPort,
+			DestinationAddr: serverAddr,
+			DestinationPort: 443,
+			WitnessProto:    strings.Repeat("a", witnessSize),
+		},
+		{
+			OriginAddr:      serverAddr,
+			OriginPort:      443,
+			DestinationAddr: clientAddr,
+			DestinationPort: clientPort,
+			WitnessProto:    strings.Repeat("b", witnessSize),
+		},
+	}
+	return conn, tls, witnesses
+}
+
+func TestSplitKeepsConnectionsTogether(t *testing.T) {
+	req := &UploadReportsRequest{}
+	conns := map[uint16]bool{}
+	for port := uint16(1000); port < 1010; port++ {
+		conn, tls, witnesses := connectionReports(port, 100)
+		conns[port] = true
+		req.AddTCPConnectionReport(conn)
+		req.AddTLSHandshakeReport(tls)
+		for _, w := range witnesses {
+			req.AddWitnessReport(w)
+		}
+	}
+
+	// Big enough for two connections per request.
+	conn, tls, witnesses := connectionReports(1, 100)
+	groupSize := conn.SizeInBytes() + tls.SizeInBytes() + witnesses[0].SizeInBytes() + witnesses[1].SizeInBytes()
+	limit := 26 + 2*groupSize + groupSize/2
+
+	split := req.Split(limit)
+	assert.Len(t, split, 5)
+
+	totalWitnesses := 0
+	for _, r := range split {
+		assert.LessOrEqual(t, r.SizeInBytes(), limit)
+		assert.Len(t, r.TCPConnections, 2)
+		assert.Len(t, r.TLSHandshakes, 2)
+		assert.Len(t, r.Witnesses, 4)
+		totalWitnesses += len(r.Witnesses)
+
+		// Each witness is in the same request as its connection.
+		ports := map[uint16]bool{}
+		for _, c := range r.TCPConnections {
+			ports[c.SrcPort] = true
+		}
+		for _, w := range r.Witnesses {
+			assert.True(t, ports[w.OriginPort] || ports[w.DestinationPort])
+		}
+	}
+	assert.Equal(t, len(req.Witnesses), totalWitnesses)
+}
+
+func TestSplitOversizedGroup(t *testing.T) {
+	req := &UploadReportsRequest{}
+	conn, tls, witnesses := connectionReports(1000, 1000)
+	req.AddTCPConnectionReport(conn)
+	req.AddTLSHandshakeReport(tls)
+	for _, w := range witnesses {
+		req.AddWitnessReport(w)
+	}
+
+	// Each witness needs a request to itself.
+	split := req.Split(26 + witnesses[0].SizeInBytes() + 10)
+	assert.Len(t, split, 3)
+	assert.Len(t, split[0].TCPConnections, 1)
+	assert.Len(t, split[0].TLSHandshakes, 1)
+	assert.Len(t, split[0].Witnesses, 0)
+	assert.Len(t, split[1].Witnesses, 1)
+	assert.Len(t, split[2].Witnesses, 1)
+
+	// Small requests are returned whole.
+	split = req.Split(req.SizeInBytes())
+	assert.Len(t, split, 1)
+	assert.Equal(t, req.SizeInBytes(), split[0].SizeInBytes())
+}
+
+// Requests built without the Add methods are split by the size of their
+// reports.
+func TestSplitStructLiteralRequest(t *testing.T) {
+	req := &UploadReportsRequest{}
+	for port := uint16(1000); port < 1010; port++ {
+		conn, tls, witnesses := connectionReports(port, 100)
+		req.TCPConnections = append(req.TCPConnections, conn)
+		req.TLSHandshakes = append(req.TLSHandshakes, tls)
+		req.Witnesses = append(req.Witnesses, witnesses...)
+	}
+
+	conn, tls, witnesses := connectionReports(1, 100)
+	groupSize := conn.SizeInBytes() + tls.SizeInBytes() + witnesses[0].SizeInBytes() + witnesses[1].SizeInBytes()
+	limit := 26 + 2*groupSize + groupSize/2
+
+	split := req.Split(limit)
+	assert.Len(t, split, 5)
+	totalWitnesses := 0
+	for _, r := range split {
+		assert.LessOrEqual(t, r.SizeInBytes(), limit)
+		totalWitnesses += len(r.Witnesses)
+	}
+	assert.Equal(t, len(req.Witnesses), totalWitnesses)
+}
+
+func TestEncodeBody(t *testing.T) {
+	req := &UploadReportsRequest{}
+	_, _, witnesses := connectionReports(1000, 10000)
+	req.AddWitnessReport(witnesses[0])
+
+	plain, err := req.EncodeBody(IdentityEncoding)
+	assert.NoError(t, err)
+	assert.Equal(t, IdentityEncoding, plain.Encoding)
+	expected, err := json.Marshal(req)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, plain.Body)
+
+	compressed, err := req.EncodeBody(GzipEncoding)
+	assert.NoError(t, err)
+	assert.Equal(t, GzipEncoding, compressed.Encoding)
+	assert.Less(t, compressed.Size(), plain.Size())
+
+	r, err := gzip.NewReader(bytes.NewReader(compressed.Body))
+	assert.NoError(t, err)
+	decompressed, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, decompressed)
+
+	compressed, err = req.EncodeBody(ZstdEncoding)
+	assert.NoError(t, err)
+	assert.Equal(t, ZstdEncoding, compressed.Encoding)
+	assert.Less(t, compressed.Size(), plain.Size())
+
+	zr, err := zstd.NewReader(bytes.NewReader(compressed.Body))
+	assert.NoError(t, err)
+	defer zr.Close()
+	decompressed, err = io.ReadAll(zr)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, decompressed)
+
+	_, err = req.EncodeBody(ContentEncoding("br"))
+	assert.Error(t, err)
+}
@@ -16,3 +16,29 @@ type Buffer[Item any] interface {
 	// empty, even when an error occurs.
 	Flush() error
 }
+
+// A Buffer whose items can be taken out as a batch and consumed separately.
+// This lets InMemory consume a batch without holding its lock, so that items
+// can be added during a slow flush, and lets a batch that fails to be consumed
+// be retried or returned to the buffer.
+type RetryableBuffer[Item any] interface {
+	Buffer[Item]
+
+	// Takes the buffered items out of the buffer as a batch. Items added
+	// afterwards are not part of the batch. Each batch must be ended with
+	// FinishBatch before the next is taken.
+	TakeBatch() []Item
+
+	// Passes a batch taken by TakeBatch to the items' consumer. Unlike the
+	// buffer's other methods, must be safe to call concurrently with Add.
+	ConsumeBatch(items []Item) error
+
+	// Ends the batch last taken by TakeBatch. If keep is true, the batch's items
+	// are returned to the buffer, ahead of any items added since it was taken;
+	// otherwise, they are discarded.
+	FinishBatch(keep bool)
+
+	// Empties the buffer without flushing it, returning the items that were in
+	// the buffer.
+	Drain() []Item
+}
@@ -0,0 +1,485 @@
+package batcher
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	segmentFilePrefix = "segment-"
+	segmentFileSuffix = ".log"
+
+	// Each record in a segment file is preceded by a header holding the length
+	// of the record's payload and its CRC-32 checksum.
+	recordHeaderSize = 8
+
+	defaultSegmentSize_bytes = 4 * 1024 * 1024
+)
+
+// Converts items to and from their on-disk representation.
+type Codec[Item any] interface {
+	Encode(item Item) ([]byte, error)
+	Decode(data []byte) (Item, error)
+}
+
+// Encodes items as JSON.
+type JSONCodec[Item any] struct{}
+
+var _ Codec[int] = JSONCodec[int]{}
+
+func (JSONCodec[Item]) Encode(item Item) ([]byte, error) {
+	return json.Marshal(item)
+}
+
+func (JSONCodec[Item]) Decode(data []byte) (Item, error) {
+	var result Item
+	err := json.Unmarshal(data, &result)
+	return result, err
+}
+
+type DiskBufferConfig[Item any] struct {
+	// The directory holding the buffer's segment files. Created if it does not
+	// exist. Must not be shared with any other buffer.
+	Dir string
+
+	// Used to store items on disk. Defaults to JSONCodec.
+	Codec Codec[Item]
+
+	// Receives the buffered items when the buffer is flushed.
+	Consumer func([]Item) error
+
+	// The soft limit on the number of items in the buffer. Add reports that the
+	// buffer is full once this many items are buffered.
+	BatchSize int
+
+	// The maximum number of bytes to keep on disk. When this is exceeded, the
+	// oldest segment files are discarded, along with the items they hold. Zero
+	// means no limit.
+	MaxSize_bytes int64
+
+	// Items are written to a new segment file once the current one reaches this
+	// size. Eviction happens a segment at a time. Defaults to 4 MiB, or a quarter
+	// of MaxSize_bytes if that is smaller. An item larger than this gets a
+	// segment file of its own.
+	SegmentSize_bytes int64
+
+	// If true, each item is synced to stable storage before Add returns.
+	// Otherwise, items may be lost if the machine crashes, but not if only the
+	// process crashes.
+	Sync bool
+
+	// If non-nil, called with the number of items discarded whenever segment
+	// files are evicted to stay within MaxSize_bytes, or when items cannot be
+	// decoded.
+	OnDiscard func(numItems int)
+}
+
+// A Buffer that spools items to append-only segment files on disk, so that
+// items survive crashes and restarts. Items left on disk by a previous process
+// are included in the next flush.
+//
+// Each record is checksummed. A record that is incomplete or fails its
+// checksum, such as one being written when the process crashed, is discarded
+// along with the remainder of its segment file.
+//
+// Not thread-safe; wrap with InMemory for concurrent use.
+type DiskBuffer[Item any] struct {
+	config DiskBufferConfig[Item]
+
+	// Segment files, oldest first. Only the last can be open for writing.
+	segments []*diskSegment
+
+	// Segment files holding the batch taken by TakeBatch, if any. They are kept
+	// on disk until the batch is finished, so that the batch is delivered again
+	// by the next process if this one crashes while consuming it.
+	inFlight []*diskSegment
+
+	// The open segment file being appended to, if any. Always the last element
+	// of segments.
+	current *os.File
+
+	// The total size of the segment files and the number of items they hold,
+	// not counting those in flight.
+	size_bytes int64
+	numItems   int
+
+	// The ID to give the next segment file. IDs increase with creation time.
+	nextSegmentID uint64
+}
+
+var _ RetryableBuffer[int] = (*DiskBuffer[int])(nil)
+
+type diskSegment struct {
+	id         uint64
+	size_bytes int64
+	numItems   int
+}
+
+// Opens a disk buffer in the configured directory, picking up any items left
+// there by a previous process.
+func NewDiskBuffer[Item any](config DiskBufferConfig[Item]) (*DiskBuffer[Item], error) {
+	if config.Dir == "" {
+		return nil, errors.New("disk buffer directory not specified")
+	}
+	if config.Consumer == nil {
+		return nil, errors.New("disk buffer consumer not specified")
+	}
+	if config.BatchSize < 1 {
+		return nil, errors.Errorf("invalid disk buffer batch size %d", config.BatchSize)
+	}
+	if config.MaxSize_bytes < 0 {
+		return nil, errors.Errorf("invalid disk buffer max size %d", config.MaxSize_bytes)
+	}
+	if config.Codec == nil {
+		config.Codec = JSONCodec[Item]{}
+	}
+	if config.SegmentSize_bytes <= 0 {
+		config.SegmentSize_bytes = defaultSegmentSize_bytes
+		if config.MaxSize_bytes > 0 && config.MaxSize_bytes/4 < config.SegmentSize_bytes {
+			config.SegmentSize_bytes = config.MaxSize_bytes / 4
+		}
+	}
+
+	if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+		return nil, errors.Wrapf(err, "unable to create disk buffer directory %s", config.Dir)
+	}
+
+	b := &DiskBuffer[Item]{config: config}
+	if err := b.loadSegments(); err != nil {
+		return nil, err
+	}
+	b.evict()
+	return b, nil
+}
+
+// Returns the number of items in the buffer.
+func (b *DiskBuffer[Item]) Len() int {
+	return b.numItems
+}
+
+func (b *DiskBuffer[Item]) Add(item Item) (bool, error) {
+	payload, err := b.config.Codec.Encode(item)
+	if err != nil {
+		return false, errors.Wrap(err, "unable to encode item")
+	}
+	if int64(len(payload)) > math.MaxUint32 {
+		return false, errors.Errorf("encoded item is too large for disk buffer: %d bytes", len(payload))
+	}
+
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeaderSize:], payload)
+
+	if b.current == nil || b.lastSegment().size_bytes+int64(len(record)) > b.config.SegmentSize_bytes {
+		if err := b.startSegment(); err != nil {
+			return false, err
+		}
+	}
+
+	segment := b.lastSegment()
+	n, err := b.current.Write(record)
+	segment.size_bytes += int64(n)
+	b.size_bytes += int64(n)
+	if err != nil {
+		// The partial record will be discarded when the segment is read.
+		b.closeCurrent()
+		return false, errors.Wrapf(err, "unable to write to disk buffer segment %s", b.segmentPath(segment.id))
+	}
+	if b.config.Sync {
+		if err := b.current.Sync(); err != nil {
+			return false, errors.Wrapf(err, "unable to sync disk buffer segment %s", b.segmentPath(segment.id))
+		}
+	}
+	segment.numItems++
+	b.numItems++
+
+	b.evict()
+	return b.numItems >= b.config.BatchSize, nil
+}
+
+// Reads the buffered items from disk and passes them to the consumer. The
+// segment files are removed once the consumer returns, so items are delivered
+// at least once: if the process crashes during a flush, the items are
+// delivered again by the next process.
+func (b *DiskBuffer[Item]) Flush() error {
+	items, numDiscarded, readErr := b.readItems()
+
+	var consumerErr error
+	if len(items) > 0 {
+		consumerErr = b.config.Consumer(items)
+	}
+	b.removeSegments(numDiscarded)
+
+	if consumerErr != nil {
+		return errors.Wrap(consumerErr, "unable to consume disk buffer items")
+	}
+	return readErr
+}
+
+// Like Flush, but if the consumer returns an error, the items are kept on disk
+// so that the flush can be retried.
+func (b *DiskBuffer[Item]) TryFlush() error {
+	items, numDiscarded, readErr := b.readItems()
+
+	if len(items) > 0 {
+		if err := b.config.Consumer(items); err != nil {
+			return errors.Wrap(err, "unable to consume disk buffer items")
+		}
+	}
+	b.removeSegments(numDiscarded)
+	return readErr
+}
+
+func (b *DiskBuffer[Item]) TakeBatch() []Item {
+	items, numDiscarded, _ := b.readItems()
+	b.inFlight = append(b.inFlight, b.segments...)
+	b.segments = nil
+	b.size_bytes = 0
+	b.numItems = 0
+	b.discarded(numDiscarded)
+	return items
+}
+
+func (b *DiskBuffer[Item]) ConsumeBatch(items []Item) error {
+	if err := b.config.Consumer(items); err != nil {
+		return errors.Wrap(err, "unable to consume disk buffer items")
+	}
+	return nil
+}
+
+func (b *DiskBuffer[Item]) FinishBatch(keep bool) {
+	if keep {
+		for _, segment := range b.inFlight {
+			b.size_bytes += segment.size_bytes
+			b.numItems += segment.numItems
+		}
+		b.segments = append(b.inFlight, b.segments...)
+	} else {
+		for _, segment := range b.inFlight {
+			os.Remove(b.segmentPath(segment.id))
+		}
+	}
+	b.inFlight = nil
+}
+
+func (b *DiskBuffer[Item]) Drain() []Item {
+	items, numDiscarded, _ := b.readItems()
+	b.removeSegments(numDiscarded)
+	return items
+}
+
+// Reads the buffered items from disk. Also returns the number of items that
+// were lost to corruption or could not be decoded.
+func (b *DiskBuffer[Item]) readItems() (items []Item, numDiscarded int, err error) {
+	b.closeCurrent()
+
+	for _, segment := range b.segments {
+		records, readErr := b.readSegment(segment.id)
+		if readErr != nil && err == nil {
+			err = readErr
+		}
+		for _, record := range records {
+			item, decodeErr := b.config.Codec.Decode(record)
+			if decodeErr != nil {
+				numDiscarded++
+				continue
+			}
+			items = append(items, item)
+		}
+		if lost := segment.numItems - len(records); lost > 0 {
+			numDiscarded += lost
+		}
+	}
+	return items, numDiscarded, err
+}
+
+// Removes all segment files, leaving the buffer empty.
+func (b *DiskBuffer[Item]) removeSegments(numDiscarded int) {
+	for _, segment := range b.segments {
+		os.Remove(b.segmentPath(segment.id))
+	}
+	b.segments = nil
+	b.size_bytes = 0
+	b.numItems = 0
+	b.discarded(numDiscarded)
+}
+
+// Closes the open segment file, if any. Buffered items remain on disk, to be
+// picked up by the next DiskBuffer opened on the same directory.
+func (b *DiskBuffer[Item]) Close() error {
+	return b.closeCurrent()
+}
+
+// Finds the segment files in the buffer's directory and counts the valid
+// records in each.
+func (b *DiskBuffer[Item]) loadSegments() error {
+	entries, err := os.ReadDir(b.config.Dir)
+	if err != nil {
+		return errors.Wrapf(err, "unable to read disk buffer directory %s", b.config.Dir)
+	}
+
+	var ids []uint64
+	for _, entry := range entries {
+		if id, ok := parseSegmentFileName(entry.Name()); ok && entry.Type().IsRegular() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		records, err := b.readSegment(id)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(b.segmentPath(id))
+		if err != nil {
+			return errors.Wrapf(err, "unable to stat disk buffer segment %s", b.segmentPath(id))
+		}
+
+		b.segments = append(b.segments, &diskSegment{
+			id:         id,
+			size_bytes: info.Size(),
+			numItems:   len(records),
+		})
+		b.size_bytes += info.Size()
+		b.numItems += len(records)
+		b.nextSegmentID = id + 1
+	}
+	return nil
+}
+
+// Returns the payloads of the valid records in the given segment file,
+// stopping at the first incomplete or corrupt record.
+func (b *DiskBuffer[Item]) readSegment(id uint64) ([][]byte, error) {
+	path := b.segmentPath(id)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open disk buffer segment %s", path)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to stat disk buffer segment %s", path)
+	}
+	remaining_bytes := info.Size()
+
+	var result [][]byte
+	r := bufio.NewReader(f)
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return result, nil
+			}
+			return result, errors.Wrapf(err, "unable to read disk buffer segment %s", path)
+		}
+
+		remaining_bytes -= recordHeaderSize
+
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if length > remaining_bytes {
+			// Incomplete record, or corrupt length. Don't try to allocate it.
+			return result, nil
+		}
+		remaining_bytes -= length
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return result, nil
+			}
+			return result, errors.Wrapf(err, "unable to read disk buffer segment %s", path)
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return result, nil
+		}
+		result = append(result, payload)
+	}
+}
+
+// Closes the current segment file and starts a new one.
+func (b *DiskBuffer[Item]) startSegment() error {
+	b.closeCurrent()
+
+	id := b.nextSegmentID
+	path := b.segmentPath(id)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0o600)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create disk buffer segment %s", path)
+	}
+
+	b.nextSegmentID++
+	b.current = f
+	b.segments = append(b.segments, &diskSegment{id: id})
+	return nil
+}
+
+func (b *DiskBuffer[Item]) closeCurrent() error {
+	if b.current == nil {
+		return nil
+	}
+	err := b.current.Close()
+	b.current = nil
+	return err
+}
+
+// Removes the oldest segment files until the buffer is within its size limit.
+// The segment being written is never removed.
+func (b *DiskBuffer[Item]) evict() {
+	if b.config.MaxSize_bytes == 0 {
+		return
+	}
+
+	for b.size_bytes > b.config.MaxSize_bytes && len(b.segments) > 0 {
+		oldest := b.segments[0]
+		if b.current != nil && len(b.segments) == 1 {
+			return
+		}
+
+		os.Remove(b.segmentPath(oldest.id))
+		b.segments = b.segments[1:]
+		b.size_bytes -= oldest.size_bytes
+		b.numItems -= oldest.numItems
+		b.discarded(oldest.numItems)
+	}
+}
+
+func (b *DiskBuffer[Item]) discarded(numItems int) {
+	if b.config.OnDiscard != nil && numItems > 0 {
+		b.config.OnDiscard(numItems)
+	}
+}
+
+func (b *DiskBuffer[Item]) lastSegment() *diskSegment {
+	return b.segments[len(b.segments)-1]
+}
+
+func (b *DiskBuffer[Item]) segmentPath(id uint64) string {
+	return filepath.Join(b.config.Dir, fmt.Sprintf("%s%020d%s", segmentFilePrefix, id, segmentFileSuffix))
+}
+
+func parseSegmentFileName(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, segmentFilePrefix) || !strings.HasSuffix(name, segmentFileSuffix) {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, segmentFilePrefix), segmentFileSuffix), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
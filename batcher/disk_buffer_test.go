@@ -0,0 +1,302 @@
+package batcher
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type collector struct {
+	batches [][]int
+}
+
+func (c *collector) consume(items []int) error {
+	c.batches = append(c.batches, items)
+	return nil
+}
+
+func (c *collector) items() []int {
+	var result []int
+	for _, batch := range c.batches {
+		result = append(result, batch...)
+	}
+	return result
+}
+
+func TestDiskBufferAddFlush(t *testing.T) {
+	c := &collector{}
+	b, err := NewDiskBuffer(DiskBufferConfig[int]{
+		Dir:       t.TempDir(),
+		Consumer:  c.consume,
+		BatchSize: 3,
+	})
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		full, err := b.Add(i)
+		assert.NoError(t, err)
+		assert.Equal(t, i == 2, full)
+	}
+	assert.Equal(t, 3, b.Len())
+
+	assert.NoError(t, b.Flush())
+	assert.Equal(t, [][]int{{0, 1, 2}}, c.batches)
+	assert.Equal(t, 0, b.Len())
+
+	// Flushing an empty buffer doesn't call the consumer.
+	assert.NoError(t, b.Flush())
+	assert.Len(t, c.batches, 1)
+}
+
+func TestDiskBufferReplaysAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	c := &collector{}
+	config := DiskBufferConfig[int]{
+		Dir:               dir,
+		Consumer:          c.consume,
+		BatchSize:         100,
+		SegmentSize_bytes: 32,
+	}
+
+	b, err := NewDiskBuffer(config)
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := b.Add(i)
+		assert.NoError(t, err)
+	}
+
+	// Simulate a crash part way through writing another item.
+	assert.NoError(t, b.Close())
+	segments, err := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	assert.NoError(t, err)
+	assert.Greater(t, len(segments), 1)
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 9, 1, 2})
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	// A new buffer picks up where the old one left off.
+	b, err = NewDiskBuffer(config)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, b.Len())
+	_, err = b.Add(10)
+	assert.NoError(t, err)
+	assert.NoError(t, b.Flush())
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, c.items())
+
+	segments, err = filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	assert.NoError(t, err)
+	assert.Empty(t, segments)
+}
+
+func TestDiskBufferDiscardsCorruptRecords(t *testing.T) {
+	dir := t.TempDir()
+	c := &collector{}
+	config := DiskBufferConfig[int]{
+		Dir:       dir,
+		Consumer:  c.consume,
+		BatchSize: 100,
+	}
+
+	b, err := NewDiskBuffer(config)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := b.Add(i)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, b.Close())
+
+	// Corrupt the payload of the second record. Each record is an 8-byte header
+	// followed by a 1-byte payload.
+	segments, err := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	assert.NoError(t, err)
+	assert.Len(t, segments, 1)
+	data, err := os.ReadFile(segments[0])
+	assert.NoError(t, err)
+	data[2*recordHeaderSize+1] = '7'
+	assert.NoError(t, os.WriteFile(segments[0], data, 0o600))
+
+	b, err = NewDiskBuffer(config)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, b.Len())
+	assert.NoError(t, b.Flush())
+	assert.Equal(t, []int{0}, c.items())
+}
+
+// Items larger than a segment are kept, and survive a restart.
+func TestDiskBufferKeepsOversizedItems(t *testing.T) {
+	dir := t.TempDir()
+	var got [][]string
+	config := DiskBufferConfig[string]{
+		Dir: dir,
+		Consumer: func(items []string) error {
+			got = append(got, items)
+			return nil
+		},
+		BatchSize:         100,
+		SegmentSize_bytes: 64,
+	}
+
+	big := strings.Repeat("x", 200)
+	b, err := NewDiskBuffer(config)
+	assert.NoError(t, err)
+	for _, item := range []string{"a", big, "b"} {
+		_, err := b.Add(item)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, b.Close())
+
+	b, err = NewDiskBuffer(config)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, b.Len())
+	assert.NoError(t, b.Flush())
+	assert.Equal(t, [][]string{{"a", big, "b"}}, got)
+}
+
+// A record whose length runs past the end of its segment is treated as
+// incomplete.
+func TestDiskBufferDiscardsTruncatedRecords(t *testing.T) {
+	dir := t.TempDir()
+	c := &collector{}
+	config := DiskBufferConfig[int]{
+		Dir:       dir,
+		Consumer:  c.consume,
+		BatchSize: 100,
+	}
+
+	b, err := NewDiskBuffer(config)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := b.Add(i)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, b.Close())
+
+	// Claim that the second record is longer than the rest of the file.
+	segments, err := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	assert.NoError(t, err)
+	assert.Len(t, segments, 1)
+	data, err := os.ReadFile(segments[0])
+	assert.NoError(t, err)
+	data[recordHeaderSize+1+3] = 100
+	assert.NoError(t, os.WriteFile(segments[0], data, 0o600))
+
+	b, err = NewDiskBuffer(config)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, b.Len())
+	assert.NoError(t, b.Flush())
+	assert.Equal(t, []int{0}, c.items())
+}
+
+func TestDiskBufferEvictsOldest(t *testing.T) {
+	c := &collector{}
+	discarded := 0
+	b, err := NewDiskBuffer(DiskBufferConfig[int]{
+		Dir:               t.TempDir(),
+		Consumer:          c.consume,
+		BatchSize:         1000,
+		MaxSize_bytes:     100,
+		SegmentSize_bytes: 20,
+		OnDiscard:         func(n int) { discarded += n },
+	})
+	assert.NoError(t, err)
+
+	// Each record takes 10 bytes, so each segment holds two items.
+	for i := 0; i < 30; i++ {
+		_, err := b.Add(i)
+		assert.NoError(t, err)
+	}
+	assert.LessOrEqual(t, b.Len(), 10)
+	assert.Equal(t, 30, b.Len()+discarded)
+
+	// The newest items are kept.
+	numKept := b.Len()
+	assert.NoError(t, b.Flush())
+	items := c.items()
+	assert.Len(t, items, numKept)
+	assert.Equal(t, 30-numKept, items[0])
+	assert.Equal(t, 29, items[len(items)-1])
+}
+
+func TestDiskBufferTryFlushKeepsItems(t *testing.T) {
+	fail := true
+	var consumed []int
+	b, err := NewDiskBuffer(DiskBufferConfig[int]{
+		Dir: t.TempDir(),
+		Consumer: func(items []int) error {
+			if fail {
+				return errors.New("upload failed")
+			}
+			consumed = append(consumed, items...)
+			return nil
+		},
+		BatchSize: 100,
+	})
+	assert.NoError(t, err)
+
+	_, err = b.Add(1)
+	assert.NoError(t, err)
+	assert.Error(t, b.TryFlush())
+	assert.Equal(t, 1, b.Len())
+
+	_, err = b.Add(2)
+	assert.NoError(t, err)
+	fail = false
+	assert.NoError(t, b.TryFlush())
+	assert.Equal(t, []int{1, 2}, consumed)
+	assert.Equal(t, 0, b.Len())
+
+	_, err = b.Add(3)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{3}, b.Drain())
+	assert.Equal(t, 0, b.Len())
+}
+
+func TestDiskBufferBatches(t *testing.T) {
+	dir := t.TempDir()
+	c := &collector{}
+	config := DiskBufferConfig[int]{
+		Dir:       dir,
+		Consumer:  c.consume,
+		BatchSize: 100,
+	}
+
+	b, err := NewDiskBuffer(config)
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err := b.Add(i)
+		assert.NoError(t, err)
+	}
+
+	// Items added while a batch is out are not part of it.
+	assert.Equal(t, []int{0, 1}, b.TakeBatch())
+	assert.Equal(t, 0, b.Len())
+	_, err = b.Add(2)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, b.Len())
+
+	// A kept batch goes back ahead of the newer items.
+	b.FinishBatch(true)
+	assert.Equal(t, 3, b.Len())
+	batch := b.TakeBatch()
+	assert.Equal(t, []int{0, 1, 2}, batch)
+	assert.NoError(t, b.ConsumeBatch(batch))
+	b.FinishBatch(false)
+	assert.Equal(t, []int{0, 1, 2}, c.items())
+
+	// A batch that is never finished, as when the process crashes while
+	// consuming it, is delivered again by the next process.
+	_, err = b.Add(3)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{3}, b.TakeBatch())
+	assert.NoError(t, b.Close())
+
+	b, err = NewDiskBuffer(config)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{3}, b.Drain())
+}
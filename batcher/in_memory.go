@@ -1,29 +1,142 @@
 package batcher
 
 import (
+	"context"
+	"math/rand"
 	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 )
 
+const (
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = 30 * time.Second
+)
+
+// Controls when InMemory flushes and how it handles failed flushes.
+type InMemoryOptions[Item any] struct {
+	// Flush once this many items have been added since the last flush. Zero
+	// means no limit, other than the one imposed by the buffer.
+	MaxBatchSize_items int
+
+	// Flush once the items added since the last flush total at least this many
+	// bytes, as measured by ItemSize. Zero means no limit.
+	MaxBatchSize_bytes int
+
+	// Returns the approximate size of an item, such as given by
+	// WitnessReport.SizeInBytes. Required if MaxBatchSize_bytes is set.
+	ItemSize func(Item) int
+
+	// Flush once the oldest item added since the last flush is this old. Zero
+	// means items are only flushed by size or by the periodic flush.
+	MaxItemAge time.Duration
+
+	// If true, flushes triggered by Add happen in the background, so that Add
+	// returns without waiting for a slow flush.
+	AsyncFlush bool
+
+	// If non-nil, called each time a flush attempt fails, with the number of
+	// the attempt, starting at 1.
+	OnFlushError func(err error, attempt int)
+
+	// The number of times to try each flush before giving up and passing the
+	// items to OnDeadLetter. Zero means no limit: each flush makes one attempt,
+	// and if it fails, the items stay in the buffer to be included in the next
+	// flush. Retries are only possible if the buffer implements RetryableBuffer;
+	// other buffers are empty after a failed flush.
+	MaxAttempts int
+
+	// The delay before the first retry. Each subsequent delay is double the
+	// previous, up to MaxBackoff. Default 100ms.
+	InitialBackoff time.Duration
+
+	// The longest delay between retries. Default 30s.
+	MaxBackoff time.Duration
+
+	// Randomizes each delay by up to this fraction in either direction, so that
+	// many agents that fail together don't retry together. Zero means no
+	// jitter; 0.2 is a reasonable choice.
+	BackoffJitter float64
+
+	// If non-nil, called when a flush is abandoned, either because every
+	// attempt failed or because the deadline given to Close passed. Receives
+	// the items that were not flushed and the last error. The items are nil if
+	// the buffer does not implement RetryableBuffer.
+	OnDeadLetter func(items []Item, err error)
+}
+
 // A wrapper around a Buffer[Item] that manages thread-safety and flushing.
 type InMemory[Item any] struct {
-	buf Buffer[Item] // protected by mu
+	buf  Buffer[Item] // protected by mu
+	opts InMemoryOptions[Item]
+
+	// Cancelled when the batcher is closed, to stop periodic flushing and
+	// abandon retries in progress.
+	closing       context.Context
+	cancelClosing context.CancelFunc
 
-	signalClose                chan struct{} // closed when the batcher is closed
 	signalPeriodicFlushStopped chan struct{} // closed when we stopped periodic flushing
 	mu                         sync.Mutex
+
+	// Held for the duration of a flush, including retries, so that flushes
+	// don't interleave.
+	flushMu sync.Mutex
+
+	// Signals the background goroutine to flush. Has a buffer of one, so that
+	// requests made while a flush is pending are coalesced.
+	flushRequests chan struct{}
+
+	// The number and approximate size of the items added since the last
+	// successful flush. Protected by mu.
+	pendingItems int
+	pendingBytes int
+
+	// Requests a flush when the oldest pending item reaches MaxItemAge. Nil if
+	// there are no pending items or MaxItemAge is not set. Protected by mu.
+	ageTimer *time.Timer
+
+	// The batch taken from a RetryableBuffer by the flush in progress, if any.
+	// Protected by mu.
+	inFlight []Item
+
+	// Set when Close gives up on a flush that is still in progress. The flush's
+	// batch has then been passed to OnDeadLetter, so it is discarded when the
+	// flush ends, rather than returned to the buffer or dead-lettered again.
+	// Protected by mu.
+	abandoned bool
 }
 
 func NewInMemory[Item any](
 	buf Buffer[Item],
 	flushDuration time.Duration,
 ) *InMemory[Item] {
+	return NewInMemoryWithOptions(buf, flushDuration, InMemoryOptions[Item]{})
+}
+
+func NewInMemoryWithOptions[Item any](
+	buf Buffer[Item],
+	flushDuration time.Duration,
+	opts InMemoryOptions[Item],
+) *InMemory[Item] {
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = defaultInitialBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaultMaxBackoff
+	}
+	if opts.ItemSize == nil {
+		opts.MaxBatchSize_bytes = 0
+	}
+
+	closing, cancelClosing := context.WithCancel(context.Background())
 	m := &InMemory[Item]{
 		buf:                        buf,
-		signalClose:                make(chan struct{}),
+		opts:                       opts,
+		closing:                    closing,
+		cancelClosing:              cancelClosing,
 		signalPeriodicFlushStopped: make(chan struct{}),
+		flushRequests:              make(chan struct{}, 1),
 	}
 
 	go func() {
@@ -32,12 +145,12 @@ func NewInMemory[Item any](
 		defer ticker.Stop()
 		for {
 			select {
-			case <-m.signalClose:
+			case <-m.closing.Done():
 				return
 			case <-ticker.C:
-				m.mu.Lock()
-				m.buf.Flush()
-				m.mu.Unlock()
+				m.flush(m.closing)
+			case <-m.flushRequests:
+				m.flush(m.closing)
 			}
 		}
 	}()
@@ -46,29 +159,246 @@ func NewInMemory[Item any](
 }
 
 func (m *InMemory[Item]) Add(items ...Item) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
 	for _, item := range items {
+		m.mu.Lock()
 		full, err := m.buf.Add(item)
+		if err == nil {
+			full = m.recordAdded(item) || full
+		}
+		m.mu.Unlock()
 		if err != nil {
 			return errors.Wrap(err, "unable to add item to batch")
 		}
 
 		if full {
-			m.buf.Flush()
+			if m.opts.AsyncFlush {
+				m.requestFlush()
+			} else {
+				m.flush(m.closing)
+			}
 		}
 	}
 
 	return nil
 }
 
-func (m *InMemory[_]) Close() {
+// Updates the pending item counters for a newly added item. Returns true if a
+// flush is due. Must be called with mu held.
+func (m *InMemory[Item]) recordAdded(item Item) bool {
+	m.pendingItems++
+	if m.opts.MaxBatchSize_bytes > 0 {
+		m.pendingBytes += m.opts.ItemSize(item)
+	}
+	if m.pendingItems == 1 && m.opts.MaxItemAge > 0 {
+		m.ageTimer = time.AfterFunc(m.opts.MaxItemAge, m.requestFlush)
+	}
+
+	return (m.opts.MaxBatchSize_items > 0 && m.pendingItems >= m.opts.MaxBatchSize_items) ||
+		(m.opts.MaxBatchSize_bytes > 0 && m.pendingBytes >= m.opts.MaxBatchSize_bytes)
+}
+
+// Resets the pending item counters after the buffer is emptied. Must be called
+// with mu held.
+func (m *InMemory[Item]) resetPending() {
+	m.pendingItems = 0
+	m.pendingBytes = 0
+	if m.ageTimer != nil {
+		m.ageTimer.Stop()
+		m.ageTimer = nil
+	}
+}
+
+// Asks the background goroutine to flush, without waiting for the flush.
+func (m *InMemory[Item]) requestFlush() {
+	select {
+	case m.flushRequests <- struct{}{}:
+	default:
+		// A flush is already pending.
+	}
+}
+
+// Stops periodic flushing and flushes any remaining items. If the context is
+// done before the flush succeeds, the remaining items are passed to the
+// OnDeadLetter hook and the context's error is returned. Otherwise, returns
+// the error from the final flush, if any. If MaxAttempts is zero, items from a
+// failed final flush are left in the buffer, so that a DiskBuffer can replay
+// them in the next process.
+//
+// If the consumer is still running when the context is done, Close returns
+// without waiting for it. The items it was given are passed to OnDeadLetter
+// along with the rest, even though the consumer may yet deliver them. For a
+// buffer that is not a RetryableBuffer, the items are not known, and
+// OnDeadLetter receives nil.
+func (m *InMemory[Item]) Close(ctx context.Context) error {
 	// Stop the periodic flusher.
-	close(m.signalClose)
-	<-m.signalPeriodicFlushStopped
+	m.cancelClosing()
+	select {
+	case <-m.signalPeriodicFlushStopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- m.flush(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-flushed:
+	case <-ctx.Done():
+		select {
+		case err = <-flushed:
+		default:
+			m.abandonFlush(ctx.Err())
+			return ctx.Err()
+		}
+	}
+
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		m.flushMu.Lock()
+		defer m.flushMu.Unlock()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if retryable, ok := m.buf.(RetryableBuffer[Item]); ok {
+			if items := retryable.Drain(); len(items) > 0 {
+				m.deadLetter(items, err)
+			}
+		}
+		m.resetPending()
+		return ctxErr
+	}
+	return err
+}
+
+// Gives up on a flush that is stuck in the consumer, leaving it to finish in
+// the background. Passes the items in the buffer and in the flush's batch to
+// OnDeadLetter.
+func (m *InMemory[Item]) abandonFlush(err error) {
+	retryable, ok := m.buf.(RetryableBuffer[Item])
+	if !ok {
+		// The flush holds mu, and its items can't be recovered.
+		m.deadLetter(nil, err)
+		return
+	}
 
+	m.mu.Lock()
+	items := append(append([]Item(nil), m.inFlight...), retryable.Drain()...)
+	m.abandoned = true
+	m.resetPending()
+	m.mu.Unlock()
+
+	if len(items) > 0 {
+		m.deadLetter(items, err)
+	}
+}
+
+// Flushes the buffer, retrying failed attempts with exponential backoff. Gives
+// up early, returning any unflushed items to the buffer, if the context is
+// done. Returns the error from the last attempt.
+//
+// If the buffer is a RetryableBuffer, its items are taken out as a batch, and
+// the batch is consumed without holding mu, so that Add is not blocked by a
+// slow flush. Otherwise, mu is held for the whole flush.
+func (m *InMemory[Item]) flush(ctx context.Context) error {
+	m.flushMu.Lock()
+	defer m.flushMu.Unlock()
+
+	retryable, canRetry := m.buf.(RetryableBuffer[Item])
+	if !canRetry {
+		m.mu.Lock()
+		err := m.buf.Flush()
+		m.resetPending()
+		m.mu.Unlock()
+
+		if err != nil {
+			m.flushFailed(err, 1)
+			m.deadLetter(nil, err)
+		}
+		return err
+	}
+
+	m.mu.Lock()
+	batch := retryable.TakeBatch()
+	m.inFlight = batch
+	m.resetPending()
+	m.mu.Unlock()
+
+	// Items added while the batch is being consumed are left for the next
+	// flush.
+	for attempt := 1; ; attempt++ {
+		var err error
+		if len(batch) > 0 {
+			err = retryable.ConsumeBatch(batch)
+		}
+		if err == nil {
+			m.finishBatch(retryable, false)
+			return nil
+		}
+		m.flushFailed(err, attempt)
+
+		if m.opts.MaxAttempts == 0 {
+			// Leave the items in the buffer for the next flush.
+			m.finishBatch(retryable, true)
+			return err
+		}
+		if attempt >= m.opts.MaxAttempts {
+			if m.finishBatch(retryable, false) {
+				m.deadLetter(batch, err)
+			}
+			return err
+		}
+
+		timer := time.NewTimer(m.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			m.finishBatch(retryable, true)
+			return err
+		}
+	}
+}
+
+// Ends the flush's batch. Returns false if Close abandoned the flush, in which
+// case the batch is discarded, since it has already been dead-lettered.
+func (m *InMemory[Item]) finishBatch(retryable RetryableBuffer[Item], keep bool) bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.buf.Flush()
+
+	m.inFlight = nil
+	if m.abandoned {
+		retryable.FinishBatch(false)
+		return false
+	}
+	retryable.FinishBatch(keep)
+	return true
+}
+
+func (m *InMemory[Item]) flushFailed(err error, attempt int) {
+	if m.opts.OnFlushError != nil {
+		m.opts.OnFlushError(err, attempt)
+	}
+}
+
+// Returns how long to wait after the given failed attempt.
+func (m *InMemory[Item]) backoff(attempt int) time.Duration {
+	delay := m.opts.InitialBackoff
+	for i := 1; i < attempt && delay < m.opts.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > m.opts.MaxBackoff {
+		delay = m.opts.MaxBackoff
+	}
+
+	if m.opts.BackoffJitter > 0 {
+		delay = time.Duration(float64(delay) * (1 + m.opts.BackoffJitter*(2*rand.Float64()-1)))
+	}
+	return delay
+}
+
+func (m *InMemory[Item]) deadLetter(items []Item, err error) {
+	if m.opts.OnDeadLetter != nil {
+		m.opts.OnDeadLetter(items, err)
+	}
 }
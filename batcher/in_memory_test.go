@@ -1,8 +1,13 @@
 package batcher
 
 import (
+	"context"
+	"errors"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 type testBuffer struct {
@@ -42,7 +47,7 @@ func TestInMemoryBatcherFlushOnBatchSize(t *testing.T) {
 		},
 		999*time.Minute,
 	)
-	defer b.Close()
+	defer b.Close(context.Background())
 
 	expectedItemCount := 2 * bufSize
 	for i := 0; i < expectedItemCount; i++ {
@@ -87,7 +92,7 @@ func TestInMemoryBatcherFlushOnClose(t *testing.T) {
 	}
 
 	// Close should trigger a flush.
-	b.Close()
+	b.Close(context.Background())
 
 	if procCount != 3 {
 		t.Errorf("expected 3 call to processor, got %d", procCount)
@@ -112,7 +117,7 @@ func TestInMemoryBatcherPeriodicFlush(t *testing.T) {
 		},
 		5*time.Millisecond,
 	)
-	defer b.Close()
+	defer b.Close(context.Background())
 	expectedItemCount := 21
 	for i := 0; i < expectedItemCount; i++ {
 		if err := b.Add(i); err != nil {
@@ -129,3 +134,363 @@ func TestInMemoryBatcherPeriodicFlush(t *testing.T) {
 		time.Sleep(10 * time.Millisecond)
 	}
 }
+
+// A RetryableBuffer whose consumer fails a given number of times before
+// succeeding.
+type flakyBuffer struct {
+	items []int
+	batch []int
+
+	// If non-nil, ConsumeBatch signals on consuming when it starts, then waits
+	// for block to be closed.
+	consuming chan struct{}
+	block     chan struct{}
+
+	// Protects the fields below, which are used by ConsumeBatch.
+	mu       sync.Mutex
+	failures int
+	flushed  []int
+	attempts int
+}
+
+var _ RetryableBuffer[int] = (*flakyBuffer)(nil)
+
+func (buf *flakyBuffer) Add(val int) (bool, error) {
+	buf.items = append(buf.items, val)
+	return false, nil
+}
+
+func (buf *flakyBuffer) Flush() error {
+	items := buf.items
+	buf.items = nil
+	return buf.ConsumeBatch(items)
+}
+
+func (buf *flakyBuffer) TakeBatch() []int {
+	buf.batch = buf.items
+	buf.items = nil
+	return buf.batch
+}
+
+func (buf *flakyBuffer) ConsumeBatch(items []int) error {
+	if buf.block != nil {
+		buf.consuming <- struct{}{}
+		<-buf.block
+	}
+
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+
+	buf.attempts++
+	if buf.failures > 0 {
+		buf.failures--
+		return errors.New("upload failed")
+	}
+	buf.flushed = append(buf.flushed, items...)
+	return nil
+}
+
+func (buf *flakyBuffer) FinishBatch(keep bool) {
+	if keep {
+		buf.items = append(buf.batch, buf.items...)
+	}
+	buf.batch = nil
+}
+
+func (buf *flakyBuffer) Drain() []int {
+	result := buf.items
+	buf.items = nil
+	return result
+}
+
+func (buf *flakyBuffer) status() (attempts int, flushed []int) {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	return buf.attempts, buf.flushed
+}
+
+func TestInMemoryBatcherRetriesFailedFlush(t *testing.T) {
+	buf := &flakyBuffer{failures: 2}
+	var errAttempts []int
+	b := NewInMemoryWithOptions[int](buf, 999*time.Minute, InMemoryOptions[int]{
+		OnFlushError:   func(err error, attempt int) { errAttempts = append(errAttempts, attempt) },
+		MaxAttempts:    5,
+		InitialBackoff: time.Millisecond,
+		BackoffJitter:  0.2,
+		OnDeadLetter:   func(items []int, err error) { t.Errorf("unexpected dead letter: %v", err) },
+	})
+
+	assert.NoError(t, b.Add(1, 2, 3))
+	assert.NoError(t, b.Close(context.Background()))
+
+	attempts, flushed := buf.status()
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, []int{1, 2, 3}, flushed)
+	assert.Equal(t, []int{1, 2}, errAttempts)
+}
+
+func TestInMemoryBatcherDeadLetter(t *testing.T) {
+	buf := &flakyBuffer{failures: 100}
+	var deadLetters []int
+	b := NewInMemoryWithOptions[int](buf, 999*time.Minute, InMemoryOptions[int]{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		OnDeadLetter:   func(items []int, err error) { deadLetters = append(deadLetters, items...) },
+	})
+
+	assert.NoError(t, b.Add(1, 2))
+	err := b.Close(context.Background())
+	assert.Error(t, err)
+
+	attempts, flushed := buf.status()
+	assert.Equal(t, 3, attempts)
+	assert.Empty(t, flushed)
+	assert.Equal(t, []int{1, 2}, deadLetters)
+}
+
+// Without MaxAttempts, a failed flush leaves the items for the next flush.
+func TestInMemoryBatcherKeepsItemsWithoutMaxAttempts(t *testing.T) {
+	buf := &flakyBuffer{failures: 1}
+	var errAttempts []int
+	b := NewInMemoryWithOptions[int](buf, 999*time.Minute, InMemoryOptions[int]{
+		OnFlushError: func(err error, attempt int) { errAttempts = append(errAttempts, attempt) },
+		OnDeadLetter: func(items []int, err error) { t.Errorf("unexpected dead letter: %v", err) },
+	})
+
+	assert.NoError(t, b.Add(1, 2))
+	assert.Error(t, b.flush(context.Background()))
+	attempts, flushed := buf.status()
+	assert.Equal(t, 1, attempts)
+	assert.Empty(t, flushed)
+
+	assert.NoError(t, b.Add(3))
+	assert.NoError(t, b.Close(context.Background()))
+	attempts, flushed = buf.status()
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, []int{1, 2, 3}, flushed)
+	assert.Equal(t, []int{1}, errAttempts)
+}
+
+// Items can be added while a batch is being consumed, and are left for the
+// next flush.
+func TestInMemoryBatcherAddDuringSlowFlush(t *testing.T) {
+	buf := &flakyBuffer{
+		consuming: make(chan struct{}),
+		block:     make(chan struct{}),
+	}
+	b := NewInMemoryWithOptions[int](buf, 999*time.Minute, InMemoryOptions[int]{
+		MaxBatchSize_items: 2,
+		AsyncFlush:         true,
+	})
+
+	assert.NoError(t, b.Add(1, 2))
+	select {
+	case <-buf.consuming:
+	case <-time.After(3 * time.Second):
+		t.Fatal("flush did not start")
+	}
+
+	// The flush is blocked in the consumer.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, b.Add(3))
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Add blocked on flush")
+	}
+
+	close(buf.block)
+	go func() {
+		// Let the final flush through.
+		<-buf.consuming
+	}()
+	assert.NoError(t, b.Close(context.Background()))
+	attempts, flushed := buf.status()
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, []int{1, 2, 3}, flushed)
+}
+
+func TestInMemoryBatcherCloseHonoursDeadline(t *testing.T) {
+	buf := &flakyBuffer{failures: 100}
+	var deadLetters []int
+	b := NewInMemoryWithOptions[int](buf, 999*time.Minute, InMemoryOptions[int]{
+		MaxAttempts:    1000,
+		InitialBackoff: time.Hour,
+		OnDeadLetter:   func(items []int, err error) { deadLetters = append(deadLetters, items...) },
+	})
+	assert.NoError(t, b.Add(1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := b.Close(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, []int{1}, deadLetters)
+}
+
+func TestInMemoryBatcherCloseAbandonsStuckConsumer(t *testing.T) {
+	buf := &flakyBuffer{
+		consuming: make(chan struct{}, 1),
+		block:     make(chan struct{}),
+	}
+	defer close(buf.block)
+	var deadLetters []int
+	b := NewInMemoryWithOptions[int](buf, 999*time.Minute, InMemoryOptions[int]{
+		MaxAttempts:  3,
+		OnDeadLetter: func(items []int, err error) { deadLetters = append(deadLetters, items...) },
+	})
+	assert.NoError(t, b.Add(1))
+	assert.NoError(t, b.Add(2))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := b.Close(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, []int{1, 2}, deadLetters)
+}
+
+func TestInMemoryBatcherCloseAbandonsStuckFlush(t *testing.T) {
+	buf := &recordingBuffer{block: make(chan struct{})}
+	defer close(buf.block)
+	var deadLetters [][]int
+	b := NewInMemoryWithOptions[int](buf, 999*time.Minute, InMemoryOptions[int]{
+		OnDeadLetter: func(items []int, err error) { deadLetters = append(deadLetters, items) },
+	})
+	assert.NoError(t, b.Add(1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := b.Close(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// The items held by a plain Buffer can't be recovered.
+	assert.Equal(t, [][]int{nil}, deadLetters)
+}
+
+func TestBackoff(t *testing.T) {
+	b := NewInMemoryWithOptions[int](&flakyBuffer{}, 999*time.Minute, InMemoryOptions[int]{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+	})
+	defer b.Close(context.Background())
+
+	assert.Equal(t, 10*time.Millisecond, b.backoff(1))
+	assert.Equal(t, 20*time.Millisecond, b.backoff(2))
+	assert.Equal(t, 40*time.Millisecond, b.backoff(3))
+	assert.Equal(t, 50*time.Millisecond, b.backoff(4))
+	assert.Equal(t, 50*time.Millisecond, b.backoff(100))
+}
+
+// A buffer whose consumer can be made to block, for testing flush triggers.
+type recordingBuffer struct {
+	mu      sync.Mutex
+	items   []int
+	batches [][]int
+
+	// If non-nil, Flush waits for this to be closed.
+	block chan struct{}
+}
+
+var _ Buffer[int] = (*recordingBuffer)(nil)
+
+func (buf *recordingBuffer) Add(val int) (bool, error) {
+	buf.items = append(buf.items, val)
+	return false, nil
+}
+
+func (buf *recordingBuffer) Flush() error {
+	if buf.block != nil {
+		<-buf.block
+	}
+
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	if len(buf.items) > 0 {
+		buf.batches = append(buf.batches, buf.items)
+	}
+	buf.items = nil
+	return nil
+}
+
+func (buf *recordingBuffer) getBatches() [][]int {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	return buf.batches
+}
+
+func TestInMemoryBatcherFlushOnItemCount(t *testing.T) {
+	buf := &recordingBuffer{}
+	b := NewInMemoryWithOptions[int](buf, 999*time.Minute, InMemoryOptions[int]{
+		MaxBatchSize_items: 3,
+	})
+
+	assert.NoError(t, b.Add(1, 2, 3, 4, 5, 6, 7))
+	assert.Equal(t, [][]int{{1, 2, 3}, {4, 5, 6}}, buf.getBatches())
+
+	assert.NoError(t, b.Close(context.Background()))
+	assert.Equal(t, [][]int{{1, 2, 3}, {4, 5, 6}, {7}}, buf.getBatches())
+}
+
+func TestInMemoryBatcherFlushOnByteSize(t *testing.T) {
+	buf := &recordingBuffer{}
+	b := NewInMemoryWithOptions[int](buf, 999*time.Minute, InMemoryOptions[int]{
+		MaxBatchSize_bytes: 100,
+		ItemSize:           func(i int) int { return i },
+	})
+	defer b.Close(context.Background())
+
+	assert.NoError(t, b.Add(10, 50, 40, 99, 1, 200))
+	assert.Equal(t, [][]int{{10, 50, 40}, {99, 1}, {200}}, buf.getBatches())
+}
+
+func TestInMemoryBatcherFlushOnAge(t *testing.T) {
+	buf := &recordingBuffer{}
+	b := NewInMemoryWithOptions[int](buf, 999*time.Minute, InMemoryOptions[int]{
+		MaxItemAge: 10 * time.Millisecond,
+	})
+	defer b.Close(context.Background())
+
+	assert.NoError(t, b.Add(1, 2))
+	assert.Eventually(t, func() bool {
+		return len(buf.getBatches()) == 1
+	}, 3*time.Second, 5*time.Millisecond)
+
+	// The age is measured from the first item after a flush.
+	assert.NoError(t, b.Add(3))
+	assert.Eventually(t, func() bool {
+		return len(buf.getBatches()) == 2
+	}, 3*time.Second, 5*time.Millisecond)
+	assert.Equal(t, [][]int{{1, 2}, {3}}, buf.getBatches())
+}
+
+func TestInMemoryBatcherAsyncFlush(t *testing.T) {
+	buf := &recordingBuffer{block: make(chan struct{})}
+	b := NewInMemoryWithOptions[int](buf, 999*time.Minute, InMemoryOptions[int]{
+		MaxBatchSize_items: 2,
+		AsyncFlush:         true,
+	})
+
+	// Add returns even though the flush is blocked.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, b.Add(1, 2))
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Add blocked on flush")
+	}
+
+	close(buf.block)
+	assert.NoError(t, b.Close(context.Background()))
+	assert.Equal(t, [][]int{{1, 2}}, buf.getBatches())
+}
@@ -1,6 +1,7 @@
 package buffer_pool
 
 import (
+	"context"
 	"errors"
 	"io"
 
@@ -37,8 +38,8 @@ type Buffer interface {
 	// Write(p) appends the contents of the slice p to the buffer, obtaining
 	// additional storage from the pool as needed.
 	//
-	// Returns the number of bytes written from p and EmptyPool if the write
-	// stopped early.
+	// Returns the number of bytes written from p and ErrEmptyPool or
+	// ErrQuotaExceeded if the write stopped early.
 	io.Writer
 
 	// ReadFrom(r) copies the contents of the io.Reader r into the buffer until
@@ -48,26 +49,59 @@ type Buffer interface {
 	// Returns the number of bytes copied. Any error except EOF encountered during
 	// the read is also returned.
 	//
-	// EmptyPool is returned if additional storage is needed, but the buffer pool
-	// is empty. It is possible for this to happen even when all of r is copied:
-	// if the end of r coincides exactly with the end of the buffer's allocated
-	// storage, and r doesn't immediately report its EOF, ReadFrom will try to
-	// obtain additional storage from the pool before reading the EOF from r.
+	// ErrEmptyPool is returned if additional storage is needed, but the buffer
+	// pool is empty, and ErrQuotaExceeded is returned if obtaining it would
+	// exceed the buffer's quota. It is possible for this to happen even when all
+	// of r is copied: if the end of r coincides exactly with the end of the
+	// buffer's allocated storage, and r doesn't immediately report its EOF,
+	// ReadFrom will try to obtain additional storage from the pool before
+	// reading the EOF from r.
 	io.ReaderFrom
 }
 
 var ErrEmptyPool = errors.New("buffer_pool.Buffer: pool is empty")
+var ErrQuotaExceeded = errors.New("buffer_pool.Buffer: quota exceeded")
 var errNegativeRead = errors.New("buffer_pool.Buffer: reader returned negative count from Read")
 
+// The source of a buffer's storage. Implemented by each kind of buffer pool.
+type chunkPool interface {
+	// Returns the size of the next chunk to obtain for a buffer that currently
+	// holds allocated_bytes of storage and needs space for needed_bytes more.
+	nextChunkSize(allocated_bytes, needed_bytes int) int
+
+	// Obtains a chunk of the given size. The chunk may be smaller, if the pool
+	// has no room for one of the given size. Returns nil if the pool is empty.
+	getChunk(size int) []byte
+
+	// Obtains a chunk of the given size, waiting for storage to be released if
+	// the pool is empty. Returns nil if the given context is done before a
+	// chunk becomes available.
+	waitForChunk(ctx context.Context, size int) []byte
+
+	// Releases the given chunks back to the pool. Chunks that are not held by
+	// a buffer, such as chunks that were already released, are ignored. Returns
+	// the total size of the chunks released.
+	release(chunks [][]byte) int
+
+	stats() *poolStats
+	tracker() *allocationTracker
+}
+
 type buffer struct {
-	pool bufferPool
+	pool chunkPool
+
+	// Controls how storage is obtained from the pool.
+	opts BufferOptions
+
+	// Where the buffer was created, if TrackAllocations was set at the time.
+	stack string
 
 	// Contents of the buffer start at chunks[0][readOffset] (inclusive) and end
 	// at chunks[len(chunks)-1][writeOffset] (exclusive).
 	//
 	// Invariants, checked by repOk:
 	//   - this is empty when the buffer is empty.
-	//   - all elements have length and capacity pool.chunkSize_bytes.
+	//   - all elements have non-zero length, equal to their capacity.
 	chunks [][]byte
 
 	// Contents of the buffer start at chunks[0][readOffset] (inclusive). This is
@@ -75,7 +109,7 @@ type buffer struct {
 	//
 	// Invariants, checked by repOk:
 	//   - readOffset == 0 when len(chunks) == 0.
-	//   - readOffset < pool.chunkSize_bytes when len(chunks) > 0.
+	//   - readOffset < len(chunks[0]) when len(chunks) > 0.
 	//   - readOffset < writeOffset when len(chunks) == 1.
 	//
 	// XXX Currently not meaningfully used, since we read via Bytes(). This is
@@ -91,10 +125,15 @@ type buffer struct {
 	writeOffset int
 }
 
-func newBuffer(pool bufferPool) Buffer {
-	return &buffer{
+func newBuffer(pool chunkPool, opts BufferOptions) Buffer {
+	result := &buffer{
 		pool: pool,
+		opts: opts,
+	}
+	if TrackAllocations {
+		result.stack = captureStack()
 	}
+	return result
 }
 
 var _ Buffer = (*buffer)(nil)
@@ -116,8 +155,8 @@ func (buf *buffer) repOk() {
 	// We don't check that `chunks` is empty when the buffer is empty, since we
 	// don't have any other way of seeing whether the buffer is empty.
 	for _, chunk := range buf.chunks {
-		assert(len(chunk) == buf.pool.chunkSize_bytes)
-		assert(cap(chunk) == buf.pool.chunkSize_bytes)
+		assert(len(chunk) > 0)
+		assert(cap(chunk) == len(chunk))
 	}
 
 	// Invariants on readOffset. See documentation on readOffset.
@@ -125,7 +164,7 @@ func (buf *buffer) repOk() {
 		assert(buf.readOffset == 0)
 	}
 	if len(buf.chunks) > 0 {
-		assert(buf.readOffset < buf.pool.chunkSize_bytes)
+		assert(buf.readOffset < len(buf.chunks[0]))
 	}
 	if len(buf.chunks) == 1 {
 		assert(buf.readOffset < buf.writeOffset)
@@ -162,12 +201,21 @@ func (buf *buffer) Len() int {
 		return 0
 	}
 
-	bytesAllocated := buf.pool.chunkSize_bytes * numChunks
+	bytesAllocated := buf.allocatedBytes()
 	bytesAlreadyRead := buf.readOffset
-	bytesNotYetWritten := buf.pool.chunkSize_bytes - buf.writeOffset
+	bytesNotYetWritten := len(buf.chunks[numChunks-1]) - buf.writeOffset
 	return bytesAllocated - bytesAlreadyRead - bytesNotYetWritten
 }
 
+// Returns the total size of the buffer's chunks.
+func (buf *buffer) allocatedBytes() int {
+	result := 0
+	for _, chunk := range buf.chunks {
+		result += len(chunk)
+	}
+	return result
+}
+
 func (buf *buffer) Reset() { buf.Release() }
 
 func (buf *buffer) Release() {
@@ -178,23 +226,76 @@ func (buf *buffer) Release() {
 	// Check representation invariants for the buffer's chunks.
 	buf.repOk()
 
-	buf.pool.release(buf.chunks)
+	buf.releaseChunks(buf.chunks)
 	buf.chunks = nil
+	buf.pool.tracker().untrack(buf)
 	buf.readOffset = 0
 
 	// Check representation invariants for the resulting buffer.
 	buf.repOk()
 }
 
+// Obtains a chunk of the given size from the pool, subject to the buffer's
+// quota, waiting for one to be released if the buffer's options allow. Returns
+// ErrQuotaExceeded or ErrEmptyPool if no chunk was obtained.
+func (buf *buffer) getChunk(ctx context.Context, size int) ([]byte, error) {
+	if !buf.opts.Quota.reserve(int64(size)) {
+		return nil, ErrQuotaExceeded
+	}
+
+	var chunk []byte
+	if ctx != nil {
+		chunk = buf.pool.waitForChunk(ctx, size)
+	} else {
+		chunk = buf.pool.getChunk(size)
+	}
+	if chunk == nil {
+		buf.opts.Quota.release(int64(size))
+		buf.pool.stats().recordEmptyPoolFailure()
+		return nil, ErrEmptyPool
+	}
+	if len(chunk) < size {
+		buf.opts.Quota.release(int64(size - len(chunk)))
+	}
+	return chunk, nil
+}
+
+// Returns the given chunks to the pool and releases them from the buffer's
+// quota.
+func (buf *buffer) releaseChunks(chunks [][]byte) {
+	size := buf.pool.release(chunks)
+	buf.opts.Quota.release(int64(size))
+}
+
+// Returns the context bounding how long to wait for storage from the pool, or
+// nil if the buffer does not wait. The caller must call the returned cancel
+// function once it has finished obtaining storage.
+func (buf *buffer) waitContext() (context.Context, context.CancelFunc) {
+	if !buf.opts.waits() {
+		return nil, func() {}
+	}
+
+	ctx := buf.opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if buf.opts.MaxWait > 0 {
+		return context.WithTimeout(ctx, buf.opts.MaxWait)
+	}
+	return ctx, func() {}
+}
+
 // Grows the buffer to provide space for up to n more bytes. Returns the chunk
 // index and offset where bytes should be written, and the amount of space
 // available in the buffer for writing. If n is non-positive or the resulting
 // amount of space available is 0, then no change is made to the buffer, and the
-// chunk index and offset returned are meaningless.
+// chunk index and offset returned are meaningless. If less than n bytes of
+// space are available, also returns the reason more space could not be
+// obtained.
 //
 // This method leaves the buffer in an inconsistent state. The caller is
 // responsible for re-establishing the buffer's invariants.
-func (buf *buffer) grow(n int) (chunkIdx, offset, availableBytes int) {
+func (buf *buffer) grow(n int) (chunkIdx, offset, availableBytes int, err error) {
 	// Determine result values for the buffer's current state.
 	{
 		chunkIdx = 0
@@ -204,34 +305,42 @@ func (buf *buffer) grow(n int) (chunkIdx, offset, availableBytes int) {
 		if len(buf.chunks) > 0 {
 			chunkIdx = len(buf.chunks) - 1
 			offset = buf.writeOffset
-			availableBytes = buf.pool.chunkSize_bytes - buf.writeOffset
+			availableBytes = len(buf.chunks[chunkIdx]) - buf.writeOffset
 		}
 	}
 
 	spaceNeeded := n - availableBytes
 	if spaceNeeded <= 0 {
 		// No need to allocate more space.
-		return chunkIdx, offset, availableBytes
+		return chunkIdx, offset, availableBytes, nil
 	}
 
 	// Get more space from the pool.
-	chunksNeeded := (spaceNeeded + buf.pool.chunkSize_bytes - 1) / buf.pool.chunkSize_bytes
-	chunksObtained := 0
-	for ; chunksObtained < chunksNeeded; chunksObtained++ {
-		chunk := buf.pool.getChunk()
-		if chunk == nil {
-			// Pool is empty.
+	ctx, cancel := buf.waitContext()
+	defer cancel()
+
+	lastChunkFull := len(buf.chunks) > 0 && offset == len(buf.chunks[chunkIdx])
+	allocated := buf.allocatedBytes()
+	for spaceNeeded > 0 {
+		var chunk []byte
+		chunk, err = buf.getChunk(ctx, buf.pool.nextChunkSize(allocated, spaceNeeded))
+		if err != nil {
 			break
 		}
 		buf.chunks = append(buf.chunks, chunk)
+		allocated += len(chunk)
+		availableBytes += len(chunk)
+		spaceNeeded -= len(chunk)
+	}
+	if len(buf.chunks) > 0 {
+		buf.pool.tracker().track(buf)
 	}
 
-	if offset == buf.pool.chunkSize_bytes {
+	if lastChunkFull {
 		chunkIdx++
 		offset = 0
 	}
-	availableBytes += chunksObtained * buf.pool.chunkSize_bytes
-	return chunkIdx, offset, availableBytes
+	return chunkIdx, offset, availableBytes, err
 }
 
 func (buf *buffer) Write(p []byte) (n int, err error) {
@@ -242,10 +351,7 @@ func (buf *buffer) Write(p []byte) (n int, err error) {
 	}
 
 	// Make as much space as we can for p.
-	chunkIdx, offset, bytesAvail := buf.grow(len(p))
-	if bytesAvail < len(p) {
-		err = ErrEmptyPool
-	}
+	chunkIdx, offset, bytesAvail, err := buf.grow(len(p))
 
 	// Per grow(), chunkIdx and offset are meaningless when bytesAvail is 0.
 	if bytesAvail == 0 {
@@ -280,18 +386,23 @@ func (buf *buffer) ReadFrom(r io.Reader) (totalBytesCopied int64, err error) {
 		// Re-establish invariant: if we have an unused chunk, release it back to
 		// the pool.
 		if buf.writeOffset == 0 {
-			buf.pool.release([][]byte{buf.chunks[numChunks-1]})
+			buf.releaseChunks([][]byte{buf.chunks[numChunks-1]})
 			buf.chunks = buf.chunks[:numChunks-1]
-			buf.writeOffset = buf.pool.chunkSize_bytes
+			if len(buf.chunks) == 0 {
+				buf.writeOffset = 0
+				buf.pool.tracker().untrack(buf)
+			} else {
+				buf.writeOffset = len(buf.chunks[len(buf.chunks)-1])
+			}
 		}
 	}()
 
 	for {
 		// Ensure there is space to write into.
-		if len(buf.chunks) == 0 || buf.writeOffset == buf.pool.chunkSize_bytes {
-			_, _, availBytes := buf.grow(buf.pool.chunkSize_bytes)
+		if len(buf.chunks) == 0 || buf.writeOffset == len(buf.chunks[len(buf.chunks)-1]) {
+			_, _, availBytes, growErr := buf.grow(1)
 			if availBytes == 0 {
-				return totalBytesCopied, ErrEmptyPool
+				return totalBytesCopied, growErr
 			}
 			buf.writeOffset = 0
 		}
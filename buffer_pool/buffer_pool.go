@@ -1,7 +1,9 @@
 package buffer_pool
 
 import (
+	"context"
 	"fmt"
+	"time"
 )
 
 // A factory of variable-sized buffers whose backing storage is drawn from a
@@ -10,6 +12,43 @@ import (
 type BufferPool interface {
 	// Returns a new empty buffer
 	NewBuffer() Buffer
+
+	// Returns a new empty buffer that obtains storage from the pool according to
+	// the given options.
+	NewBufferWithOptions(opts BufferOptions) Buffer
+
+	// Returns a snapshot of the pool's usage.
+	Stats() PoolStats
+
+	// Returns the buffers that have held storage from this pool for at least
+	// minAge without being released, oldest first. Always empty unless
+	// TrackAllocations was set when the buffers were created.
+	Leaks(minAge time.Duration) []LeakedBuffer
+}
+
+// Controls how a buffer obtains storage from its pool. The zero value gives
+// the behaviour of BufferPool.NewBuffer: writes fail immediately with
+// ErrEmptyPool when the pool is empty, and the buffer may grow until the pool
+// is exhausted.
+type BufferOptions struct {
+	// If non-nil, writes that need storage while the pool is empty wait for
+	// other buffers to release their storage, until this context is done.
+	Context context.Context
+
+	// If positive, writes that need storage while the pool is empty wait up to
+	// this long for other buffers to release their storage. If Context is also
+	// set, the wait ends at whichever comes first.
+	MaxWait time.Duration
+
+	// If non-nil, limits the amount of storage held by this buffer, together
+	// with all other buffers sharing the quota. Writes that would exceed the
+	// quota fail with ErrQuotaExceeded, without waiting.
+	Quota *Quota
+}
+
+// Returns true if writes should wait for storage when the pool is empty.
+func (opts BufferOptions) waits() bool {
+	return opts.Context != nil || opts.MaxWait > 0
 }
 
 // Creates a new buffer pool. Up to maxPoolSize_bytes of buffer chunks will be
@@ -30,7 +69,11 @@ func MakeBufferPool(maxPoolSize_bytes int64, chunkSize_bytes int64) (BufferPool,
 
 	return bufferPool{
 		chunks:          chunks,
+		numChunks:       int(numChunks),
 		chunkSize_bytes: int(chunkSize_bytes),
+		counters:        &poolStats{},
+		allocations:     newAllocationTracker(),
+		outstanding:     newChunkSet(),
 	}, nil
 }
 
@@ -38,39 +81,114 @@ type bufferPool struct {
 	// Stores all available chunks.
 	chunks chan []byte
 
+	// The total number of chunks in the pool.
+	numChunks int
+
 	// The size of each chunk, in bytes.
 	chunkSize_bytes int
+
+	counters    *poolStats
+	allocations *allocationTracker
+
+	// The chunks held by buffers.
+	outstanding *chunkSet
 }
 
 var _ BufferPool = (*bufferPool)(nil)
+var _ chunkPool = (*bufferPool)(nil)
 
 func (pool bufferPool) NewBuffer() Buffer {
-	return newBuffer(pool)
+	return newBuffer(pool, BufferOptions{})
+}
+
+func (pool bufferPool) NewBufferWithOptions(opts BufferOptions) Buffer {
+	return newBuffer(pool, opts)
+}
+
+func (pool bufferPool) Stats() PoolStats {
+	inUse := pool.numChunks - len(pool.chunks)
+	result := pool.counters.snapshot()
+	result.TotalChunks = pool.numChunks
+	result.ChunksInUse = inUse
+	result.Capacity_bytes = int64(pool.numChunks) * int64(pool.chunkSize_bytes)
+	result.InUse_bytes = int64(inUse) * int64(pool.chunkSize_bytes)
+	result.ChunkSize_bytes = pool.chunkSize_bytes
+	return result
+}
+
+func (pool bufferPool) Leaks(minAge time.Duration) []LeakedBuffer {
+	return pool.allocations.leaks(minAge)
+}
+
+func (pool bufferPool) stats() *poolStats {
+	return pool.counters
+}
+
+func (pool bufferPool) tracker() *allocationTracker {
+	return pool.allocations
+}
+
+// All chunks in this pool have the same size.
+func (pool bufferPool) nextChunkSize(allocated_bytes, needed_bytes int) int {
+	return pool.chunkSize_bytes
 }
 
-// Obtains a chunk from the pool. Returns nil if the pool is empty.
-func (pool bufferPool) getChunk() []byte {
+// Obtains a chunk from the pool. Returns nil if the pool is empty. The size
+// must be the pool's chunk size.
+func (pool bufferPool) getChunk(size int) []byte {
 	select {
 	case result := <-pool.chunks:
-		for i := range result {
-			result[i] = 0
-		}
-		return result
+		return pool.prepareChunk(result)
 	default:
 		return nil
 	}
 }
 
+// Obtains a chunk from the pool, waiting for one to be released if the pool
+// is empty. Returns nil if the given context is done before a chunk becomes
+// available.
+func (pool bufferPool) waitForChunk(ctx context.Context, size int) []byte {
+	if result := pool.getChunk(size); result != nil {
+		return result
+	}
+
+	select {
+	case result := <-pool.chunks:
+		return pool.prepareChunk(result)
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// Zeroes a chunk that was just obtained from the pool and records its
+// acquisition.
+func (pool bufferPool) prepareChunk(chunk []byte) []byte {
+	for i := range chunk {
+		chunk[i] = 0
+	}
+	pool.outstanding.add(chunk)
+	inUse := pool.numChunks - len(pool.chunks)
+	pool.counters.recordAcquisition(inUse, int64(inUse)*int64(pool.chunkSize_bytes))
+	return chunk
+}
+
 // Releases the given chunks back to the pool.
-func (pool bufferPool) release(chunks [][]byte) {
-	// Avoid blocking, in case we somehow end up releasing more chunks than were
-	// initially allocated for the pool.
+func (pool bufferPool) release(chunks [][]byte) int {
+	released_bytes := 0
 	for _, chunk := range chunks {
+		if !pool.outstanding.remove(chunk) {
+			continue
+		}
+
+		// Avoid blocking, in case we somehow end up releasing more chunks than
+		// were initially allocated for the pool.
 		select {
 		case pool.chunks <- chunk:
-			continue
+			pool.counters.recordRelease(1)
+			released_bytes += len(chunk)
 		default:
-			return
+			return released_bytes
 		}
 	}
+	return released_bytes
 }
@@ -2,8 +2,10 @@ package buffer_pool
 
 import (
 	"bytes"
+	"context"
 	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/akitasoftware/akita-libs/memview"
 	"github.com/google/go-cmp/cmp"
@@ -389,3 +391,233 @@ var readWriteTests = []testCase{
 		},
 	},
 }
+
+func TestWaitForRelease(t *testing.T) {
+	CheckInvariants = true
+
+	pool, err := MakeBufferPool(8, 8)
+	assert.NoError(t, err)
+
+	holder := pool.NewBuffer()
+	n, err := holder.Write(bytes.Repeat([]byte{'a'}, 8))
+	assert.NoError(t, err)
+	assert.Equal(t, 8, n)
+
+	// Without waiting, the write fails immediately.
+	n, err = pool.NewBuffer().Write([]byte("hello"))
+	assert.ErrorIs(t, err, ErrEmptyPool)
+	assert.Equal(t, 0, n)
+
+	// With waiting, the write succeeds once the holder releases its storage.
+	released := make(chan struct{})
+	go func() {
+		defer close(released)
+		time.Sleep(10 * time.Millisecond)
+		holder.Release()
+	}()
+	waiter := pool.NewBufferWithOptions(BufferOptions{Context: context.Background()})
+	n, err = waiter.Write([]byte("hello"))
+	<-released
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, "hello", waiter.Bytes().String())
+	waiter.Release()
+}
+
+func TestWaitTimeout(t *testing.T) {
+	CheckInvariants = true
+
+	pool, err := MakeBufferPool(8, 8)
+	assert.NoError(t, err)
+
+	holder := pool.NewBuffer()
+	defer holder.Release()
+	_, err = holder.Write([]byte("a"))
+	assert.NoError(t, err)
+
+	// Times out after MaxWait.
+	waiter := pool.NewBufferWithOptions(BufferOptions{MaxWait: 10 * time.Millisecond})
+	start := time.Now()
+	n, err := waiter.Write([]byte("hello"))
+	assert.ErrorIs(t, err, ErrEmptyPool)
+	assert.Equal(t, 0, n)
+	assert.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+
+	// Gives up when the context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	waiter = pool.NewBufferWithOptions(BufferOptions{Context: ctx, MaxWait: time.Hour})
+	copied, err := waiter.ReadFrom(bytes.NewReader([]byte("hello")))
+	assert.ErrorIs(t, err, ErrEmptyPool)
+	assert.Equal(t, int64(0), copied)
+}
+
+func TestQuota(t *testing.T) {
+	CheckInvariants = true
+
+	_, err := NewQuota(0)
+	assert.Error(t, err)
+
+	pool, err := MakeBufferPool(64, 8)
+	assert.NoError(t, err)
+
+	quota, err := NewQuota(16)
+	assert.NoError(t, err)
+
+	// Two buffers share a quota of two chunks.
+	buf1 := pool.NewBufferWithOptions(BufferOptions{Quota: quota})
+	buf2 := pool.NewBufferWithOptions(BufferOptions{Quota: quota})
+
+	n, err := buf1.Write(bytes.Repeat([]byte{'a'}, 10))
+	assert.NoError(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, int64(16), quota.Used())
+
+	n, err = buf2.Write([]byte("b"))
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	assert.Equal(t, 0, n)
+
+	// Buffers outside the quota are unaffected.
+	other := pool.NewBuffer()
+	n, err = other.Write(bytes.Repeat([]byte{'c'}, 32))
+	assert.NoError(t, err)
+	assert.Equal(t, 32, n)
+	other.Release()
+
+	// Partial writes stop at the quota.
+	buf1.Release()
+	assert.Equal(t, int64(0), quota.Used())
+	n, err = buf2.Write(bytes.Repeat([]byte{'b'}, 20))
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	assert.Equal(t, 16, n)
+
+	// Storage left unused by ReadFrom is returned to the quota.
+	buf2.Release()
+	copied, err := buf2.ReadFrom(bytes.NewReader(bytes.Repeat([]byte{'b'}, 8)))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8), copied)
+	assert.Equal(t, int64(8), quota.Used())
+	buf2.Release()
+	assert.Equal(t, int64(0), quota.Used())
+}
+
+func TestDoubleRelease(t *testing.T) {
+	defer func() { CheckInvariants = true }()
+
+	fixed, err := MakeBufferPool(64, 8)
+	assert.NoError(t, err)
+	sizeClassed, err := MakeSizeClassedBufferPool(64, []int{8})
+	assert.NoError(t, err)
+
+	for _, pool := range []BufferPool{fixed, sizeClassed} {
+		quota, err := NewQuota(32)
+		assert.NoError(t, err)
+
+		buf1 := pool.NewBufferWithOptions(BufferOptions{Quota: quota}).(*buffer)
+		buf2 := pool.NewBufferWithOptions(BufferOptions{Quota: quota})
+		_, err = buf1.Write([]byte("a"))
+		assert.NoError(t, err)
+		_, err = buf2.Write([]byte("b"))
+		assert.NoError(t, err)
+
+		chunks := buf1.chunks
+		buf1.Release()
+		assert.Equal(t, int64(8), quota.Used())
+
+		// Releasing the chunks again is reported, and neither returns them to the
+		// pool nor credits the quota.
+		CheckInvariants = true
+		assert.Panics(t, func() { buf1.releaseChunks(chunks) })
+		CheckInvariants = false
+		buf1.releaseChunks(chunks)
+		assert.Equal(t, int64(8), quota.Used())
+		assert.Equal(t, int64(1), pool.Stats().ChunksReleased)
+
+		// Chunks from another pool are also ignored.
+		buf1.releaseChunks([][]byte{make([]byte, 8)})
+		assert.Equal(t, int64(1), pool.Stats().ChunksReleased)
+
+		buf2.Release()
+		assert.Equal(t, int64(0), quota.Used())
+		assert.Equal(t, 0, pool.Stats().ChunksInUse)
+	}
+}
+
+func TestStats(t *testing.T) {
+	CheckInvariants = true
+
+	pool, err := MakeBufferPool(32, 8)
+	assert.NoError(t, err)
+
+	start := pool.Stats()
+	assert.Equal(t, 4, start.TotalChunks)
+	assert.Equal(t, 0, start.ChunksInUse)
+
+	buf1 := pool.NewBuffer()
+	_, err = buf1.Write(bytes.Repeat([]byte{'a'}, 20))
+	assert.NoError(t, err)
+
+	buf2 := pool.NewBuffer()
+	_, err = buf2.Write(bytes.Repeat([]byte{'b'}, 20))
+	assert.ErrorIs(t, err, ErrEmptyPool)
+
+	stats := pool.Stats()
+	assert.Equal(t, 4, stats.ChunksInUse)
+	assert.Equal(t, int64(32), stats.InUse_bytes)
+	assert.Equal(t, int64(32), stats.HighWatermark_bytes)
+	assert.Equal(t, 4, stats.HighWatermark_chunks)
+	assert.Equal(t, int64(4), stats.ChunksAcquired)
+	assert.Equal(t, int64(1), stats.EmptyPoolFailures)
+
+	buf1.Release()
+	buf2.Release()
+
+	stats = pool.Stats()
+	assert.Equal(t, 0, stats.ChunksInUse)
+	assert.Equal(t, 4, stats.HighWatermark_chunks)
+	assert.Equal(t, int64(4), stats.ChunksReleased)
+	assert.Greater(t, stats.AcquisitionRate(start), 0.0)
+}
+
+func TestLeaks(t *testing.T) {
+	CheckInvariants = true
+	TrackAllocations = true
+	defer func() { TrackAllocations = false }()
+
+	pool, err := MakeBufferPool(32, 8)
+	assert.NoError(t, err)
+
+	leaked := pool.NewBuffer()
+	released := pool.NewBuffer()
+	unused := pool.NewBuffer()
+	_, err = leaked.Write([]byte("leak"))
+	assert.NoError(t, err)
+	_, err = released.Write([]byte("released"))
+	assert.NoError(t, err)
+	released.Release()
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, pool.Leaks(time.Hour))
+
+	leaks := pool.Leaks(10 * time.Millisecond)
+	if assert.Len(t, leaks, 1) {
+		assert.Contains(t, leaks[0].Stack, "TestLeaks")
+		assert.GreaterOrEqual(t, leaks[0].Age, 10*time.Millisecond)
+	}
+
+	// The watcher reports the same leak.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	WatchForLeaks(ctx, pool, 10*time.Millisecond, func(leaks []LeakedBuffer) {
+		assert.Len(t, leaks, 1)
+		cancel()
+	})
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+
+	leaked.Release()
+	unused.Release()
+	assert.Empty(t, pool.Leaks(0))
+}
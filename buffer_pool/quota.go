@@ -0,0 +1,75 @@
+package buffer_pool
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Limits the total amount of pool storage held by a set of buffers, so that a
+// single consumer cannot drain a shared pool. For example, giving each TCP
+// stream its own quota prevents one large upload from starving every other
+// stream.
+//
+// Safe for concurrent use.
+type Quota struct {
+	mu sync.Mutex
+
+	// The maximum number of bytes of storage that may be held.
+	limit_bytes int64
+
+	// The number of bytes of storage currently held.
+	used_bytes int64
+}
+
+// Creates a quota that allows up to maxSize_bytes of storage to be held at
+// once.
+func NewQuota(maxSize_bytes int64) (*Quota, error) {
+	if maxSize_bytes < 1 {
+		return nil, fmt.Errorf("invalid maxSize_bytes %d", maxSize_bytes)
+	}
+	return &Quota{limit_bytes: maxSize_bytes}, nil
+}
+
+// Returns the number of bytes of storage currently held under this quota.
+func (q *Quota) Used() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.used_bytes
+}
+
+// Returns the maximum number of bytes of storage that may be held under this
+// quota.
+func (q *Quota) Limit() int64 {
+	return q.limit_bytes
+}
+
+// Records that n more bytes of storage are to be held. Returns false, without
+// recording anything, if this would exceed the quota. A nil quota is
+// unlimited.
+func (q *Quota) reserve(n int64) bool {
+	if q == nil {
+		return true
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.used_bytes+n > q.limit_bytes {
+		return false
+	}
+	q.used_bytes += n
+	return true
+}
+
+// Records that n bytes of storage are no longer held.
+func (q *Quota) release(n int64) {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.used_bytes -= n
+	if q.used_bytes < 0 {
+		q.used_bytes = 0
+	}
+}
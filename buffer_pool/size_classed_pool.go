@@ -0,0 +1,276 @@
+package buffer_pool
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Chunk sizes used by MakeSizeClassedBufferPool when none are given.
+var DefaultSizeClasses_bytes = []int{1024, 16 * 1024, 256 * 1024}
+
+// Creates a buffer pool whose chunks come in several sizes, so that small
+// buffers don't waste most of a large chunk and large buffers don't need long
+// chains of small chunks. Each buffer starts with chunks of the smallest size
+// and moves to larger sizes as it grows.
+//
+// Chunks of all sizes share a budget of maxPoolSize_bytes. Chunks are
+// allocated on demand and kept for reuse once released. When the budget is
+// used up and a chunk of one size is needed, released chunks of other sizes
+// are discarded to make room. If there is no room for a chunk of the size
+// needed, a smaller chunk is used instead.
+//
+// sizeClasses_bytes must be in increasing order. If empty,
+// DefaultSizeClasses_bytes is used.
+func MakeSizeClassedBufferPool(maxPoolSize_bytes int64, sizeClasses_bytes []int) (BufferPool, error) {
+	if len(sizeClasses_bytes) == 0 {
+		sizeClasses_bytes = DefaultSizeClasses_bytes
+	}
+	for i, size := range sizeClasses_bytes {
+		if size < 1 {
+			return nil, fmt.Errorf("invalid size class %d", size)
+		}
+		if i > 0 && size <= sizeClasses_bytes[i-1] {
+			return nil, fmt.Errorf("size classes not in increasing order: %v", sizeClasses_bytes)
+		}
+	}
+	if maxPoolSize_bytes < int64(sizeClasses_bytes[len(sizeClasses_bytes)-1]) {
+		return nil, fmt.Errorf("invalid maxPoolSize_bytes %d", maxPoolSize_bytes)
+	}
+
+	classes := make([]int, len(sizeClasses_bytes))
+	copy(classes, sizeClasses_bytes)
+
+	return &sizeClassedPool{
+		maxPoolSize_bytes: maxPoolSize_bytes,
+		classes:           classes,
+		free:              make([][][]byte, len(classes)),
+		released:          make(chan struct{}),
+		counters:          &poolStats{},
+		allocations:       newAllocationTracker(),
+		outstanding:       newChunkSet(),
+	}, nil
+}
+
+type sizeClassedPool struct {
+	mu sync.Mutex
+
+	// The total size of all chunks, whether in use or free, is kept within this
+	// budget.
+	maxPoolSize_bytes int64
+
+	// The chunk sizes, in increasing order.
+	classes []int
+
+	// Released chunks available for reuse, indexed by size class.
+	free [][][]byte
+
+	// The total size of the chunks in free.
+	free_bytes int64
+
+	// The number and total size of chunks held by buffers.
+	inUse_chunks int
+	inUse_bytes  int64
+
+	// Closed and replaced whenever chunks are released, to wake goroutines
+	// waiting for storage.
+	released chan struct{}
+
+	counters    *poolStats
+	allocations *allocationTracker
+
+	// The chunks held by buffers.
+	outstanding *chunkSet
+}
+
+var _ BufferPool = (*sizeClassedPool)(nil)
+var _ chunkPool = (*sizeClassedPool)(nil)
+
+func (pool *sizeClassedPool) NewBuffer() Buffer {
+	return newBuffer(pool, BufferOptions{})
+}
+
+func (pool *sizeClassedPool) NewBufferWithOptions(opts BufferOptions) Buffer {
+	return newBuffer(pool, opts)
+}
+
+func (pool *sizeClassedPool) Stats() PoolStats {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	result := pool.counters.snapshot()
+	result.ChunksInUse = pool.inUse_chunks
+	result.Capacity_bytes = pool.maxPoolSize_bytes
+	result.InUse_bytes = pool.inUse_bytes
+	return result
+}
+
+func (pool *sizeClassedPool) Leaks(minAge time.Duration) []LeakedBuffer {
+	return pool.allocations.leaks(minAge)
+}
+
+func (pool *sizeClassedPool) stats() *poolStats {
+	return pool.counters
+}
+
+func (pool *sizeClassedPool) tracker() *allocationTracker {
+	return pool.allocations
+}
+
+// Uses the largest size class that is no larger than the greater of the space
+// needed and the buffer's current size. A buffer growing by small writes thus
+// at most doubles its storage with each chunk, while a large write can get a
+// chunk as large as itself, but no larger. Small buffers get the smallest size
+// class.
+func (pool *sizeClassedPool) nextChunkSize(allocated_bytes, needed_bytes int) int {
+	target := allocated_bytes
+	if needed_bytes > target {
+		target = needed_bytes
+	}
+
+	result := pool.classes[0]
+	for _, size := range pool.classes[1:] {
+		if size > target {
+			break
+		}
+		result = size
+	}
+	return result
+}
+
+// Obtains a chunk of the given size, or of a smaller size class if there is no
+// room for one of the given size. Returns nil if the pool is empty.
+func (pool *sizeClassedPool) getChunk(size int) []byte {
+	pool.mu.Lock()
+	result, reused := pool.getChunkLocked(size)
+	pool.mu.Unlock()
+
+	if reused {
+		for i := range result {
+			result[i] = 0
+		}
+	}
+	return result
+}
+
+// Like getChunk, but waits for chunks to be released if the pool is empty.
+// Returns nil if the given context is done before a chunk becomes available.
+func (pool *sizeClassedPool) waitForChunk(ctx context.Context, size int) []byte {
+	for {
+		pool.mu.Lock()
+		result, reused := pool.getChunkLocked(size)
+		released := pool.released
+		pool.mu.Unlock()
+
+		if result != nil {
+			if reused {
+				for i := range result {
+					result[i] = 0
+				}
+			}
+			return result
+		}
+
+		select {
+		case <-released:
+			continue
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Obtains a chunk, trying the size class for the given size first, followed
+// by successively smaller size classes. Returns the chunk and whether it was
+// reused, in which case it needs to be zeroed. Returns nil if no chunk could
+// be obtained. Must be called with the lock held.
+func (pool *sizeClassedPool) getChunkLocked(size int) (chunk []byte, reused bool) {
+	for classIdx := pool.classIndex(size); classIdx >= 0; classIdx-- {
+		chunk, reused = pool.getChunkOfClassLocked(classIdx)
+		if chunk != nil {
+			pool.outstanding.add(chunk)
+			pool.inUse_chunks++
+			pool.inUse_bytes += int64(len(chunk))
+			pool.counters.recordAcquisition(pool.inUse_chunks, pool.inUse_bytes)
+			return chunk, reused
+		}
+	}
+	return nil, false
+}
+
+// Obtains a chunk of the given size class, reusing a released chunk if one is
+// available, and otherwise allocating a new one if it fits within the budget.
+// Must be called with the lock held.
+func (pool *sizeClassedPool) getChunkOfClassLocked(classIdx int) (chunk []byte, reused bool) {
+	size := pool.classes[classIdx]
+
+	if free := pool.free[classIdx]; len(free) > 0 {
+		chunk = free[len(free)-1]
+		pool.free[classIdx] = free[:len(free)-1]
+		pool.free_bytes -= int64(size)
+		return chunk, true
+	}
+
+	if pool.inUse_bytes+int64(size) > pool.maxPoolSize_bytes {
+		return nil, false
+	}
+
+	// Discard released chunks of other sizes, largest first, until there is
+	// room for the new chunk.
+	for otherIdx := len(pool.classes) - 1; otherIdx >= 0; otherIdx-- {
+		for pool.inUse_bytes+pool.free_bytes+int64(size) > pool.maxPoolSize_bytes && len(pool.free[otherIdx]) > 0 {
+			free := pool.free[otherIdx]
+			free[len(free)-1] = nil
+			pool.free[otherIdx] = free[:len(free)-1]
+			pool.free_bytes -= int64(pool.classes[otherIdx])
+		}
+	}
+
+	return make([]byte, size), false
+}
+
+// Returns the index of the largest size class no larger than the given size,
+// or -1 if the size is smaller than all size classes.
+func (pool *sizeClassedPool) classIndex(size int) int {
+	result := -1
+	for i, classSize := range pool.classes {
+		if classSize > size {
+			break
+		}
+		result = i
+	}
+	return result
+}
+
+func (pool *sizeClassedPool) release(chunks [][]byte) int {
+	if len(chunks) == 0 {
+		return 0
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	released_bytes := 0
+	for _, chunk := range chunks {
+		if !pool.outstanding.remove(chunk) {
+			continue
+		}
+		classIdx := pool.classIndex(len(chunk))
+		if classIdx < 0 || pool.classes[classIdx] != len(chunk) {
+			// Not one of ours.
+			continue
+		}
+		released_bytes += len(chunk)
+
+		pool.free[classIdx] = append(pool.free[classIdx], chunk)
+		pool.free_bytes += int64(len(chunk))
+		pool.inUse_chunks--
+		pool.inUse_bytes -= int64(len(chunk))
+		pool.counters.recordRelease(1)
+	}
+
+	close(pool.released)
+	pool.released = make(chan struct{})
+	return released_bytes
+}
@@ -0,0 +1,253 @@
+package buffer_pool
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMakeSizeClassedBufferPool(t *testing.T) {
+	tests := []struct {
+		name              string
+		maxPoolSize_bytes int64
+		sizeClasses_bytes []int
+		expectError       bool
+	}{
+		{
+			name:              "Default size classes",
+			maxPoolSize_bytes: 1024 * 1024,
+		},
+		{
+			name:              "Custom size classes",
+			maxPoolSize_bytes: 1024,
+			sizeClasses_bytes: []int{16, 256},
+		},
+		{
+			name:              "Zero size class",
+			maxPoolSize_bytes: 1024,
+			sizeClasses_bytes: []int{0, 256},
+			expectError:       true,
+		},
+		{
+			name:              "Size classes out of order",
+			maxPoolSize_bytes: 1024,
+			sizeClasses_bytes: []int{256, 16},
+			expectError:       true,
+		},
+		{
+			name:              "Max pool size smaller than largest size class",
+			maxPoolSize_bytes: 128,
+			sizeClasses_bytes: []int{16, 256},
+			expectError:       true,
+		},
+	}
+
+	for _, testCase := range tests {
+		_, err := MakeSizeClassedBufferPool(testCase.maxPoolSize_bytes, testCase.sizeClasses_bytes)
+		if testCase.expectError {
+			assert.Error(t, err, testCase.name)
+		} else {
+			assert.NoError(t, err, testCase.name)
+		}
+	}
+}
+
+func TestSizeClassesGrowWithBuffer(t *testing.T) {
+	CheckInvariants = true
+
+	pool, err := MakeSizeClassedBufferPool(1024*1024, []int{1024, 16 * 1024, 256 * 1024})
+	assert.NoError(t, err)
+
+	// Small bodies use a single small chunk.
+	small := pool.NewBuffer()
+	_, err = small.Write(bytes.Repeat([]byte{'a'}, 100))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1024), pool.Stats().InUse_bytes)
+	assert.Equal(t, int64(100), small.Bytes().Len())
+	small.Release()
+
+	// Larger bodies move to larger chunks.
+	large := pool.NewBuffer()
+	for i := 0; i < 100; i++ {
+		_, err = large.Write(bytes.Repeat([]byte{'b'}, 4096))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 100*4096, large.Len())
+
+	// A pool of 1 KiB chunks would need 400 chunks.
+	stats := pool.Stats()
+	assert.Less(t, stats.ChunksInUse, 40)
+	assert.Less(t, stats.InUse_bytes, int64(2*100*4096))
+	large.Release()
+
+	stats = pool.Stats()
+	assert.Equal(t, 0, stats.ChunksInUse)
+	assert.Equal(t, int64(0), stats.InUse_bytes)
+}
+
+func TestSizeClassedNextChunkSize(t *testing.T) {
+	p, err := MakeSizeClassedBufferPool(1024*1024, []int{1024, 16 * 1024, 256 * 1024})
+	assert.NoError(t, err)
+	pool := p.(*sizeClassedPool)
+
+	// A buffer growing one byte at a time gets chunks no larger than its
+	// current size, so its storage at most doubles with each chunk.
+	var sizes []int
+	allocated := 0
+	for allocated < 1024*1024 {
+		size := pool.nextChunkSize(allocated, 1)
+		sizes = append(sizes, size)
+		allocated += size
+	}
+	expected := []int{1024}
+	for i := 0; i < 15; i++ {
+		expected = append(expected, 1024)
+	}
+	expected = append(expected, 16*1024)
+	for i := 0; i < 14; i++ {
+		expected = append(expected, 16*1024)
+	}
+	expected = append(expected, 256*1024, 256*1024, 256*1024)
+	assert.Equal(t, expected, sizes)
+
+	// A large write gets a chunk as large as the write, but no larger.
+	assert.Equal(t, 16*1024, pool.nextChunkSize(0, 20*1024))
+	assert.Equal(t, 256*1024, pool.nextChunkSize(1024, 300*1024))
+	assert.Equal(t, 1024, pool.nextChunkSize(0, 16*1024-1))
+}
+
+func TestSizeClassedReadWrite(t *testing.T) {
+	CheckInvariants = true
+	rand.Seed(0)
+
+	pool, err := MakeSizeClassedBufferPool(64*1024, []int{16, 256, 4096})
+	assert.NoError(t, err)
+
+	buffers := make([]Buffer, 4)
+	expected := make([]*bytes.Buffer, len(buffers))
+	for i := range buffers {
+		buffers[i] = pool.NewBuffer()
+		expected[i] = &bytes.Buffer{}
+	}
+
+	for i := 0; i < 200; i++ {
+		idx := rand.Intn(len(buffers))
+		payload := make([]byte, rand.Intn(1000))
+		rand.Read(payload)
+
+		var n int64
+		if i%2 == 0 {
+			written, err := buffers[idx].Write(payload)
+			assert.NoError(t, err)
+			n = int64(written)
+		} else {
+			n, err = buffers[idx].ReadFrom(bytes.NewReader(payload))
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, int64(len(payload)), n)
+		expected[idx].Write(payload)
+
+		if rand.Intn(10) == 0 {
+			buffers[idx].Release()
+			expected[idx].Reset()
+		}
+
+		for j := range buffers {
+			assert.Equal(t, expected[j].Len(), buffers[j].Len())
+			assert.Equal(t, expected[j].String(), buffers[j].Bytes().String())
+		}
+	}
+
+	for _, buf := range buffers {
+		buf.Release()
+	}
+	assert.Equal(t, int64(0), pool.Stats().InUse_bytes)
+}
+
+func TestSizeClassesShareBudget(t *testing.T) {
+	CheckInvariants = true
+
+	pool, err := MakeSizeClassedBufferPool(32, []int{4, 16})
+	assert.NoError(t, err)
+
+	// Fill the budget with small chunks, then release them.
+	var small []Buffer
+	for i := 0; i < 8; i++ {
+		buf := pool.NewBuffer()
+		_, err := buf.Write([]byte("abcd"))
+		assert.NoError(t, err)
+		small = append(small, buf)
+	}
+	_, err = pool.NewBuffer().Write([]byte("x"))
+	assert.ErrorIs(t, err, ErrEmptyPool)
+	for _, buf := range small {
+		buf.Release()
+	}
+
+	// The released small chunks make room for large ones.
+	large := pool.NewBuffer()
+	_, err = large.Write(bytes.Repeat([]byte{'a'}, 20))
+	assert.NoError(t, err)
+	_, err = large.Write(bytes.Repeat([]byte{'a'}, 12))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(32), pool.Stats().InUse_bytes)
+	large.Release()
+}
+
+func TestSizeClassesFallBackToSmallerChunks(t *testing.T) {
+	CheckInvariants = true
+
+	pool, err := MakeSizeClassedBufferPool(24, []int{4, 16})
+	assert.NoError(t, err)
+
+	quota, err := NewQuota(100)
+	assert.NoError(t, err)
+
+	// Uses 4 + 16 bytes.
+	holder := pool.NewBuffer()
+	_, err = holder.Write(bytes.Repeat([]byte{'a'}, 20))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20), pool.Stats().InUse_bytes)
+
+	// Would like a 16-byte chunk, but only 4 bytes remain.
+	buf := pool.NewBufferWithOptions(BufferOptions{Quota: quota})
+	_, err = buf.Write(bytes.Repeat([]byte{'b'}, 4))
+	assert.NoError(t, err)
+	n, err := buf.Write(bytes.Repeat([]byte{'b'}, 16))
+	assert.ErrorIs(t, err, ErrEmptyPool)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, int64(4), quota.Used())
+
+	holder.Release()
+	buf.Release()
+	assert.Equal(t, int64(0), quota.Used())
+}
+
+func TestSizeClassedWaitForRelease(t *testing.T) {
+	CheckInvariants = true
+
+	pool, err := MakeSizeClassedBufferPool(16, []int{4, 16})
+	assert.NoError(t, err)
+
+	holder := pool.NewBuffer()
+	_, err = holder.Write(bytes.Repeat([]byte{'a'}, 16))
+	assert.NoError(t, err)
+
+	released := make(chan struct{})
+	go func() {
+		defer close(released)
+		time.Sleep(10 * time.Millisecond)
+		holder.Release()
+	}()
+
+	waiter := pool.NewBufferWithOptions(BufferOptions{Context: context.Background()})
+	n, err := waiter.Write([]byte("hello"))
+	<-released
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+	waiter.Release()
+}
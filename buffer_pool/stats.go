@@ -0,0 +1,261 @@
+package buffer_pool
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Controls whether buffer pools record where each buffer was created, so that
+// buffers that are never released can be found with BufferPool.Leaks. This
+// captures a stack trace for every buffer, so it is intended for debugging
+// only. Must be set before buffers are created.
+var TrackAllocations = false
+
+// A snapshot of a buffer pool's usage.
+type PoolStats struct {
+	// When the snapshot was taken.
+	Timestamp time.Time
+
+	// The total number of chunks in the pool. Zero for pools whose chunks are
+	// allocated on demand; see Capacity_bytes.
+	TotalChunks int
+
+	// The number of chunks currently held by buffers.
+	ChunksInUse int
+
+	// The largest number of chunks held by buffers at once.
+	HighWatermark_chunks int
+
+	// The total amount of storage in the pool.
+	Capacity_bytes int64
+
+	// The amount of storage currently held by buffers.
+	InUse_bytes int64
+
+	// The largest amount of storage held by buffers at once.
+	HighWatermark_bytes int64
+
+	// The cumulative number of chunks obtained from the pool.
+	ChunksAcquired int64
+
+	// The cumulative number of chunks returned to the pool.
+	ChunksReleased int64
+
+	// The cumulative number of times a buffer needed storage but could not
+	// obtain any because the pool was empty.
+	EmptyPoolFailures int64
+
+	// The size of each chunk, in bytes. Zero for pools with more than one chunk
+	// size.
+	ChunkSize_bytes int
+}
+
+// Returns the rate, in chunks per second, at which chunks were obtained from
+// the pool between an earlier snapshot and this one.
+func (s PoolStats) AcquisitionRate(earlier PoolStats) float64 {
+	elapsed := s.Timestamp.Sub(earlier.Timestamp).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(s.ChunksAcquired-earlier.ChunksAcquired) / elapsed
+}
+
+// Describes a buffer that has held storage from a pool for a long time.
+type LeakedBuffer struct {
+	// How long the buffer has held storage.
+	Age time.Duration
+
+	// The stack trace of the goroutine that created the buffer.
+	Stack string
+}
+
+// Counters for a buffer pool. Shared between copies of the pool.
+type poolStats struct {
+	chunksAcquired       int64
+	chunksReleased       int64
+	emptyPoolFailures    int64
+	highWatermark_chunks int64
+	highWatermark_bytes  int64
+}
+
+// Records that a chunk was obtained, given the number of chunks and bytes now
+// in use.
+func (s *poolStats) recordAcquisition(inUse_chunks int, inUse_bytes int64) {
+	atomic.AddInt64(&s.chunksAcquired, 1)
+	raiseToAtLeast(&s.highWatermark_chunks, int64(inUse_chunks))
+	raiseToAtLeast(&s.highWatermark_bytes, inUse_bytes)
+}
+
+// Atomically sets *addr to the larger of its current value and v.
+func raiseToAtLeast(addr *int64, v int64) {
+	for {
+		old := atomic.LoadInt64(addr)
+		if v <= old || atomic.CompareAndSwapInt64(addr, old, v) {
+			return
+		}
+	}
+}
+
+func (s *poolStats) recordRelease(n int) {
+	atomic.AddInt64(&s.chunksReleased, int64(n))
+}
+
+func (s *poolStats) recordEmptyPoolFailure() {
+	atomic.AddInt64(&s.emptyPoolFailures, 1)
+}
+
+// Returns the counters as a PoolStats. The caller fills in the fields that
+// depend on the kind of pool.
+func (s *poolStats) snapshot() PoolStats {
+	return PoolStats{
+		Timestamp:            time.Now(),
+		HighWatermark_chunks: int(atomic.LoadInt64(&s.highWatermark_chunks)),
+		HighWatermark_bytes:  atomic.LoadInt64(&s.highWatermark_bytes),
+		ChunksAcquired:       atomic.LoadInt64(&s.chunksAcquired),
+		ChunksReleased:       atomic.LoadInt64(&s.chunksReleased),
+		EmptyPoolFailures:    atomic.LoadInt64(&s.emptyPoolFailures),
+	}
+}
+
+// Tracks buffers that currently hold storage, when TrackAllocations is set.
+type allocationTracker struct {
+	mu sync.Mutex
+
+	// Maps each buffer holding storage to the time it first obtained storage.
+	since map[*buffer]time.Time
+}
+
+func newAllocationTracker() *allocationTracker {
+	return &allocationTracker{
+		since: make(map[*buffer]time.Time),
+	}
+}
+
+// Records that the given buffer holds storage, if it is not already recorded.
+func (t *allocationTracker) track(buf *buffer) {
+	if buf.stack == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.since[buf]; !ok {
+		t.since[buf] = time.Now()
+	}
+}
+
+// Records that the given buffer no longer holds storage.
+func (t *allocationTracker) untrack(buf *buffer) {
+	if buf.stack == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.since, buf)
+}
+
+// Returns the buffers that have held storage for at least minAge, oldest
+// first.
+func (t *allocationTracker) leaks(minAge time.Duration) []LeakedBuffer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var result []LeakedBuffer
+	for buf, since := range t.since {
+		if age := now.Sub(since); age >= minAge {
+			result = append(result, LeakedBuffer{
+				Age:   age,
+				Stack: buf.stack,
+			})
+		}
+	}
+	sortLeaks(result)
+	return result
+}
+
+func sortLeaks(leaks []LeakedBuffer) {
+	// Insertion sort; the number of leaks reported is expected to be small.
+	for i := 1; i < len(leaks); i++ {
+		for j := i; j > 0 && leaks[j].Age > leaks[j-1].Age; j-- {
+			leaks[j], leaks[j-1] = leaks[j-1], leaks[j]
+		}
+	}
+}
+
+// The chunks of a pool that are held by buffers, keyed by the address of their
+// first byte, so that a chunk released twice, or released to the wrong pool,
+// is not put back into circulation.
+type chunkSet struct {
+	mu     sync.Mutex
+	chunks map[*byte]struct{}
+}
+
+func newChunkSet() *chunkSet {
+	return &chunkSet{
+		chunks: make(map[*byte]struct{}),
+	}
+}
+
+// Records that the given chunk is held by a buffer.
+func (s *chunkSet) add(chunk []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chunks[&chunk[0]] = struct{}{}
+}
+
+// Records that the given chunk is no longer held by a buffer. Returns false,
+// and reports the bad release, if the chunk was not held by a buffer.
+func (s *chunkSet) remove(chunk []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(chunk) > 0 {
+		if _, ok := s.chunks[&chunk[0]]; ok {
+			delete(s.chunks, &chunk[0])
+			return true
+		}
+	}
+
+	if CheckInvariants {
+		panic("buffer_pool: chunk released twice or not obtained from this pool")
+	}
+	glog.Errorf("buffer_pool: ignoring release of %d-byte chunk that was released twice or not obtained from this pool", len(chunk))
+	return false
+}
+
+// Returns the stack trace of the calling goroutine.
+func captureStack() string {
+	buf := make([]byte, 4096)
+	n := runtime.Stack(buf, false)
+	return string(buf[:n])
+}
+
+// Periodically checks the given pool for buffers that have held storage for at
+// least maxAge, and passes them to report. Requires TrackAllocations to be set
+// when the buffers are created. Returns when the context is done.
+func WatchForLeaks(ctx context.Context, pool BufferPool, maxAge time.Duration, report func([]LeakedBuffer)) {
+	interval := maxAge / 2
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if leaks := pool.Leaks(maxAge); len(leaks) > 0 {
+				report(leaks)
+			}
+		}
+	}
+}
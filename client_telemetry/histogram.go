@@ -0,0 +1,258 @@
+package client_telemetry
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	// Quantiles reported by a histogram with this accuracy are within 1% of the
+	// true value.
+	DefaultRelativeAccuracy = 0.01
+
+	// The maximum number of buckets a histogram keeps. When exceeded, the
+	// lowest buckets are merged, losing accuracy for the smallest values first.
+	// With the default accuracy, 2048 buckets cover more than 17 orders of
+	// magnitude.
+	MaxHistogramBuckets = 2048
+)
+
+// A mergeable histogram of non-negative values with bounded relative error, in
+// the style of DDSketch (https://arxiv.org/abs/1908.10693). Values are counted
+// in logarithmically sized buckets, so that any quantile can be estimated to
+// within RelativeAccuracy of its true value, and histograms from different
+// agents or time periods can be combined exactly.
+//
+// The zero value is an empty histogram with the default accuracy.
+type Histogram struct {
+	RelativeAccuracy float64 `json:"relative_accuracy"`
+
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+
+	// The number of zero values recorded. Negative values are recorded as zero.
+	ZeroCount int64 `json:"zero_count,omitempty"`
+
+	// Counts of positive values. The bucket with index i holds values in
+	// (gamma^(i-1), gamma^i], where gamma = (1+a)/(1-a) for relative accuracy a.
+	Buckets map[int]int64 `json:"buckets,omitempty"`
+}
+
+// Returns an empty histogram with the given relative accuracy, which must be
+// between 0 and 1.
+func NewHistogram(relativeAccuracy float64) *Histogram {
+	return &Histogram{RelativeAccuracy: relativeAccuracy}
+}
+
+func (h *Histogram) accuracy() float64 {
+	if h.RelativeAccuracy <= 0 || h.RelativeAccuracy >= 1 {
+		return DefaultRelativeAccuracy
+	}
+	return h.RelativeAccuracy
+}
+
+func (h *Histogram) logGamma() float64 {
+	a := h.accuracy()
+	return math.Log((1 + a) / (1 - a))
+}
+
+// Returns the index of the bucket holding the given positive value.
+func (h *Histogram) bucketIndex(v float64) int {
+	return int(math.Ceil(math.Log(v) / h.logGamma()))
+}
+
+// Returns the value that represents the bucket with the given index: the one
+// with the least relative error from any value in the bucket.
+func (h *Histogram) bucketValue(i int) float64 {
+	logGamma := h.logGamma()
+	gamma := math.Exp(logGamma)
+	return 2 * math.Exp(logGamma*float64(i)) / (gamma + 1)
+}
+
+// Records a value.
+func (h *Histogram) Record(v float64) {
+	h.RecordN(v, 1)
+}
+
+// Records a value n times.
+func (h *Histogram) RecordN(v float64, n int64) {
+	if n <= 0 || math.IsNaN(v) {
+		return
+	}
+	if v < 0 {
+		v = 0
+	}
+	if h.RelativeAccuracy == 0 {
+		h.RelativeAccuracy = DefaultRelativeAccuracy
+	}
+
+	if h.Count == 0 || v < h.Min {
+		h.Min = v
+	}
+	if h.Count == 0 || v > h.Max {
+		h.Max = v
+	}
+	h.Count += n
+	h.Sum += v * float64(n)
+
+	if v == 0 {
+		h.ZeroCount += n
+		return
+	}
+	if h.Buckets == nil {
+		h.Buckets = make(map[int]int64)
+	}
+	h.Buckets[h.bucketIndex(v)] += n
+	h.collapse()
+}
+
+// Adds the values recorded by another histogram to this one. If the
+// histograms have different accuracies, the buckets of the more accurate one
+// are re-bucketed, and the result has the coarser of the two accuracies.
+func (h *Histogram) Merge(other *Histogram) {
+	if other == nil || other.Count == 0 {
+		return
+	}
+	if h.Count == 0 {
+		accuracy := h.RelativeAccuracy
+		*h = *other.Copy()
+		if accuracy > 0 && accuracy < 1 && accuracy > h.accuracy() {
+			h.rebucket(accuracy)
+		}
+		return
+	}
+
+	if other.Min < h.Min {
+		h.Min = other.Min
+	}
+	if other.Max > h.Max {
+		h.Max = other.Max
+	}
+	h.Count += other.Count
+	h.Sum += other.Sum
+	h.ZeroCount += other.ZeroCount
+
+	if other.accuracy() > h.accuracy() {
+		h.rebucket(other.accuracy())
+	}
+	if len(other.Buckets) == 0 {
+		return
+	}
+	if h.Buckets == nil {
+		h.Buckets = make(map[int]int64, len(other.Buckets))
+	}
+	sameAccuracy := h.accuracy() == other.accuracy()
+	for i, count := range other.Buckets {
+		if sameAccuracy {
+			h.Buckets[i] += count
+		} else {
+			h.Buckets[h.bucketIndex(other.bucketValue(i))] += count
+		}
+	}
+	h.collapse()
+}
+
+// Changes the histogram's accuracy to the given, coarser accuracy, moving
+// each bucket's count to the bucket that holds its value at the new accuracy.
+func (h *Histogram) rebucket(accuracy float64) {
+	old := h.Copy()
+	h.RelativeAccuracy = accuracy
+	if len(old.Buckets) == 0 {
+		return
+	}
+	h.Buckets = make(map[int]int64, len(old.Buckets))
+	for i, count := range old.Buckets {
+		h.Buckets[h.bucketIndex(old.bucketValue(i))] += count
+	}
+}
+
+// Merges the lowest buckets until there are at most MaxHistogramBuckets.
+func (h *Histogram) collapse() {
+	if len(h.Buckets) <= MaxHistogramBuckets {
+		return
+	}
+
+	if len(h.Buckets) == MaxHistogramBuckets+1 {
+		// The common case when recording: find the two lowest buckets without
+		// sorting.
+		lowest, secondLowest := math.MaxInt, math.MaxInt
+		for i := range h.Buckets {
+			if i < lowest {
+				lowest, secondLowest = i, lowest
+			} else if i < secondLowest {
+				secondLowest = i
+			}
+		}
+		h.Buckets[secondLowest] += h.Buckets[lowest]
+		delete(h.Buckets, lowest)
+		return
+	}
+
+	indices := h.sortedIndices()
+	excess := len(indices) - MaxHistogramBuckets
+	target := indices[excess]
+	for _, i := range indices[:excess] {
+		h.Buckets[target] += h.Buckets[i]
+		delete(h.Buckets, i)
+	}
+}
+
+func (h *Histogram) sortedIndices() []int {
+	indices := make([]int, 0, len(h.Buckets))
+	for i := range h.Buckets {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+	return indices
+}
+
+// Returns an estimate of the q-quantile, for q between 0 and 1, or zero if the
+// histogram is empty.
+func (h *Histogram) Quantile(q float64) float64 {
+	if h == nil || h.Count == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return h.Min
+	}
+	if q >= 1 {
+		return h.Max
+	}
+
+	rank := int64(q * float64(h.Count-1))
+	if rank < h.ZeroCount {
+		return 0
+	}
+	seen := h.ZeroCount
+	for _, i := range h.sortedIndices() {
+		seen += h.Buckets[i]
+		if rank < seen {
+			return math.Max(h.Min, math.Min(h.Max, h.bucketValue(i)))
+		}
+	}
+	return h.Max
+}
+
+// Returns the mean of the recorded values, or zero if the histogram is empty.
+func (h *Histogram) Mean() float64 {
+	if h == nil || h.Count == 0 {
+		return 0
+	}
+	return h.Sum / float64(h.Count)
+}
+
+func (h *Histogram) Copy() *Histogram {
+	if h == nil {
+		return nil
+	}
+	copy := *h
+	if h.Buckets != nil {
+		copy.Buckets = make(map[int]int64, len(h.Buckets))
+		for i, count := range h.Buckets {
+			copy.Buckets[i] = count
+		}
+	}
+	return &copy
+}
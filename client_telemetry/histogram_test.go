@@ -0,0 +1,115 @@
+package client_telemetry
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func assertWithinAccuracy(t *testing.T, expected, actual float64) {
+	t.Helper()
+	assert.LessOrEqual(t, math.Abs(actual-expected), expected*DefaultRelativeAccuracy, "expected %v, got %v", expected, actual)
+}
+
+func TestHistogramQuantiles(t *testing.T) {
+	var h Histogram
+	for i := 1; i <= 1000; i++ {
+		h.Record(float64(i))
+	}
+
+	assert.Equal(t, int64(1000), h.Count)
+	assert.Equal(t, 1.0, h.Quantile(0))
+	assert.Equal(t, 1000.0, h.Quantile(1))
+	assertWithinAccuracy(t, 500, h.Quantile(0.5))
+	assertWithinAccuracy(t, 990, h.Quantile(0.99))
+	assert.Equal(t, 500.5, h.Mean())
+}
+
+func TestHistogramMerge(t *testing.T) {
+	a, b, all := NewHistogram(DefaultRelativeAccuracy), NewHistogram(DefaultRelativeAccuracy), NewHistogram(DefaultRelativeAccuracy)
+	for i := 0; i < 500; i++ {
+		a.Record(float64(i))
+		b.Record(float64(i * 10))
+		all.Record(float64(i))
+		all.Record(float64(i * 10))
+	}
+
+	merged := a.Copy()
+	merged.Merge(b)
+	assert.Equal(t, all, merged)
+
+	// Merging a histogram with a different accuracy re-buckets its values.
+	fine := NewHistogram(DefaultRelativeAccuracy)
+	fine.Record(10)
+	coarse := NewHistogram(0.05)
+	coarse.RecordN(1000, 100)
+	fine.Merge(coarse)
+	assert.Equal(t, int64(101), fine.Count)
+	assert.InDelta(t, 1000, fine.Quantile(0.5), 1000*0.06)
+
+	// The result has the coarser accuracy, whichever side it came from, and
+	// its buckets are those of that accuracy.
+	assert.Equal(t, 0.05, fine.RelativeAccuracy)
+	expected := NewHistogram(0.05)
+	expected.Record(10)
+	expected.RecordN(1000, 100)
+	assert.Equal(t, expected.Buckets, fine.Buckets)
+
+	fine = NewHistogram(DefaultRelativeAccuracy)
+	fine.Record(10)
+	coarse.Merge(fine)
+	assert.Equal(t, 0.05, coarse.RelativeAccuracy)
+	assert.Equal(t, expected.Buckets, coarse.Buckets)
+
+	empty := NewHistogram(0.05)
+	empty.Merge(fine)
+	assert.Equal(t, 0.05, empty.RelativeAccuracy)
+	assert.InDelta(t, 10, empty.Quantile(0.5), 10*0.06)
+}
+
+func TestHistogramCollapse(t *testing.T) {
+	var h Histogram
+	// Each value falls in a different bucket.
+	for i := 0; i < 5000; i++ {
+		h.Record(math.Pow(1.03, float64(i)))
+	}
+	assert.Equal(t, MaxHistogramBuckets, len(h.Buckets))
+	assert.Equal(t, int64(5000), h.Count)
+
+	// The highest values keep their accuracy.
+	assertWithinAccuracy(t, math.Pow(1.03, 4994), h.Quantile(0.999))
+}
+
+func TestPacketCountsHistograms(t *testing.T) {
+	var c PacketCounts
+	c.RecordHTTPLatency(20 * time.Millisecond)
+	c.RecordTCPPayloadSize(0)
+
+	var d PacketCounts
+	d.RecordHTTPLatency(40 * time.Millisecond)
+	d.RecordHTTPRequestBodySize(1024)
+
+	c.Add(d)
+	assert.Equal(t, int64(2), c.HTTPLatency_ms.Count)
+	assert.Equal(t, 60.0, c.HTTPLatency_ms.Sum)
+	assert.Equal(t, int64(1), c.HTTPRequestBodySize_bytes.Count)
+	assert.Nil(t, c.HTTPResponseBodySize_bytes)
+	assert.Equal(t, int64(1), c.TCPPayloadSize_bytes.ZeroCount)
+
+	// Adding doesn't alias the source's histograms.
+	c.RecordHTTPRequestBodySize(1)
+	assert.Equal(t, int64(1), d.HTTPRequestBodySize_bytes.Count)
+
+	copy := c.CopyAndReset()
+	assert.Nil(t, c.HTTPLatency_ms)
+	assert.Equal(t, int64(2), copy.HTTPLatency_ms.Count)
+
+	encoded, err := json.Marshal(copy)
+	assert.NoError(t, err)
+	var decoded PacketCounts
+	assert.NoError(t, json.Unmarshal(encoded, &decoded))
+	assert.Equal(t, copy, &decoded)
+}
@@ -0,0 +1,376 @@
+package client_telemetry
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// A text exposition format for metrics.
+type MetricsFormat int
+
+const (
+	// The Prometheus text format, version 0.0.4.
+	PrometheusFormat MetricsFormat = iota
+
+	// The OpenMetrics text format, version 1.0.0.
+	OpenMetricsFormat
+)
+
+const (
+	PrometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+	OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+	DefaultMetricsNamespace = "akita_agent"
+)
+
+func (f MetricsFormat) ContentType() string {
+	if f == OpenMetricsFormat {
+		return OpenMetricsContentType
+	}
+	return PrometheusContentType
+}
+
+// Quantiles reported for each histogram.
+var metricsQuantiles = []float64{0.5, 0.9, 0.99}
+
+// Each PacketCounts event counter, with the protocol and event labels it is
+// exported under.
+var packetEventCounters = []struct {
+	protocol string
+	event    string
+	count    func(*PacketCounts) int
+}{
+	{"tcp", "packet", func(c *PacketCounts) int { return c.TCPPackets }},
+	{"http", "request", func(c *PacketCounts) int { return c.HTTPRequests }},
+	{"http", "response", func(c *PacketCounts) int { return c.HTTPResponses }},
+	{"http", "request_rate_limited", func(c *PacketCounts) int { return c.HTTPRequestsRateLimited }},
+	{"http", "oversized_witness", func(c *PacketCounts) int { return c.OversizedWitnesses }},
+	{"tls", "hello", func(c *PacketCounts) int { return c.TLSHello }},
+	{"http2", "preface", func(c *PacketCounts) int { return c.HTTP2Prefaces }},
+	{"quic", "handshake", func(c *PacketCounts) int { return c.QUICHandshakes }},
+	{"unknown", "unparsed", func(c *PacketCounts) int { return c.Unparsed }},
+}
+
+// Label value used for counts of keys beyond a TopByX map's limit.
+const overflowLabelValue = "other"
+
+// Renders packet counts and resource usage as Prometheus or OpenMetrics text.
+// Either argument may be nil. Metric names are prefixed with the given
+// namespace, or DefaultMetricsNamespace if it is empty.
+//
+// The totals and the TopByX breakdowns are exported as counters in separate
+// metric families, so that summing a family never double-counts. The
+// observation window is exported as gauges. Histograms in the totals are
+// exported as summaries with 0.5, 0.9 and 0.99 quantiles.
+//
+// Cardinality is bounded by the TopByX limits: keys beyond the limits are
+// exported with the label value "other".
+func WriteMetrics(w io.Writer, format MetricsFormat, namespace string, summary *PacketCountSummary, usage *AgentResourceUsage) error {
+	if namespace == "" {
+		namespace = DefaultMetricsNamespace
+	}
+	mw := &metricsWriter{format: format, namespace: sanitizeMetricName(namespace)}
+
+	if summary != nil {
+		mw.writePacketCounts(summary)
+	}
+	if usage != nil {
+		mw.writeResourceUsage(usage)
+	}
+	if format == OpenMetricsFormat {
+		mw.buf.WriteString("# EOF\n")
+	}
+
+	_, err := w.Write(mw.buf.Bytes())
+	return errors.Wrap(err, "unable to write metrics")
+}
+
+func (mw *metricsWriter) writePacketCounts(summary *PacketCountSummary) {
+	mw.writeEventCounters("packet_events", "Packet capture events, by protocol and event.", counterMetric,
+		[]labelledCounts{{counts: &summary.Total}})
+
+	mw.writeEventCounters("window_packet_events", "Packet capture events in the most recent observation window, by protocol and event.", gaugeMetric,
+		[]labelledCounts{{counts: &summary.ObservationWindow}})
+
+	byPort := make([]labelledCounts, 0, len(summary.TopByPort)+1)
+	for _, port := range sortedKeys(summary.TopByPort) {
+		byPort = append(byPort, labelledCounts{labels: []label{{"port", strconv.Itoa(port)}}, counts: summary.TopByPort[port]})
+	}
+	if summary.ByPortOverflow != nil {
+		byPort = append(byPort, labelledCounts{labels: []label{{"port", overflowLabelValue}}, counts: summary.ByPortOverflow})
+	}
+	mw.writeEventCounters("packet_events_by_port", "Packet capture events for the busiest ports, by protocol and event.", counterMetric, byPort)
+
+	byInterface := make([]labelledCounts, 0, len(summary.TopByInterface)+1)
+	for _, iface := range sortedKeys(summary.TopByInterface) {
+		byInterface = append(byInterface, labelledCounts{labels: []label{{"interface", iface}}, counts: summary.TopByInterface[iface]})
+	}
+	if summary.ByInterfaceOverflow != nil {
+		byInterface = append(byInterface, labelledCounts{labels: []label{{"interface", overflowLabelValue}}, counts: summary.ByInterfaceOverflow})
+	}
+	mw.writeEventCounters("packet_events_by_interface", "Packet capture events for the busiest interfaces, by protocol and event.", counterMetric, byInterface)
+
+	byHost := make([]labelledCounts, 0, len(summary.TopByHost)+1)
+	for _, host := range sortedKeys(summary.TopByHost) {
+		byHost = append(byHost, labelledCounts{labels: []label{{"host", host}}, counts: summary.TopByHost[host]})
+	}
+	if summary.ByHostOverflow != nil {
+		byHost = append(byHost, labelledCounts{labels: []label{{"host", overflowLabelValue}}, counts: summary.ByHostOverflow})
+	}
+	mw.writeEventCounters("packet_events_by_host", "Packet capture events for the busiest hosts, by protocol and event.", counterMetric, byHost)
+
+	mw.writeHeader("unparsed_bytes", "Bytes in TCP streams that could not be parsed.", counterMetric)
+	mw.writeSample("unparsed_bytes", counterMetric, "", nil, float64(summary.Total.UnparsedBytes))
+
+	if len(summary.Total.UnparsedByReason) > 0 {
+		mw.writeHeader("unparsed_by_reason", "Parse failures, by reason.", counterMetric)
+		for _, reason := range sortedKeys(summary.Total.UnparsedByReason) {
+			mw.writeSample("unparsed_by_reason", counterMetric, "", []label{{"reason", reason}}, float64(summary.Total.UnparsedByReason[reason]))
+		}
+	}
+
+	// Prometheus convention is to use base units, so latency is exported in
+	// seconds.
+	mw.writeHistogram("http_latency_seconds", "Time from the end of an HTTP request to the start of its response.", summary.Total.HTTPLatency_ms, 0.001)
+	mw.writeHistogram("http_request_body_size_bytes", "Sizes of HTTP request bodies.", summary.Total.HTTPRequestBodySize_bytes, 1)
+	mw.writeHistogram("http_response_body_size_bytes", "Sizes of HTTP response bodies.", summary.Total.HTTPResponseBodySize_bytes, 1)
+	mw.writeHistogram("tcp_payload_size_bytes", "Sizes of TCP segment payloads.", summary.Total.TCPPayloadSize_bytes, 1)
+}
+
+func (mw *metricsWriter) writeResourceUsage(usage *AgentResourceUsage) {
+	windows := []struct {
+		name string
+		data AgentResourceUsageData
+	}{
+		{"peak", usage.Peak},
+		{"recent", usage.Recent},
+	}
+
+	mw.writeHeader("cpu_cores_used", "CPU cores used by the agent.", gaugeMetric)
+	for _, w := range windows {
+		mw.writeSample("cpu_cores_used", gaugeMetric, "", []label{{"window", w.name}}, w.data.CoresUsed)
+	}
+
+	mw.writeHeader("cpu_relative_percent", "CPU used by the agent, as a percentage of total CPU availability.", gaugeMetric)
+	for _, w := range windows {
+		mw.writeSample("cpu_relative_percent", gaugeMetric, "", []label{{"window", w.name}}, w.data.RelativeCPU)
+	}
+
+	mw.writeHeader("resident_memory_peak_bytes", "Peak resident set size of the agent.", gaugeMetric)
+	for _, w := range windows {
+		mw.writeSample("resident_memory_peak_bytes", gaugeMetric, "", []label{{"window", w.name}}, float64(w.data.VmHWM)*1024)
+	}
+
+	if usage.CPULimit_cores > 0 {
+		mw.writeHeader("cpu_limit_cores", "The CPU limit of the agent's cgroup.", gaugeMetric)
+		mw.writeSample("cpu_limit_cores", gaugeMetric, "", nil, usage.CPULimit_cores)
+	}
+	if usage.MemoryLimit_bytes > 0 {
+		mw.writeHeader("memory_limit_bytes", "The memory limit of the agent's cgroup.", gaugeMetric)
+		mw.writeSample("memory_limit_bytes", gaugeMetric, "", nil, float64(usage.MemoryLimit_bytes))
+	}
+}
+
+type metricType string
+
+const (
+	counterMetric metricType = "counter"
+	gaugeMetric   metricType = "gauge"
+	summaryMetric metricType = "summary"
+)
+
+type label struct {
+	name  string
+	value string
+}
+
+type labelledCounts struct {
+	labels []label
+	counts *PacketCounts
+}
+
+type metricsWriter struct {
+	format    MetricsFormat
+	namespace string
+	buf       bytes.Buffer
+}
+
+// Writes a metric family with a sample for each event counter of each of the
+// given counts.
+func (mw *metricsWriter) writeEventCounters(name, help string, typ metricType, counts []labelledCounts) {
+	if len(counts) == 0 {
+		return
+	}
+
+	mw.writeHeader(name, help, typ)
+	for _, c := range counts {
+		for _, counter := range packetEventCounters {
+			labels := append(append([]label(nil), c.labels...), label{"protocol", counter.protocol}, label{"event", counter.event})
+			mw.writeSample(name, typ, "", labels, float64(counter.count(c.counts)))
+		}
+	}
+}
+
+// Writes a histogram as a summary, multiplying its values by the given scale.
+func (mw *metricsWriter) writeHistogram(name, help string, h *Histogram, scale float64) {
+	if h == nil {
+		return
+	}
+
+	mw.writeHeader(name, help, summaryMetric)
+	for _, q := range metricsQuantiles {
+		mw.writeSample(name, summaryMetric, "", []label{{"quantile", strconv.FormatFloat(q, 'g', -1, 64)}}, h.Quantile(q)*scale)
+	}
+	mw.writeSample(name, summaryMetric, "_sum", nil, h.Sum*scale)
+	mw.writeSample(name, summaryMetric, "_count", nil, float64(h.Count))
+}
+
+func (mw *metricsWriter) writeHeader(name, help string, typ metricType) {
+	family := mw.namespace + "_" + name
+	if typ == counterMetric && mw.format == PrometheusFormat {
+		// In the Prometheus format, the family is named after its samples.
+		family += "_total"
+	}
+	fmt.Fprintf(&mw.buf, "# HELP %s %s\n", family, escapeHelp(help))
+	fmt.Fprintf(&mw.buf, "# TYPE %s %s\n", family, typ)
+}
+
+func (mw *metricsWriter) writeSample(name string, typ metricType, suffix string, labels []label, value float64) {
+	mw.buf.WriteString(mw.namespace)
+	mw.buf.WriteByte('_')
+	mw.buf.WriteString(name)
+	if typ == counterMetric {
+		mw.buf.WriteString("_total")
+	}
+	mw.buf.WriteString(suffix)
+
+	if len(labels) > 0 {
+		mw.buf.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				mw.buf.WriteByte(',')
+			}
+			fmt.Fprintf(&mw.buf, `%s="%s"`, l.name, escapeLabelValue(l.value))
+		}
+		mw.buf.WriteByte('}')
+	}
+
+	mw.buf.WriteByte(' ')
+	mw.buf.WriteString(formatMetricValue(value))
+	mw.buf.WriteByte('\n')
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(v string) string {
+	return helpEscaper.Replace(v)
+}
+
+// Replaces characters that are not allowed in metric names with underscores.
+func sanitizeMetricName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9' && i > 0:
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+func sortedKeys[K int | string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// Serves the most recent packet counts and resource usage for scraping by
+// Prometheus or any OpenMetrics-compatible collector. The OpenMetrics format
+// is used if the request's Accept header allows it.
+type MetricsHandler struct {
+	namespace string
+
+	mu      sync.RWMutex
+	summary *PacketCountSummary
+	usage   *AgentResourceUsage
+}
+
+var _ http.Handler = (*MetricsHandler)(nil)
+
+// Returns a handler that serves metrics prefixed with the given namespace, or
+// DefaultMetricsNamespace if it is empty. Serves no samples until Update is
+// called.
+func NewMetricsHandler(namespace string) *MetricsHandler {
+	return &MetricsHandler{namespace: namespace}
+}
+
+// Replaces the data served by the handler. Either argument may be nil, in
+// which case the corresponding metrics are not served. The handler keeps
+// references to the arguments, which must not be modified afterwards.
+func (h *MetricsHandler) Update(summary *PacketCountSummary, usage *AgentResourceUsage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.summary = summary
+	h.usage = usage
+}
+
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	format := PrometheusFormat
+	if strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text") {
+		format = OpenMetricsFormat
+	}
+
+	var buf bytes.Buffer
+	h.mu.RLock()
+	err := WriteMetrics(&buf, format, h.namespace, h.summary, h.usage)
+	h.mu.RUnlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.ContentType())
+	if r.Method == http.MethodGet {
+		w.Write(buf.Bytes())
+	}
+}
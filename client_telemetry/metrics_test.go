@@ -0,0 +1,82 @@
+package client_telemetry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSummary() *PacketCountSummary {
+	summary := NewPacketCountSummary()
+	summary.Total = PacketCounts{TCPPackets: 10, HTTPRequests: 2}
+	summary.Total.AddUnparsed("bad \"header\"", 100)
+	summary.Total.RecordHTTPLatency(250 * time.Millisecond)
+	summary.TopByPort[80] = &PacketCounts{HTTPRequests: 2}
+	summary.TopByHost = map[string]*PacketCounts{"example.com": {TCPPackets: 4}}
+	summary.ByHostOverflow = &PacketCounts{TCPPackets: 6}
+	return summary
+}
+
+func TestWriteMetrics(t *testing.T) {
+	usage := &AgentResourceUsage{
+		Peak: AgentResourceUsageData{CoresUsed: 0.5, VmHWM: 2},
+	}
+
+	var b strings.Builder
+	assert.NoError(t, WriteMetrics(&b, PrometheusFormat, "", testSummary(), usage))
+	text := b.String()
+
+	for _, expected := range []string{
+		"# TYPE akita_agent_packet_events_total counter\n",
+		`akita_agent_packet_events_total{protocol="tcp",event="packet"} 10` + "\n",
+		`akita_agent_packet_events_by_port_total{port="80",protocol="http",event="request"} 2` + "\n",
+		`akita_agent_packet_events_by_host_total{host="example.com",protocol="tcp",event="packet"} 4` + "\n",
+		`akita_agent_packet_events_by_host_total{host="other",protocol="tcp",event="packet"} 6` + "\n",
+		"# TYPE akita_agent_window_packet_events gauge\n",
+		`akita_agent_unparsed_by_reason_total{reason="bad \"header\""} 1` + "\n",
+		"akita_agent_unparsed_bytes_total 100\n",
+		"# TYPE akita_agent_http_latency_seconds summary\n",
+		"akita_agent_http_latency_seconds_count 1\n",
+		`akita_agent_resident_memory_peak_bytes{window="peak"} 2048` + "\n",
+	} {
+		assert.Contains(t, text, expected)
+	}
+	assert.NotContains(t, text, "by_interface")
+	assert.NotContains(t, text, "# EOF")
+}
+
+func TestWriteOpenMetrics(t *testing.T) {
+	var b strings.Builder
+	assert.NoError(t, WriteMetrics(&b, OpenMetricsFormat, "my-agent", testSummary(), nil))
+	text := b.String()
+
+	// Counter families are named without the _total suffix.
+	assert.Contains(t, text, "# TYPE my_agent_packet_events counter\n")
+	assert.Contains(t, text, `my_agent_packet_events_total{protocol="tcp",event="packet"} 10`)
+	assert.True(t, strings.HasSuffix(text, "# EOF\n"))
+}
+
+func TestMetricsHandler(t *testing.T) {
+	handler := NewMetricsHandler("")
+	handler.Update(testSummary(), nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, OpenMetricsContentType, resp.Header().Get("Content-Type"))
+	assert.Contains(t, resp.Body.String(), "# EOF")
+
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, PrometheusContentType, resp.Header().Get("Content-Type"))
+
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+}
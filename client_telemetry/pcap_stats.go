@@ -1,5 +1,7 @@
 package client_telemetry
 
+import "time"
+
 // We produce a set of packet counters indexed by interface, host and
 // port number (*either* source or destination.)
 type PacketCounts struct {
@@ -20,6 +22,75 @@ type PacketCounts struct {
 	HTTP2Prefaces           int `json:"http2_prefaces"`
 	QUICHandshakes          int `json:"quic_handshakes"`
 	Unparsed                int `json:"unparsed"`
+
+	// Breakdown of Unparsed by reason. Keys are akinet.ParseErrorReason values.
+	// Also counts messages that were parsed with a truncated body, such as
+	// BODY_OVER_LIMIT, which are not counted in Unparsed.
+	UnparsedByReason map[string]int `json:"unparsed_by_reason,omitempty"`
+
+	// Number of bytes in the TCP stream that could not be parsed.
+	UnparsedBytes int `json:"unparsed_bytes"`
+
+	// Distributions. Nil if no values were recorded.
+	HTTPLatency_ms             *Histogram `json:"http_latency_ms,omitempty"` // From the end of a request to the start of its response.
+	HTTPRequestBodySize_bytes  *Histogram `json:"http_request_body_size_bytes,omitempty"`
+	HTTPResponseBodySize_bytes *Histogram `json:"http_response_body_size_bytes,omitempty"`
+	TCPPayloadSize_bytes       *Histogram `json:"tcp_payload_size_bytes,omitempty"`
+}
+
+func recordIn(h **Histogram, v float64) {
+	if *h == nil {
+		*h = NewHistogram(DefaultRelativeAccuracy)
+	}
+	(*h).Record(v)
+}
+
+func mergeInto(h **Histogram, d *Histogram) {
+	if d == nil {
+		return
+	}
+	if *h == nil {
+		*h = d.Copy()
+		return
+	}
+	(*h).Merge(d)
+}
+
+// Records the time between an HTTP request and its response.
+func (c *PacketCounts) RecordHTTPLatency(latency time.Duration) {
+	recordIn(&c.HTTPLatency_ms, float64(latency)/float64(time.Millisecond))
+}
+
+func (c *PacketCounts) RecordHTTPRequestBodySize(size_bytes int) {
+	recordIn(&c.HTTPRequestBodySize_bytes, float64(size_bytes))
+}
+
+func (c *PacketCounts) RecordHTTPResponseBodySize(size_bytes int) {
+	recordIn(&c.HTTPResponseBodySize_bytes, float64(size_bytes))
+}
+
+func (c *PacketCounts) RecordTCPPayloadSize(size_bytes int) {
+	recordIn(&c.TCPPayloadSize_bytes, float64(size_bytes))
+}
+
+// Records a parse failure for the given reason, covering the given number of
+// bytes.
+func (c *PacketCounts) AddUnparsed(reason string, bytes int) {
+	c.Unparsed += 1
+	c.UnparsedBytes += bytes
+	if c.UnparsedByReason == nil {
+		c.UnparsedByReason = make(map[string]int)
+	}
+	c.UnparsedByReason[reason] += 1
+}
+
+// Records a message that was parsed, but whose body was truncated for the
+// given reason.
+func (c *PacketCounts) AddTruncated(reason string) {
+	if c.UnparsedByReason == nil {
+		c.UnparsedByReason = make(map[string]int)
+	}
+	c.UnparsedByReason[reason] += 1
 }
 
 func (c *PacketCounts) Add(d PacketCounts) {
@@ -32,6 +103,17 @@ func (c *PacketCounts) Add(d PacketCounts) {
 	c.HTTP2Prefaces += d.HTTP2Prefaces
 	c.QUICHandshakes += d.QUICHandshakes
 	c.Unparsed += d.Unparsed
+	c.UnparsedBytes += d.UnparsedBytes
+	for reason, count := range d.UnparsedByReason {
+		if c.UnparsedByReason == nil {
+			c.UnparsedByReason = make(map[string]int, len(d.UnparsedByReason))
+		}
+		c.UnparsedByReason[reason] += count
+	}
+	mergeInto(&c.HTTPLatency_ms, d.HTTPLatency_ms)
+	mergeInto(&c.HTTPRequestBodySize_bytes, d.HTTPRequestBodySize_bytes)
+	mergeInto(&c.HTTPResponseBodySize_bytes, d.HTTPResponseBodySize_bytes)
+	mergeInto(&c.TCPPayloadSize_bytes, d.TCPPayloadSize_bytes)
 }
 
 func (c *PacketCounts) Copy() *PacketCounts {
@@ -39,6 +121,16 @@ func (c *PacketCounts) Copy() *PacketCounts {
 		return nil
 	}
 	copy := *c
+	if c.UnparsedByReason != nil {
+		copy.UnparsedByReason = make(map[string]int, len(c.UnparsedByReason))
+		for reason, count := range c.UnparsedByReason {
+			copy.UnparsedByReason[reason] = count
+		}
+	}
+	copy.HTTPLatency_ms = c.HTTPLatency_ms.Copy()
+	copy.HTTPRequestBodySize_bytes = c.HTTPRequestBodySize_bytes.Copy()
+	copy.HTTPResponseBodySize_bytes = c.HTTPResponseBodySize_bytes.Copy()
+	copy.TCPPayloadSize_bytes = c.TCPPayloadSize_bytes.Copy()
 	return &copy
 }
 
@@ -54,6 +146,12 @@ func (c *PacketCounts) CopyAndReset() *PacketCounts {
 	c.HTTP2Prefaces = 0
 	c.QUICHandshakes = 0
 	c.Unparsed = 0
+	c.UnparsedByReason = nil
+	c.UnparsedBytes = 0
+	c.HTTPLatency_ms = nil
+	c.HTTPRequestBodySize_bytes = nil
+	c.HTTPResponseBodySize_bytes = nil
+	c.TCPPayloadSize_bytes = nil
 
 	return copy
 }
@@ -61,7 +159,7 @@ func (c *PacketCounts) CopyAndReset() *PacketCounts {
 // Reflects the version of the JSON encoding.  Increase the minor version
 // number for backwards-compatible changes and the major number for non-
 // backwards compatible changes.
-const Version = "v0.4"
+const Version = "v0.7"
 
 type PacketCountSummary struct {
 	Version           string                   `json:"version"`
@@ -81,6 +179,13 @@ type PacketCountSummary struct {
 	ByPortOverflow      *PacketCounts `json:"by_port_overflow,omitempty"`
 	ByInterfaceOverflow *PacketCounts `json:"by_interface_overflow,omitempty"`
 	ByHostOverflow      *PacketCounts `json:"by_host_overflow,omitempty"`
+
+	// Upper bounds on the weight of each TopByX key's traffic that was counted
+	// in the overflow before the key was tracked. See TopK. Keys with no error
+	// are omitted.
+	TopByPortErrors      map[int]int    `json:"top_by_port_errors,omitempty"`
+	TopByInterfaceErrors map[string]int `json:"top_by_interface_errors,omitempty"`
+	TopByHostErrors      map[string]int `json:"top_by_host_errors,omitempty"`
 }
 
 func NewPacketCountSummary() *PacketCountSummary {
@@ -90,3 +195,28 @@ func NewPacketCountSummary() *PacketCountSummary {
 		TopByInterface: make(map[string]*PacketCounts),
 	}
 }
+
+// Fills in TopByPort, its limit, overflow and errors from the given tracker.
+func (s *PacketCountSummary) SetTopByPort(t *TopK[int]) {
+	s.TopByPort = t.Counts()
+	s.ByPortOverflowLimit = t.Limit()
+	s.ByPortOverflow = t.Overflow()
+	s.TopByPortErrors = t.Errors()
+}
+
+// Fills in TopByInterface, its limit, overflow and errors from the given
+// tracker.
+func (s *PacketCountSummary) SetTopByInterface(t *TopK[string]) {
+	s.TopByInterface = t.Counts()
+	s.ByInterfaceOverflowLimit = t.Limit()
+	s.ByInterfaceOverflow = t.Overflow()
+	s.TopByInterfaceErrors = t.Errors()
+}
+
+// Fills in TopByHost, its limit, overflow and errors from the given tracker.
+func (s *PacketCountSummary) SetTopByHost(t *TopK[string]) {
+	s.TopByHost = t.Counts()
+	s.ByHostOverflowLimit = t.Limit()
+	s.ByHostOverflow = t.Overflow()
+	s.TopByHostErrors = t.Errors()
+}
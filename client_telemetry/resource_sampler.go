@@ -0,0 +1,423 @@
+package client_telemetry
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// The clock tick rate used by /proc/<pid>/stat on virtually all Linux
+	// systems.
+	defaultClockTicksPerSecond = 100
+
+	// cgroup v1 reports no memory limit as a very large number, rounded down to
+	// the page size. Anything above this is treated as unlimited.
+	cgroupV1UnlimitedMemory_bytes = uint64(1) << 62
+)
+
+type ResourceSamplerConfig struct {
+	// The proc directory of the process to sample. Default /proc/self.
+	ProcDir string
+
+	// Where the cgroup filesystem is mounted. Default /sys/fs/cgroup.
+	CgroupDir string
+
+	// The unit of CPU times in ProcDir/stat. Default 100.
+	ClockTicksPerSecond int
+
+	// The number of CPUs on the machine, used when the process's cgroup has no
+	// CPU limit. Default runtime.NumCPU().
+	NumCPU int
+
+	// Returns the current time. Default time.Now.
+	Now func() time.Time
+
+	// Whether to reset the process's peak resident set size when the sampler is
+	// created and after each sample, by writing to ProcDir/clear_refs, so that
+	// Recent.VmHWM is the peak of each window. This also resets the VmHWM seen
+	// by anything else reading the process's status. Default false.
+	ResetPeakRSS bool
+}
+
+// Measures the CPU and memory usage of a process on Linux, by reading its proc
+// files and the limits of its cgroup. Supports cgroup v1 and v2.
+//
+// Each call to Sample reports usage since the previous call as the recent
+// window, and the highest usage of any window as the peak. The peak includes
+// the process's peak resident set size from before the sampler was created.
+// Safe for concurrent use.
+type ResourceSampler struct {
+	config ResourceSamplerConfig
+
+	mu sync.Mutex
+
+	// The process's CPU time and the wall-clock time at the last sample.
+	lastCPUTicks uint64
+	lastSampleAt time.Time
+
+	// Whether the process's peak resident set size is reset after each sample.
+	// False unless ResetPeakRSS is set and ProcDir/clear_refs can be written,
+	// which needs kernel 4.0 or later.
+	resetsPeakRSS bool
+
+	peak AgentResourceUsageData
+}
+
+// Returns a sampler whose first recent window starts now. Returns an error if
+// the process's proc files cannot be read, e.g. on a system other than Linux.
+func NewResourceSampler(config ResourceSamplerConfig) (*ResourceSampler, error) {
+	if config.ProcDir == "" {
+		config.ProcDir = "/proc/self"
+	}
+	if config.CgroupDir == "" {
+		config.CgroupDir = "/sys/fs/cgroup"
+	}
+	if config.ClockTicksPerSecond <= 0 {
+		config.ClockTicksPerSecond = defaultClockTicksPerSecond
+	}
+	if config.NumCPU <= 0 {
+		config.NumCPU = runtime.NumCPU()
+	}
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+
+	ticks, err := readCPUTicks(filepath.Join(config.ProcDir, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	memory, err := readMemoryStatus(filepath.Join(config.ProcDir, "status"))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ResourceSampler{
+		config:       config,
+		lastCPUTicks: ticks,
+		lastSampleAt: config.Now(),
+		peak:         AgentResourceUsageData{VmHWM: memory.vmHWM_kB},
+	}
+
+	// The process's peak so far is recorded, so the first window can start
+	// afresh.
+	if config.ResetPeakRSS {
+		s.resetsPeakRSS = resetPeakRSS(config.ProcDir) == nil
+	}
+	return s, nil
+}
+
+// Measures usage since the previous sample, or since the sampler was created.
+//
+// If ResetPeakRSS is set, Recent.VmHWM is the peak resident set size during
+// the window. Otherwise, or if the peak cannot be reset, it is the resident set
+// size at the time of sampling. Peak.VmHWM is the highest peak seen by any sample.
+func (s *ResourceSampler) Sample() (*AgentResourceUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.config.Now()
+	ticks, err := readCPUTicks(filepath.Join(s.config.ProcDir, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	memory, err := readMemoryStatus(filepath.Join(s.config.ProcDir, "status"))
+	if err != nil {
+		return nil, err
+	}
+	limits := s.readLimits()
+
+	availableCores := float64(s.config.NumCPU)
+	if limits.cpuCores > 0 && limits.cpuCores < availableCores {
+		availableCores = limits.cpuCores
+	}
+
+	var recent AgentResourceUsageData
+	elapsed := now.Sub(s.lastSampleAt)
+	if elapsed > 0 && ticks >= s.lastCPUTicks {
+		cpuSeconds := float64(ticks-s.lastCPUTicks) / float64(s.config.ClockTicksPerSecond)
+		recent.CoresUsed = cpuSeconds / elapsed.Seconds()
+		recent.RelativeCPU = 100 * recent.CoresUsed / availableCores
+	}
+	if s.resetsPeakRSS {
+		recent.VmHWM = memory.vmHWM_kB
+		s.resetsPeakRSS = resetPeakRSS(s.config.ProcDir) == nil
+	} else {
+		recent.VmHWM = memory.vmRSS_kB
+	}
+
+	if recent.CoresUsed > s.peak.CoresUsed {
+		s.peak.CoresUsed = recent.CoresUsed
+	}
+	if recent.RelativeCPU > s.peak.RelativeCPU {
+		s.peak.RelativeCPU = recent.RelativeCPU
+	}
+	if memory.vmHWM_kB > s.peak.VmHWM {
+		s.peak.VmHWM = memory.vmHWM_kB
+	}
+
+	result := &AgentResourceUsage{
+		Peak:                      s.peak,
+		Recent:                    recent,
+		ObservedStartingAt:        s.lastSampleAt,
+		ObservedDurationInSeconds: int(elapsed.Round(time.Second) / time.Second),
+		CPULimit_cores:            limits.cpuCores,
+		MemoryLimit_bytes:         limits.memory_bytes,
+	}
+
+	s.lastCPUTicks = ticks
+	s.lastSampleAt = now
+	return result, nil
+}
+
+// Resets the peak resident set size reported as VmHWM in the process's status
+// file to its current resident set size.
+func resetPeakRSS(procDir string) error {
+	path := filepath.Join(procDir, "clear_refs")
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open %s", path)
+	}
+	defer f.Close()
+	if _, err := f.WriteString("5"); err != nil {
+		return errors.Wrapf(err, "unable to write %s", path)
+	}
+	return nil
+}
+
+// Returns the total user and system CPU time of the process, in clock ticks,
+// from a /proc/<pid>/stat file.
+func readCPUTicks(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to read %s", path)
+	}
+
+	// The second field is the command name in parentheses, which may contain
+	// spaces and parentheses. The remaining fields follow the last ')'.
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return 0, errors.Errorf("malformed %s", path)
+	}
+	fields := strings.Fields(string(data[end+1:]))
+
+	// utime and stime are fields 14 and 15 of the whole line, so 12 and 13 after
+	// the command name, counting from 1.
+	if len(fields) < 13 {
+		return 0, errors.Errorf("malformed %s: too few fields", path)
+	}
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "malformed utime in %s", path)
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "malformed stime in %s", path)
+	}
+	return utime + stime, nil
+}
+
+type memoryStatus struct {
+	vmHWM_kB uint64
+	vmRSS_kB uint64
+}
+
+// Reads the peak and current resident set sizes from a /proc/<pid>/status
+// file.
+func readMemoryStatus(path string) (memoryStatus, error) {
+	var result memoryStatus
+
+	f, err := os.Open(path)
+	if err != nil {
+		return result, errors.Wrapf(err, "unable to read %s", path)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+
+		var dest *uint64
+		switch key {
+		case "VmHWM":
+			dest = &result.vmHWM_kB
+		case "VmRSS":
+			dest = &result.vmRSS_kB
+		default:
+			continue
+		}
+
+		// Values are of the form "1234 kB".
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			return result, errors.Errorf("malformed %s in %s", key, path)
+		}
+		*dest, err = strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return result, errors.Wrapf(err, "malformed %s in %s", key, path)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return result, errors.Wrapf(err, "unable to read %s", path)
+	}
+	return result, nil
+}
+
+type cgroupLimits struct {
+	// Zero means no limit.
+	cpuCores     float64
+	memory_bytes uint64
+}
+
+// Reads the CPU and memory limits of the process's cgroup. Limits that cannot
+// be determined are reported as zero, meaning no limit.
+func (s *ResourceSampler) readLimits() cgroupLimits {
+	var result cgroupLimits
+	v1Paths, v2Path := readCgroupPaths(filepath.Join(s.config.ProcDir, "cgroup"))
+
+	// cgroup v2: a single hierarchy with cpu.max and memory.max.
+	if dir, ok := s.findCgroupDir(v2Path, "", "cpu.max"); ok {
+		result.cpuCores = readCgroupV2CPULimit(filepath.Join(dir, "cpu.max"))
+	}
+	if dir, ok := s.findCgroupDir(v2Path, "", "memory.max"); ok {
+		result.memory_bytes = readCgroupLimit(filepath.Join(dir, "memory.max"))
+	}
+	if result.cpuCores > 0 || result.memory_bytes > 0 {
+		return result
+	}
+
+	// cgroup v1: a hierarchy per controller.
+	cpu := v1Paths["cpu"]
+	if dir, ok := s.findCgroupDir(cpu.path, cpu.hierarchy, "cpu.cfs_quota_us"); ok {
+		quota := readCgroupInt(filepath.Join(dir, "cpu.cfs_quota_us"))
+		period := readCgroupInt(filepath.Join(dir, "cpu.cfs_period_us"))
+		if quota > 0 && period > 0 {
+			result.cpuCores = float64(quota) / float64(period)
+		}
+	}
+	memory := v1Paths["memory"]
+	if dir, ok := s.findCgroupDir(memory.path, memory.hierarchy, "memory.limit_in_bytes"); ok {
+		limit := readCgroupLimit(filepath.Join(dir, "memory.limit_in_bytes"))
+		if limit < cgroupV1UnlimitedMemory_bytes {
+			result.memory_bytes = limit
+		}
+	}
+	return result
+}
+
+// Returns the directory of the process's cgroup that contains the given file.
+// Tries the cgroup's path within the hierarchy, then the root of the
+// hierarchy, which is where the process's cgroup appears inside a container
+// with its own cgroup namespace.
+func (s *ResourceSampler) findCgroupDir(cgroupPath, hierarchy, file string) (string, bool) {
+	root := filepath.Join(s.config.CgroupDir, hierarchy)
+	candidates := []string{root}
+	if cgroupPath != "" && cgroupPath != "/" {
+		candidates = []string{filepath.Join(root, cgroupPath), root}
+	}
+
+	for _, dir := range candidates {
+		if _, err := os.Stat(filepath.Join(dir, file)); err == nil {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// The location of a process's cgroup in a cgroup v1 hierarchy.
+type cgroupV1Path struct {
+	// The hierarchy's directory name, which lists its controllers, e.g.
+	// "cpu,cpuacct".
+	hierarchy string
+
+	// The cgroup's path within the hierarchy.
+	path string
+}
+
+// Parses a /proc/<pid>/cgroup file. Returns the cgroup v1 path for each
+// controller, and the cgroup v2 path, if any.
+func readCgroupPaths(path string) (v1Paths map[string]cgroupV1Path, v2Path string) {
+	v1Paths = make(map[string]cgroupV1Path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return v1Paths, ""
+	}
+
+	// Each line is of the form "hierarchy-ID:controller-list:cgroup-path".
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			v2Path = parts[2]
+			continue
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			v1Paths[controller] = cgroupV1Path{hierarchy: parts[1], path: parts[2]}
+		}
+	}
+	return v1Paths, v2Path
+}
+
+// Reads a cgroup v2 cpu.max file, of the form "$MAX $PERIOD". Returns the
+// limit in cores, or zero if there is no limit.
+func readCgroupV2CPULimit(path string) float64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 || fields[0] == "max" {
+		return 0
+	}
+	quota, quotaErr := strconv.ParseFloat(fields[0], 64)
+	period, periodErr := strconv.ParseFloat(fields[1], 64)
+	if quotaErr != nil || periodErr != nil || quota <= 0 || period <= 0 {
+		return 0
+	}
+	return quota / period
+}
+
+// Reads a cgroup file holding a single limit in bytes. Returns zero if there
+// is no limit.
+func readCgroupLimit(path string) uint64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "max" {
+		return 0
+	}
+	limit, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return limit
+}
+
+// Reads a cgroup file holding a single integer, which may be negative.
+func readCgroupInt(path string) int64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	value, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return value
+}
@@ -0,0 +1,187 @@
+package client_telemetry
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Copies a fixture proc directory, so that the test can update it.
+func copyProcDir(t *testing.T, fixture string) string {
+	dir := t.TempDir()
+	for _, name := range []string{"stat", "status", "cgroup"} {
+		data, err := os.ReadFile(filepath.Join("testdata", fixture, name))
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0o644))
+	}
+	return dir
+}
+
+// Sets the utime and stime fields of a proc stat file.
+func writeStat(t *testing.T, procDir string, utime, stime string) {
+	stat := "4242 (akita (agent)) S 1 4242 4242 0 -1 4194560 5000 0 0 0 " + utime + " " + stime + " 0 0 20 0 12 0 1000 800000000 20000\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(procDir, "stat"), []byte(stat), 0o644))
+}
+
+// Sets the peak and current resident set sizes in a proc status file.
+func writeStatus(t *testing.T, procDir string, vmHWM, vmRSS string) {
+	status := "Name:\takita\nVmHWM:\t" + vmHWM + " kB\nVmRSS:\t" + vmRSS + " kB\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(procDir, "status"), []byte(status), 0o644))
+}
+
+// Returns the contents of a proc clear_refs file, then empties it.
+func readClearRefs(t *testing.T, procDir string) string {
+	path := filepath.Join(procDir, "clear_refs")
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, nil, 0o644))
+	return string(data)
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestResourceSamplerCgroupV1(t *testing.T) {
+	procDir := copyProcDir(t, "proc_v1")
+	assert.NoError(t, os.WriteFile(filepath.Join(procDir, "clear_refs"), nil, 0o644))
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+
+	sampler, err := NewResourceSampler(ResourceSamplerConfig{
+		ProcDir:      procDir,
+		CgroupDir:    filepath.Join("testdata", "cgroup_v1"),
+		NumCPU:       8,
+		Now:          clock.Now,
+		ResetPeakRSS: true,
+	})
+	assert.NoError(t, err)
+
+	// The peak resident set size is reset at the start of each window.
+	assert.Equal(t, "5", readClearRefs(t, procDir))
+
+	// 1.5 seconds of CPU time in 2 seconds.
+	clock.now = start.Add(2 * time.Second)
+	writeStat(t, procDir, "250", "100")
+	usage, err := sampler.Sample()
+	assert.NoError(t, err)
+	assert.Equal(t, &AgentResourceUsage{
+		Peak:                      AgentResourceUsageData{CoresUsed: 0.75, RelativeCPU: 50, VmHWM: 90000},
+		Recent:                    AgentResourceUsageData{CoresUsed: 0.75, RelativeCPU: 50, VmHWM: 90000},
+		ObservedStartingAt:        start,
+		ObservedDurationInSeconds: 2,
+		CPULimit_cores:            1.5,
+	}, usage)
+
+	assert.Equal(t, "5", readClearRefs(t, procDir))
+
+	// An idle window doesn't lower the peak.
+	clock.now = start.Add(12 * time.Second)
+	writeStatus(t, procDir, "85000", "70000")
+	usage, err = sampler.Sample()
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, usage.Recent.CoresUsed)
+	assert.Equal(t, 0.75, usage.Peak.CoresUsed)
+	assert.Equal(t, uint64(85000), usage.Recent.VmHWM)
+	assert.Equal(t, uint64(90000), usage.Peak.VmHWM)
+	assert.Equal(t, start.Add(2*time.Second), usage.ObservedStartingAt)
+	assert.Equal(t, 10, usage.ObservedDurationInSeconds)
+}
+
+func TestResourceSamplerKeepsEarlierPeak(t *testing.T) {
+	procDir := copyProcDir(t, "proc_v1")
+	assert.NoError(t, os.WriteFile(filepath.Join(procDir, "clear_refs"), nil, 0o644))
+	writeStatus(t, procDir, "120000", "80000")
+
+	sampler, err := NewResourceSampler(ResourceSamplerConfig{
+		ProcDir:      procDir,
+		CgroupDir:    filepath.Join("testdata", "cgroup_v1"),
+		ResetPeakRSS: true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "5", readClearRefs(t, procDir))
+
+	// The reset lowered VmHWM, but the peak from before the sampler remains.
+	writeStatus(t, procDir, "90000", "80000")
+	usage, err := sampler.Sample()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(90000), usage.Recent.VmHWM)
+	assert.Equal(t, uint64(120000), usage.Peak.VmHWM)
+}
+
+func TestResourceSamplerLeavesPeakRSSByDefault(t *testing.T) {
+	procDir := copyProcDir(t, "proc_v1")
+	assert.NoError(t, os.WriteFile(filepath.Join(procDir, "clear_refs"), nil, 0o644))
+
+	sampler, err := NewResourceSampler(ResourceSamplerConfig{
+		ProcDir:   procDir,
+		CgroupDir: filepath.Join("testdata", "cgroup_v1"),
+	})
+	assert.NoError(t, err)
+	usage, err := sampler.Sample()
+	assert.NoError(t, err)
+	assert.Equal(t, "", readClearRefs(t, procDir))
+
+	// Without resets, the recent window reports the current resident set size.
+	assert.Equal(t, uint64(80000), usage.Recent.VmHWM)
+	assert.Equal(t, uint64(90000), usage.Peak.VmHWM)
+}
+
+func TestResourceSamplerCgroupV2(t *testing.T) {
+	procDir := copyProcDir(t, "proc_v2")
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+
+	sampler, err := NewResourceSampler(ResourceSamplerConfig{
+		ProcDir:   procDir,
+		CgroupDir: filepath.Join("testdata", "cgroup_v2"),
+		NumCPU:    8,
+		Now:       clock.Now,
+	})
+	assert.NoError(t, err)
+
+	clock.now = start.Add(time.Second)
+	writeStat(t, procDir, "200", "50")
+	usage, err := sampler.Sample()
+	assert.NoError(t, err)
+	assert.Equal(t, 0.5, usage.Recent.CoresUsed)
+	assert.Equal(t, 100.0, usage.Recent.RelativeCPU)
+	assert.Equal(t, 0.5, usage.CPULimit_cores)
+	assert.Equal(t, uint64(512<<20), usage.MemoryLimit_bytes)
+
+	// Without clear_refs, the peak can't be reset, so the recent window reports
+	// the current resident set size.
+	assert.Equal(t, uint64(80000), usage.Recent.VmHWM)
+	assert.Equal(t, uint64(90000), usage.Peak.VmHWM)
+}
+
+func TestResourceSamplerNoCgroupLimits(t *testing.T) {
+	procDir := copyProcDir(t, "proc_v2")
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	sampler, err := NewResourceSampler(ResourceSamplerConfig{
+		ProcDir:   procDir,
+		CgroupDir: t.TempDir(),
+		NumCPU:    4,
+		Now:       clock.Now,
+	})
+	assert.NoError(t, err)
+
+	clock.now = clock.now.Add(time.Second)
+	writeStat(t, procDir, "250", "50")
+	usage, err := sampler.Sample()
+	assert.NoError(t, err)
+	assert.Equal(t, 25.0, usage.Recent.RelativeCPU)
+	assert.Equal(t, 0.0, usage.CPULimit_cores)
+}
+
+func TestResourceSamplerMissingProc(t *testing.T) {
+	_, err := NewResourceSampler(ResourceSamplerConfig{ProcDir: t.TempDir()})
+	assert.Error(t, err)
+}
@@ -0,0 +1,33 @@
+package client_telemetry
+
+import "time"
+
+type AgentResourceUsage struct {
+	// Peak usage data over the lifetime of the agent.
+	Peak AgentResourceUsageData `json:"peak"`
+
+	// Recent usage data over the interval defined by ObservedStartingAt and
+	// ObservedDurationInSeconds.
+	Recent AgentResourceUsageData `json:"recent"`
+
+	// Time window in which recent resource usage was observed.  This may be different
+	// than the window specified in api_schema.PostClientPacketCaptureStatsRequest.
+	ObservedStartingAt        time.Time `json:"observed_starting_at"`
+	ObservedDurationInSeconds int       `json:"observed_duration_in_seconds"`
+
+	// The CPU and memory limits of the agent's cgroup, if any. Zero means no
+	// limit, or that the limit is unknown.
+	CPULimit_cores    float64 `json:"cpu_limit_cores,omitempty"`
+	MemoryLimit_bytes uint64  `json:"memory_limit_bytes,omitempty"`
+}
+
+type AgentResourceUsageData struct {
+	// The number of CPU cores (or fractions thereof) the Akita agent used.
+	CoresUsed float64 `json:"cpus_used"`
+
+	// Akita agent CPU usage, as a percentage of total CPU availability.
+	RelativeCPU float64 `json:"relative_cpu"`
+
+	// Peak resident set size in kB.
+	VmHWM uint64 `json:"vm_hwm"`
+}
@@ -0,0 +1,399 @@
+package client_telemetry
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Returned when a summary's encoding version is not compatible with this
+// version of the library.
+var ErrIncompatibleVersion = errors.New("incompatible packet count summary version")
+
+// Checks that a summary with the given encoding version can be read by this
+// version of the library. Versions are compatible if their major numbers
+// match; see Version.
+func CheckVersion(version string) error {
+	major, _, err := parseVersion(version)
+	if err != nil {
+		return err
+	}
+	ourMajor, _, err := parseVersion(Version)
+	if err != nil {
+		return err
+	}
+	if major != ourMajor {
+		return errors.Wrapf(ErrIncompatibleVersion, "got %s, expected v%d.x", version, ourMajor)
+	}
+	return nil
+}
+
+// Parses a version of the form "vMAJOR.MINOR".
+func parseVersion(version string) (major, minor int, err error) {
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	if !strings.HasPrefix(version, "v") || len(parts) != 2 {
+		return 0, 0, errors.Wrapf(ErrIncompatibleVersion, "malformed version %q", version)
+	}
+	major, majorErr := strconv.Atoi(parts[0])
+	minor, minorErr := strconv.Atoi(parts[1])
+	if majorErr != nil || minorErr != nil || major < 0 || minor < 0 {
+		return 0, 0, errors.Wrapf(ErrIncompatibleVersion, "malformed version %q", version)
+	}
+	return major, minor, nil
+}
+
+// Combines summaries from several agents into one, such as for a
+// cluster-level view. Nil summaries are skipped. Returns an error if any
+// summary has an incompatible version.
+//
+// Each TopByX map in the result is limited to the largest of the summaries'
+// overflow limits, or is unlimited if no summary has a limit. Keys are
+// re-ranked by PacketCounts.Weight across all summaries, and counts for keys
+// that don't make the cut are moved to the overflow.
+//
+// A key tracked by one agent may have been counted in another agent's
+// overflow. The result's TopByXErrors account for this: each key's error
+// bound includes the overflow weight of every summary that did not track the
+// key.
+func MergeSummaries(summaries ...*PacketCountSummary) (*PacketCountSummary, error) {
+	result := NewPacketCountSummary()
+
+	var nonNil []*PacketCountSummary
+	for _, s := range summaries {
+		if s == nil {
+			continue
+		}
+		if err := CheckVersion(s.Version); err != nil {
+			return nil, err
+		}
+		nonNil = append(nonNil, s)
+		result.Total.Add(s.Total)
+		result.ObservationWindow.Add(s.ObservationWindow)
+	}
+
+	byPort := make([]topByView[int], len(nonNil))
+	byInterface := make([]topByView[string], len(nonNil))
+	byHost := make([]topByView[string], len(nonNil))
+	for i, s := range nonNil {
+		byPort[i] = topByView[int]{s.TopByPort, s.ByPortOverflow, s.TopByPortErrors, s.ByPortOverflowLimit}
+		byInterface[i] = topByView[string]{s.TopByInterface, s.ByInterfaceOverflow, s.TopByInterfaceErrors, s.ByInterfaceOverflowLimit}
+		byHost[i] = topByView[string]{s.TopByHost, s.ByHostOverflow, s.TopByHostErrors, s.ByHostOverflowLimit}
+	}
+
+	merged := mergeTopBy(byPort, func(a, b int) bool { return a < b })
+	result.TopByPort, result.ByPortOverflow, result.TopByPortErrors, result.ByPortOverflowLimit =
+		merged.counts, merged.overflow, merged.errors, merged.limit
+
+	mergedStr := mergeTopBy(byInterface, func(a, b string) bool { return a < b })
+	result.TopByInterface, result.ByInterfaceOverflow, result.TopByInterfaceErrors, result.ByInterfaceOverflowLimit =
+		mergedStr.counts, mergedStr.overflow, mergedStr.errors, mergedStr.limit
+
+	mergedStr = mergeTopBy(byHost, func(a, b string) bool { return a < b })
+	result.TopByHost, result.ByHostOverflow, result.TopByHostErrors, result.ByHostOverflowLimit =
+		mergedStr.counts, mergedStr.overflow, mergedStr.errors, mergedStr.limit
+
+	return result, nil
+}
+
+// One of a summary's TopByX breakdowns.
+type topByView[K comparable] struct {
+	counts   map[K]*PacketCounts
+	overflow *PacketCounts
+	errors   map[K]int
+	limit    int
+}
+
+func mergeTopBy[K comparable](views []topByView[K], less func(a, b K) bool) topByView[K] {
+	result := topByView[K]{counts: make(map[K]*PacketCounts)}
+
+	for _, v := range views {
+		if v.limit > result.limit {
+			result.limit = v.limit
+		}
+		for key, counts := range v.counts {
+			if counts == nil {
+				continue
+			}
+			if existing, ok := result.counts[key]; ok {
+				existing.Add(*counts)
+			} else {
+				result.counts[key] = counts.Copy()
+			}
+		}
+		if v.overflow != nil {
+			if result.overflow == nil {
+				result.overflow = &PacketCounts{}
+			}
+			result.overflow.Add(*v.overflow)
+		}
+	}
+
+	// Compute error bounds for the merged keys.
+	for key := range result.counts {
+		e := 0
+		for _, v := range views {
+			if _, tracked := v.counts[key]; tracked {
+				e += v.errors[key]
+			} else if v.overflow != nil {
+				e += v.overflow.Weight()
+			}
+		}
+		if e > 0 {
+			if result.errors == nil {
+				result.errors = make(map[K]int)
+			}
+			result.errors[key] = e
+		}
+	}
+
+	if result.limit <= 0 || len(result.counts) <= result.limit {
+		return result
+	}
+
+	// Keep the heaviest keys, breaking ties by key for determinism.
+	keys := make([]K, 0, len(result.counts))
+	for key := range result.counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		wi, wj := result.counts[keys[i]].Weight(), result.counts[keys[j]].Weight()
+		if wi != wj {
+			return wi > wj
+		}
+		return less(keys[i], keys[j])
+	})
+	if result.overflow == nil {
+		result.overflow = &PacketCounts{}
+	}
+	for _, key := range keys[result.limit:] {
+		result.overflow.Add(*result.counts[key])
+		delete(result.counts, key)
+		delete(result.errors, key)
+	}
+	if len(result.errors) == 0 {
+		result.errors = nil
+	}
+	return result
+}
+
+// Returns the change in counts between two snapshots of the same agent's
+// cumulative summary. A nil earlier summary is treated as empty, so the result
+// is a copy of the later one. Returns an error if the later summary is nil, or
+// if either summary has an incompatible version.
+//
+// As with Prometheus counters, a counter that decreased is assumed to have
+// been reset, such as by an agent restart, and its later value is taken as the
+// delta. Keys with no change are omitted from the TopByX maps. The
+// observation window, limits and error bounds are taken from the later
+// summary.
+//
+// A key that left a TopByX map, or whose counts decreased, is assumed to have
+// been evicted to the overflow, which then holds the key's earlier counts.
+// Those counts are subtracted from the overflow's delta, so that they are not
+// counted twice.
+//
+// This can't detect a key that was evicted and then tracked again past its
+// earlier weight, since its counts appear to have grown. The key's delta is
+// then short by its earlier counts, and the overflow's delta includes them
+// again. Totals are unaffected.
+func DiffSummaries(earlier, later *PacketCountSummary) (*PacketCountSummary, error) {
+	if later == nil {
+		return nil, errors.New("later summary is nil")
+	}
+	if earlier == nil {
+		earlier = &PacketCountSummary{Version: Version}
+	}
+	if err := CheckVersion(earlier.Version); err != nil {
+		return nil, err
+	}
+	if err := CheckVersion(later.Version); err != nil {
+		return nil, err
+	}
+
+	result := &PacketCountSummary{
+		Version:                  Version,
+		Total:                    *later.Total.Delta(&earlier.Total),
+		ObservationWindow:        *later.ObservationWindow.Copy(),
+		TopByPort:                diffTopBy(earlier.TopByPort, later.TopByPort),
+		TopByInterface:           diffTopBy(earlier.TopByInterface, later.TopByInterface),
+		TopByHost:                diffTopBy(earlier.TopByHost, later.TopByHost),
+		ByPortOverflowLimit:      later.ByPortOverflowLimit,
+		ByInterfaceOverflowLimit: later.ByInterfaceOverflowLimit,
+		ByHostOverflowLimit:      later.ByHostOverflowLimit,
+		ByPortOverflow:           diffOverflow(earlier.TopByPort, later.TopByPort, earlier.ByPortOverflow, later.ByPortOverflow),
+		ByInterfaceOverflow:      diffOverflow(earlier.TopByInterface, later.TopByInterface, earlier.ByInterfaceOverflow, later.ByInterfaceOverflow),
+		ByHostOverflow:           diffOverflow(earlier.TopByHost, later.TopByHost, earlier.ByHostOverflow, later.ByHostOverflow),
+		TopByPortErrors:          copyErrors(later.TopByPortErrors),
+		TopByInterfaceErrors:     copyErrors(later.TopByInterfaceErrors),
+		TopByHostErrors:          copyErrors(later.TopByHostErrors),
+	}
+	return result, nil
+}
+
+func diffTopBy[K comparable](earlier, later map[K]*PacketCounts) map[K]*PacketCounts {
+	result := make(map[K]*PacketCounts, len(later))
+	for key, counts := range later {
+		if counts == nil {
+			continue
+		}
+		delta := counts.Delta(earlier[key])
+		if !delta.isZero() {
+			result[key] = delta
+		}
+	}
+	return result
+}
+
+func diffOverflow[K comparable](earlierTop, laterTop map[K]*PacketCounts, earlier, later *PacketCounts) *PacketCounts {
+	if later == nil {
+		return nil
+	}
+
+	// The earlier counts of evicted keys were added to the overflow when the
+	// keys were evicted. A key that was evicted and then tracked again restarts
+	// from zero, so its counts decrease.
+	baseline := earlier.Copy()
+	for key, counts := range earlierTop {
+		if counts == nil {
+			continue
+		}
+		if laterCounts, ok := laterTop[key]; ok && laterCounts != nil && laterCounts.Weight() >= counts.Weight() {
+			continue
+		}
+		if baseline == nil {
+			baseline = &PacketCounts{}
+		}
+		baseline.Add(*counts)
+	}
+
+	delta := later.Delta(baseline)
+	if delta.isZero() {
+		return nil
+	}
+	return delta
+}
+
+func copyErrors[K comparable](errors map[K]int) map[K]int {
+	if errors == nil {
+		return nil
+	}
+	result := make(map[K]int, len(errors))
+	for k, v := range errors {
+		result[k] = v
+	}
+	return result
+}
+
+// Returns the change from earlier to c, where both are cumulative counts. A
+// counter that decreased is assumed to have been reset, and its value in c is
+// taken as the delta. The flow fields are copied from c. A nil earlier is
+// treated as all zeros.
+func (c *PacketCounts) Delta(earlier *PacketCounts) *PacketCounts {
+	if earlier == nil {
+		return c.Copy()
+	}
+
+	result := &PacketCounts{
+		Interface:                  c.Interface,
+		SrcHost:                    c.SrcHost,
+		DstHost:                    c.DstHost,
+		SrcPort:                    c.SrcPort,
+		DstPort:                    c.DstPort,
+		TCPPackets:                 counterDelta(earlier.TCPPackets, c.TCPPackets),
+		HTTPRequests:               counterDelta(earlier.HTTPRequests, c.HTTPRequests),
+		HTTPResponses:              counterDelta(earlier.HTTPResponses, c.HTTPResponses),
+		HTTPRequestsRateLimited:    counterDelta(earlier.HTTPRequestsRateLimited, c.HTTPRequestsRateLimited),
+		OversizedWitnesses:         counterDelta(earlier.OversizedWitnesses, c.OversizedWitnesses),
+		TLSHello:                   counterDelta(earlier.TLSHello, c.TLSHello),
+		HTTP2Prefaces:              counterDelta(earlier.HTTP2Prefaces, c.HTTP2Prefaces),
+		QUICHandshakes:             counterDelta(earlier.QUICHandshakes, c.QUICHandshakes),
+		Unparsed:                   counterDelta(earlier.Unparsed, c.Unparsed),
+		UnparsedBytes:              counterDelta(earlier.UnparsedBytes, c.UnparsedBytes),
+		HTTPLatency_ms:             c.HTTPLatency_ms.Delta(earlier.HTTPLatency_ms),
+		HTTPRequestBodySize_bytes:  c.HTTPRequestBodySize_bytes.Delta(earlier.HTTPRequestBodySize_bytes),
+		HTTPResponseBodySize_bytes: c.HTTPResponseBodySize_bytes.Delta(earlier.HTTPResponseBodySize_bytes),
+		TCPPayloadSize_bytes:       c.TCPPayloadSize_bytes.Delta(earlier.TCPPayloadSize_bytes),
+	}
+	for reason, count := range c.UnparsedByReason {
+		if delta := counterDelta(earlier.UnparsedByReason[reason], count); delta != 0 {
+			if result.UnparsedByReason == nil {
+				result.UnparsedByReason = make(map[string]int)
+			}
+			result.UnparsedByReason[reason] = delta
+		}
+	}
+	return result
+}
+
+func counterDelta(earlier, later int) int {
+	if later < earlier {
+		return later
+	}
+	return later - earlier
+}
+
+// Returns true if no events or values are counted.
+func (c *PacketCounts) isZero() bool {
+	return c.Weight() == 0 && c.UnparsedBytes == 0 && len(c.UnparsedByReason) == 0 &&
+		c.HTTPLatency_ms == nil && c.HTTPRequestBodySize_bytes == nil &&
+		c.HTTPResponseBodySize_bytes == nil && c.TCPPayloadSize_bytes == nil
+}
+
+// Returns the values recorded by h but not by earlier, where h is a later
+// snapshot of the same histogram. If any bucket decreased, the histogram is
+// assumed to have been reset, and a copy of h is returned. Returns nil if
+// nothing was recorded in between.
+//
+// Min and Max of the result are estimated from its buckets, since the true
+// extremes of the new values are not known.
+func (h *Histogram) Delta(earlier *Histogram) *Histogram {
+	if h == nil || h.Count == 0 {
+		return nil
+	}
+	if earlier == nil || earlier.Count == 0 {
+		return h.Copy()
+	}
+	if earlier.accuracy() != h.accuracy() || earlier.Count > h.Count || earlier.ZeroCount > h.ZeroCount {
+		return h.Copy()
+	}
+
+	result := &Histogram{
+		RelativeAccuracy: h.RelativeAccuracy,
+		Count:            h.Count - earlier.Count,
+		Sum:              h.Sum - earlier.Sum,
+		ZeroCount:        h.ZeroCount - earlier.ZeroCount,
+	}
+	if result.Count == 0 {
+		return nil
+	}
+	for i, earlierCount := range earlier.Buckets {
+		if h.Buckets[i] < earlierCount {
+			return h.Copy()
+		}
+	}
+	for i, count := range h.Buckets {
+		if delta := count - earlier.Buckets[i]; delta > 0 {
+			if result.Buckets == nil {
+				result.Buckets = make(map[int]int64)
+			}
+			result.Buckets[i] = delta
+		}
+	}
+
+	result.Min, result.Max = math.Inf(1), 0
+	if result.ZeroCount > 0 {
+		result.Min = 0
+	}
+	for i := range result.Buckets {
+		v := math.Max(h.Min, math.Min(h.Max, h.bucketValue(i)))
+		result.Min = math.Min(result.Min, v)
+		result.Max = math.Max(result.Max, v)
+	}
+	if math.IsInf(result.Min, 1) {
+		result.Min = 0
+	}
+	return result
+}
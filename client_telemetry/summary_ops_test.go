@@ -0,0 +1,168 @@
+package client_telemetry
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckVersion(t *testing.T) {
+	assert.NoError(t, CheckVersion(Version))
+	assert.NoError(t, CheckVersion("v0.1"))
+	assert.NoError(t, CheckVersion("v0.99"))
+	assert.True(t, errors.Is(CheckVersion("v1.0"), ErrIncompatibleVersion))
+	assert.True(t, errors.Is(CheckVersion(""), ErrIncompatibleVersion))
+	assert.True(t, errors.Is(CheckVersion("0.5"), ErrIncompatibleVersion))
+}
+
+func TestMergeSummaries(t *testing.T) {
+	a := NewPacketCountSummary()
+	a.Total = PacketCounts{TCPPackets: 10}
+	a.ByHostOverflowLimit = 2
+	a.TopByHost = map[string]*PacketCounts{
+		"x": {TCPPackets: 5},
+		"y": {TCPPackets: 4},
+	}
+	a.ByHostOverflow = &PacketCounts{TCPPackets: 1}
+
+	b := NewPacketCountSummary()
+	b.Total = PacketCounts{TCPPackets: 20}
+	b.ByHostOverflowLimit = 2
+	b.TopByHost = map[string]*PacketCounts{
+		"y": {TCPPackets: 3},
+		"z": {TCPPackets: 17},
+	}
+	b.TopByHostErrors = map[string]int{"z": 2}
+	b.TopByPort[80] = &PacketCounts{HTTPRequests: 1}
+
+	merged, err := MergeSummaries(a, nil, b)
+	assert.NoError(t, err)
+	assert.Equal(t, 30, merged.Total.TCPPackets)
+	assert.Equal(t, 2, merged.ByHostOverflowLimit)
+
+	// x is ranked below y and z, so it moves to the overflow.
+	assert.Equal(t, map[string]*PacketCounts{
+		"y": {TCPPackets: 7},
+		"z": {TCPPackets: 17},
+	}, merged.TopByHost)
+	assert.Equal(t, 6, merged.ByHostOverflow.TCPPackets)
+
+	// z might have been hidden in a's overflow.
+	assert.Equal(t, map[string]int{"z": 3}, merged.TopByHostErrors)
+
+	assert.Equal(t, 1, merged.TopByPort[80].HTTPRequests)
+	assert.Nil(t, merged.ByPortOverflow)
+
+	// The inputs are unchanged.
+	assert.Equal(t, 4, a.TopByHost["y"].TCPPackets)
+
+	b.Version = "v1.0"
+	_, err = MergeSummaries(a, b)
+	assert.True(t, errors.Is(err, ErrIncompatibleVersion))
+}
+
+func TestDiffSummaries(t *testing.T) {
+	earlier := NewPacketCountSummary()
+	earlier.Total = PacketCounts{TCPPackets: 10, HTTPRequests: 5}
+	earlier.Total.RecordHTTPLatency(10e6)
+	earlier.TopByPort[80] = &PacketCounts{HTTPRequests: 5}
+	earlier.TopByPort[443] = &PacketCounts{TLSHello: 2}
+
+	later := NewPacketCountSummary()
+	later.Total = PacketCounts{TCPPackets: 15, HTTPRequests: 3}
+	later.Total.RecordHTTPLatency(10e6)
+	later.Total.RecordHTTPLatency(30e6)
+	later.TopByPort[80] = &PacketCounts{HTTPRequests: 8}
+	later.TopByPort[443] = &PacketCounts{TLSHello: 2}
+
+	delta, err := DiffSummaries(earlier, later)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, delta.Total.TCPPackets)
+
+	// A decrease is treated as a reset.
+	assert.Equal(t, 3, delta.Total.HTTPRequests)
+
+	// Unchanged keys are omitted.
+	assert.Equal(t, map[int]*PacketCounts{80: {HTTPRequests: 3}}, delta.TopByPort)
+
+	latency := delta.Total.HTTPLatency_ms
+	if assert.NotNil(t, latency) {
+		assert.Equal(t, int64(1), latency.Count)
+		assert.Equal(t, 30.0, latency.Sum)
+		assertWithinAccuracy(t, 30, latency.Quantile(0.5))
+	}
+
+	// Merging the earlier snapshot with the delta recovers the later totals.
+	merged, err := MergeSummaries(earlier, delta)
+	assert.NoError(t, err)
+	assert.Equal(t, later.Total.TCPPackets, merged.Total.TCPPackets)
+	assert.Equal(t, later.Total.HTTPLatency_ms.Count, merged.Total.HTTPLatency_ms.Count)
+}
+
+func TestDiffSummariesEvictedKeys(t *testing.T) {
+	top := NewTopK[int](1)
+	top.Add(80, PacketCounts{TCPPackets: 100})
+	earlier := NewPacketCountSummary()
+	earlier.SetTopByPort(top)
+
+	// Port 443 evicts port 80, whose 100 packets move to the overflow.
+	top.Add(443, PacketCounts{TCPPackets: 5})
+	later := NewPacketCountSummary()
+	later.SetTopByPort(top)
+
+	delta, err := DiffSummaries(earlier, later)
+	assert.NoError(t, err)
+	total := delta.ByPortOverflow.Copy()
+	if total == nil {
+		total = &PacketCounts{}
+	}
+	for _, counts := range delta.TopByPort {
+		total.Add(*counts)
+	}
+	assert.Equal(t, 5, total.TCPPackets)
+
+	// Port 80 returns with 3 packets and evicts port 443, whose 5 packets join
+	// port 80's earlier 100 in the overflow.
+	top.Add(80, PacketCounts{TCPPackets: 3})
+	latest := NewPacketCountSummary()
+	latest.SetTopByPort(top)
+
+	delta, err = DiffSummaries(later, latest)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]*PacketCounts{80: {TCPPackets: 3}}, delta.TopByPort)
+	assert.Nil(t, delta.ByPortOverflow)
+}
+
+// A key that returns past its earlier weight looks like it was never evicted,
+// so its earlier counts are attributed to the overflow instead.
+func TestDiffSummariesRetrackedKeyPastEarlierWeight(t *testing.T) {
+	top := NewTopK[int](1)
+	top.Add(80, PacketCounts{TCPPackets: 100})
+	earlier := NewPacketCountSummary()
+	earlier.SetTopByPort(top)
+
+	top.Add(443, PacketCounts{TCPPackets: 5})
+	top.Add(80, PacketCounts{TCPPackets: 150})
+	later := NewPacketCountSummary()
+	later.SetTopByPort(top)
+
+	delta, err := DiffSummaries(earlier, later)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]*PacketCounts{80: {TCPPackets: 50}}, delta.TopByPort)
+	assert.Equal(t, &PacketCounts{TCPPackets: 105}, delta.ByPortOverflow)
+}
+
+func TestDiffSummariesNil(t *testing.T) {
+	top := NewTopK[int](2)
+	top.Add(80, PacketCounts{TCPPackets: 100})
+	later := NewPacketCountSummary()
+	later.SetTopByPort(top)
+
+	delta, err := DiffSummaries(nil, later)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]*PacketCounts{80: {TCPPackets: 100}}, delta.TopByPort)
+
+	_, err = DiffSummaries(later, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,186 @@
+package client_telemetry
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// Tracks the packet counts of the heaviest keys, such as ports or hosts, in
+// bounded memory, using the Space-Saving algorithm
+// (https://www.cs.ucsb.edu/sites/default/files/documents/2005-23.pdf).
+//
+// At most Limit keys are tracked. When a new key arrives and the tracker is
+// full, the lightest tracked key is evicted and its counts are moved to the
+// overflow. The new key inherits the evicted key's weight as its error: an
+// upper bound on how much of the new key's traffic was counted elsewhere before
+// it was tracked. Any key whose true weight exceeds the total weight divided
+// by Limit is guaranteed to be tracked.
+//
+// Keys are weighed by PacketCounts.Weight. Not thread-safe.
+type TopK[K comparable] struct {
+	limit int
+
+	entries map[K]*topKEntry[K]
+
+	// The tracked entries, lightest first.
+	byWeight topKHeap[K]
+
+	// Counts for evicted keys. Nil if no key has been evicted.
+	overflow *PacketCounts
+}
+
+type topKEntry[K comparable] struct {
+	key    K
+	counts PacketCounts
+
+	// The estimated weight of the key: its tracked weight plus its error.
+	weight int
+
+	// The maximum amount by which weight overestimates the key's true weight.
+	error int
+
+	// The entry's position in the heap.
+	index int
+}
+
+// Returns a tracker for at most limit keys. A limit of zero or less means no
+// keys are tracked, and all counts go to the overflow.
+func NewTopK[K comparable](limit int) *TopK[K] {
+	if limit < 0 {
+		limit = 0
+	}
+	return &TopK[K]{
+		limit:   limit,
+		entries: make(map[K]*topKEntry[K], limit),
+	}
+}
+
+// Returns the number of events in the counts, used to rank keys.
+func (c *PacketCounts) Weight() int {
+	return c.TCPPackets + c.HTTPRequests + c.HTTPResponses + c.HTTPRequestsRateLimited +
+		c.OversizedWitnesses + c.TLSHello + c.HTTP2Prefaces + c.QUICHandshakes + c.Unparsed
+}
+
+// Adds the given counts to the key's counts.
+func (t *TopK[K]) Add(key K, d PacketCounts) {
+	w := d.Weight()
+
+	if e, ok := t.entries[key]; ok {
+		e.counts.Add(d)
+		e.weight += w
+		heap.Fix(&t.byWeight, e.index)
+		return
+	}
+
+	if t.limit == 0 {
+		t.addToOverflow(d)
+		return
+	}
+
+	e := &topKEntry[K]{key: key, weight: w}
+	e.counts.Add(d)
+	if len(t.entries) >= t.limit {
+		evicted := heap.Pop(&t.byWeight).(*topKEntry[K])
+		delete(t.entries, evicted.key)
+		t.addToOverflow(evicted.counts)
+		e.weight += evicted.weight
+		e.error = evicted.weight
+	}
+	t.entries[key] = e
+	heap.Push(&t.byWeight, e)
+}
+
+func (t *TopK[K]) addToOverflow(d PacketCounts) {
+	if t.overflow == nil {
+		t.overflow = &PacketCounts{}
+	}
+	t.overflow.Add(d)
+}
+
+// Returns the maximum number of keys tracked.
+func (t *TopK[K]) Limit() int {
+	return t.limit
+}
+
+// Returns the number of keys tracked.
+func (t *TopK[K]) Len() int {
+	return len(t.entries)
+}
+
+// Returns a copy of the counts of the tracked keys.
+func (t *TopK[K]) Counts() map[K]*PacketCounts {
+	result := make(map[K]*PacketCounts, len(t.entries))
+	for key, e := range t.entries {
+		result[key] = e.counts.Copy()
+	}
+	return result
+}
+
+// Returns the error bound of each tracked key whose counts may be incomplete.
+// Keys tracked since their first appearance are omitted. Nil if no key has an
+// error.
+func (t *TopK[K]) Errors() map[K]int {
+	var result map[K]int
+	for key, e := range t.entries {
+		if e.error > 0 {
+			if result == nil {
+				result = make(map[K]int)
+			}
+			result[key] = e.error
+		}
+	}
+	return result
+}
+
+// Returns the tracked keys, heaviest first.
+func (t *TopK[K]) Keys() []K {
+	entries := make([]*topKEntry[K], len(t.byWeight))
+	copy(entries, t.byWeight)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].weight > entries[j].weight })
+
+	result := make([]K, len(entries))
+	for i, e := range entries {
+		result[i] = e.key
+	}
+	return result
+}
+
+// Returns a copy of the counts for evicted keys, or nil if no key has been
+// evicted.
+func (t *TopK[K]) Overflow() *PacketCounts {
+	return t.overflow.Copy()
+}
+
+// Forgets all keys and overflow, as at the start of a new observation window.
+func (t *TopK[K]) Reset() {
+	t.entries = make(map[K]*topKEntry[K], t.limit)
+	t.byWeight = nil
+	t.overflow = nil
+}
+
+// A min-heap of entries by weight, implementing heap.Interface.
+type topKHeap[K comparable] []*topKEntry[K]
+
+func (h topKHeap[K]) Len() int           { return len(h) }
+func (h topKHeap[K]) Less(i, j int) bool { return h[i].weight < h[j].weight }
+
+func (h topKHeap[K]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *topKHeap[K]) Push(x any) {
+	e := x.(*topKEntry[K])
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *topKHeap[K]) Pop() any {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return e
+}
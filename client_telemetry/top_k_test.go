@@ -0,0 +1,62 @@
+package client_telemetry
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopKKeepsHeavyHitters(t *testing.T) {
+	tracker := NewTopK[string](2)
+
+	// Light hosts arrive first and fill the tracker.
+	tracker.Add("light1", PacketCounts{TCPPackets: 1})
+	tracker.Add("light2", PacketCounts{TCPPackets: 2})
+	for i := 0; i < 10; i++ {
+		tracker.Add("heavy", PacketCounts{TCPPackets: 5})
+		tracker.Add("light3", PacketCounts{TCPPackets: 1})
+	}
+
+	assert.Equal(t, "heavy", tracker.Keys()[0])
+	counts := tracker.Counts()
+	assert.Equal(t, 50, counts["heavy"].TCPPackets)
+
+	// The heavy host was tracked after evicting light1, so its counts may be
+	// missing up to light1's weight.
+	assert.Equal(t, 1, tracker.Errors()["heavy"])
+
+	// Every packet is counted exactly once, either under a tracked key or in
+	// the overflow.
+	total := tracker.Overflow().TCPPackets
+	for _, c := range counts {
+		total += c.TCPPackets
+	}
+	assert.Equal(t, 63, total)
+}
+
+func TestTopKWithoutEviction(t *testing.T) {
+	tracker := NewTopK[int](3)
+	tracker.Add(80, PacketCounts{HTTPRequests: 1})
+	tracker.Add(443, PacketCounts{TLSHello: 1})
+	tracker.Add(80, PacketCounts{HTTPResponses: 1})
+
+	assert.Nil(t, tracker.Overflow())
+	assert.Nil(t, tracker.Errors())
+	assert.Equal(t, []int{80, 443}, tracker.Keys())
+
+	summary := NewPacketCountSummary()
+	summary.SetTopByPort(tracker)
+	assert.Equal(t, 3, summary.ByPortOverflowLimit)
+	assert.Equal(t, 1, summary.TopByPort[80].HTTPResponses)
+	assert.Nil(t, summary.ByPortOverflow)
+
+	tracker.Reset()
+	assert.Equal(t, 0, tracker.Len())
+}
+
+func TestTopKZeroLimit(t *testing.T) {
+	tracker := NewTopK[string](0)
+	tracker.Add("a", PacketCounts{TCPPackets: 3})
+	assert.Equal(t, 0, tracker.Len())
+	assert.Equal(t, 3, tracker.Overflow().TCPPackets)
+}
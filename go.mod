@@ -1,6 +1,6 @@
 module github.com/akitasoftware/akita-libs
 
-go 1.18
+go 1.22
 
 require (
 	github.com/OneOfOne/xxhash v1.2.8
@@ -15,6 +15,8 @@ require (
 	github.com/google/gopacket v1.1.19
 	github.com/google/uuid v1.3.0
 	github.com/iancoleman/strcase v0.3.0
+	github.com/klauspost/compress v1.18.0
+	github.com/klauspost/compress v1.18.0
 	github.com/pkg/errors v0.9.1
 	github.com/segmentio/analytics-go/v3 v3.3.0
 	github.com/stretchr/testify v1.8.1
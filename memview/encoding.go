@@ -0,0 +1,226 @@
+package memview
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Readers for the integer and string encodings used by binary protocols.
+//
+// Unless otherwise noted, these return io.EOF without advancing the reader if
+// there are not enough bytes remaining to read the whole value.
+
+var (
+	ErrVarintOverflow = errors.New("memview: varint overflows a 64-bit integer")
+
+	ErrInvalidLengthEncodedInt = errors.New("memview: invalid length-encoded integer")
+)
+
+// Returns the number of bytes between the reader's position and the end of the
+// underlying MemView.
+func (r *MemViewReader) Remaining() int64 {
+	if r.gOffset >= r.mv.length {
+		return 0
+	}
+	return r.mv.length - r.gOffset
+}
+
+// Returns a view of the next n bytes without advancing the reader. The
+// underlying data is not copied.
+func (r *MemViewReader) PeekN(n int64) (MemView, error) {
+	if n < 0 {
+		return MemView{}, errors.Errorf("memview: invalid length %d", n)
+	}
+	if r.Remaining() < n {
+		return MemView{}, io.EOF
+	}
+	return r.mv.SubView(r.gOffset, r.gOffset+n), nil
+}
+
+// Returns a view of the next n bytes and advances the reader past them. The
+// underlying data is not copied.
+func (r *MemViewReader) ReadN(n int64) (MemView, error) {
+	result, err := r.PeekN(n)
+	if err != nil {
+		return MemView{}, err
+	}
+	if _, err := r.Seek(n, io.SeekCurrent); err != nil {
+		return MemView{}, err
+	}
+	return result, nil
+}
+
+// Reads the next n bytes into a new slice. Used for fixed-width integers.
+func (r *MemViewReader) readFixed(n int) ([]byte, error) {
+	if r.Remaining() < int64(n) {
+		return nil, io.EOF
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (r *MemViewReader) ReadUint64() (uint64, error) {
+	buf, err := r.readFixed(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf), nil
+}
+
+func (r *MemViewReader) ReadUint16LE() (uint16, error) {
+	buf, err := r.readFixed(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(buf), nil
+}
+
+func (r *MemViewReader) ReadUint24LE() (uint32, error) {
+	buf, err := r.readFixed(3)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(buf[0]) | uint32(buf[1])<<8 | uint32(buf[2])<<16, nil
+}
+
+func (r *MemViewReader) ReadUint32LE() (uint32, error) {
+	buf, err := r.readFixed(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(buf), nil
+}
+
+func (r *MemViewReader) ReadUint64LE() (uint64, error) {
+	buf, err := r.readFixed(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf), nil
+}
+
+// Reads an unsigned base-128 varint, as used by protocol buffers. Returns
+// ErrVarintOverflow, without advancing the reader, if the value does not fit
+// in 64 bits.
+func (r *MemViewReader) ReadUvarint() (uint64, error) {
+	// Varints are at most 10 bytes long.
+	prefix, err := r.PeekN(minInt64(binary.MaxVarintLen64, r.Remaining()))
+	if err != nil {
+		return 0, err
+	}
+
+	var result uint64
+	for i := int64(0); i < prefix.Len(); i++ {
+		b := prefix.GetByte(i)
+		if i == binary.MaxVarintLen64-1 && b > 1 {
+			return 0, ErrVarintOverflow
+		}
+		result |= uint64(b&0x7f) << (7 * i)
+		if b < 0x80 {
+			if _, err := r.Seek(i+1, io.SeekCurrent); err != nil {
+				return 0, err
+			}
+			return result, nil
+		}
+	}
+	return 0, io.EOF
+}
+
+// Reads a signed, zigzag-encoded base-128 varint, as used by the protocol
+// buffer sint32 and sint64 types.
+func (r *MemViewReader) ReadVarint() (int64, error) {
+	u, err := r.ReadUvarint()
+	if err != nil {
+		return 0, err
+	}
+	return int64(u>>1) ^ -int64(u&1), nil
+}
+
+// Reads a MySQL length-encoded integer. Returns isNull=true if the encoding
+// represents a NULL value (0xfb). Returns ErrInvalidLengthEncodedInt, without
+// advancing the reader, if the first byte is 0xff.
+func (r *MemViewReader) ReadLengthEncodedInt() (value uint64, isNull bool, err error) {
+	first, err := r.PeekN(1)
+	if err != nil {
+		return 0, false, err
+	}
+
+	var width int
+	switch b := first.GetByte(0); {
+	case b < 0xfb:
+		r.Seek(1, io.SeekCurrent)
+		return uint64(b), false, nil
+	case b == 0xfb:
+		r.Seek(1, io.SeekCurrent)
+		return 0, true, nil
+	case b == 0xfc:
+		width = 2
+	case b == 0xfd:
+		width = 3
+	case b == 0xfe:
+		width = 8
+	default:
+		return 0, false, ErrInvalidLengthEncodedInt
+	}
+
+	if r.Remaining() < int64(1+width) {
+		return 0, false, io.EOF
+	}
+	r.Seek(1, io.SeekCurrent)
+
+	buf, err := r.readFixed(width)
+	if err != nil {
+		return 0, false, err
+	}
+	for i := width - 1; i >= 0; i-- {
+		value = value<<8 | uint64(buf[i])
+	}
+	return value, false, nil
+}
+
+// Reads a string terminated by a zero byte, and advances the reader past the
+// terminator. The terminator is not included in the result. Returns io.EOF,
+// without advancing the reader, if there is no terminator.
+func (r *MemViewReader) ReadNullTerminatedString() (string, error) {
+	end := r.mv.IndexByte(r.gOffset, 0)
+	if end == -1 {
+		return "", io.EOF
+	}
+
+	s, err := r.ReadString(int(end - r.gOffset))
+	if err != nil {
+		return "", err
+	}
+	if _, err := r.Seek(1, io.SeekCurrent); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// Reads a string whose length is indicated by the next unsigned varint, as
+// used by protocol buffers. Returns io.EOF, without advancing the reader, if
+// the string is incomplete.
+func (r *MemViewReader) ReadString_uvarint() (string, error) {
+	start := r.gOffset
+	length, err := r.ReadUvarint()
+	if err != nil {
+		return "", err
+	}
+	if uint64(r.Remaining()) < length {
+		r.Seek(start, io.SeekStart)
+		return "", io.EOF
+	}
+	return r.ReadString(int(length))
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
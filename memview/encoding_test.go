@@ -0,0 +1,169 @@
+package memview
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns a reader over data split into single-byte buffers, so that every
+// value spans buffer boundaries.
+func fragmentedReader(data []byte) *MemViewReader {
+	var mv MemView
+	for i := range data {
+		mv.Append(New(data[i : i+1]))
+	}
+	return mv.CreateReader()
+}
+
+func TestFixedWidthReaders(t *testing.T) {
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	r := fragmentedReader(data)
+	v64, err := r.ReadUint64()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x0102030405060708), v64)
+
+	r = fragmentedReader(data)
+	v64, err = r.ReadUint64LE()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x0807060504030201), v64)
+
+	r = fragmentedReader(data)
+	v16, err := r.ReadUint16LE()
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(0x0201), v16)
+	v24, err := r.ReadUint24LE()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0x050403), v24)
+	_, err = r.ReadUint32LE()
+	assert.Equal(t, io.EOF, err)
+
+	// A failed read does not advance the reader.
+	assert.Equal(t, int64(3), r.Remaining())
+	v16, err = r.ReadUint16LE()
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(0x0706), v16)
+}
+
+func TestPeekAndReadN(t *testing.T) {
+	r := fragmentedReader([]byte("hello world"))
+
+	peeked, err := r.PeekN(5)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", peeked.String())
+	assert.Equal(t, int64(11), r.Remaining())
+
+	read, err := r.ReadN(6)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello ", read.String())
+	assert.Equal(t, int64(5), r.Remaining())
+
+	_, err = r.PeekN(6)
+	assert.Equal(t, io.EOF, err)
+	_, err = r.PeekN(-1)
+	assert.Error(t, err)
+
+	read, err = r.ReadN(5)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", read.String())
+	assert.Equal(t, int64(0), r.Remaining())
+}
+
+func TestVarints(t *testing.T) {
+	unsigned := []uint64{0, 1, 127, 128, 300, math.MaxUint32, math.MaxUint64}
+	for _, v := range unsigned {
+		buf := make([]byte, binary.MaxVarintLen64)
+		buf = buf[:binary.PutUvarint(buf, v)]
+		r := fragmentedReader(append(buf, 0xaa))
+		actual, err := r.ReadUvarint()
+		assert.NoError(t, err)
+		assert.Equal(t, v, actual)
+		assert.Equal(t, int64(1), r.Remaining())
+
+		// Truncated varints are incomplete.
+		if len(buf) > 1 {
+			r = fragmentedReader(buf[:len(buf)-1])
+			_, err = r.ReadUvarint()
+			assert.Equal(t, io.EOF, err)
+			assert.Equal(t, int64(len(buf)-1), r.Remaining())
+		}
+	}
+
+	signed := []int64{0, -1, 1, -64, 64, math.MinInt64, math.MaxInt64}
+	for _, v := range signed {
+		buf := make([]byte, binary.MaxVarintLen64)
+		r := fragmentedReader(buf[:binary.PutVarint(buf, v)])
+		actual, err := r.ReadVarint()
+		assert.NoError(t, err)
+		assert.Equal(t, v, actual)
+	}
+
+	overflow := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02}
+	r := fragmentedReader(overflow)
+	_, err := r.ReadUvarint()
+	assert.Equal(t, ErrVarintOverflow, err)
+	assert.Equal(t, int64(len(overflow)), r.Remaining())
+}
+
+func TestLengthEncodedInt(t *testing.T) {
+	testCases := []struct {
+		input    []byte
+		expected uint64
+		isNull   bool
+		err      error
+	}{
+		{input: []byte{0x00}, expected: 0},
+		{input: []byte{0xfa}, expected: 250},
+		{input: []byte{0xfb}, isNull: true},
+		{input: []byte{0xfc, 0x01, 0x02}, expected: 0x0201},
+		{input: []byte{0xfd, 0x01, 0x02, 0x03}, expected: 0x030201},
+		{input: []byte{0xfe, 1, 2, 3, 4, 5, 6, 7, 8}, expected: 0x0807060504030201},
+		{input: []byte{0xfe, 1, 2, 3}, err: io.EOF},
+		{input: []byte{0xff}, err: ErrInvalidLengthEncodedInt},
+		{input: []byte{}, err: io.EOF},
+	}
+
+	for _, tc := range testCases {
+		r := fragmentedReader(tc.input)
+		value, isNull, err := r.ReadLengthEncodedInt()
+		if tc.err != nil {
+			assert.Equal(t, tc.err, err, "input %x", tc.input)
+			assert.Equal(t, int64(len(tc.input)), r.Remaining(), "input %x", tc.input)
+			continue
+		}
+		assert.NoError(t, err, "input %x", tc.input)
+		assert.Equal(t, tc.expected, value, "input %x", tc.input)
+		assert.Equal(t, tc.isNull, isNull, "input %x", tc.input)
+		assert.Equal(t, int64(0), r.Remaining(), "input %x", tc.input)
+	}
+}
+
+func TestStrings(t *testing.T) {
+	r := fragmentedReader([]byte("user\x00\x00postgres"))
+
+	s, err := r.ReadNullTerminatedString()
+	assert.NoError(t, err)
+	assert.Equal(t, "user", s)
+
+	s, err = r.ReadNullTerminatedString()
+	assert.NoError(t, err)
+	assert.Equal(t, "", s)
+
+	_, err = r.ReadNullTerminatedString()
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, int64(len("postgres")), r.Remaining())
+
+	r = fragmentedReader(append([]byte{5}, "hello"...))
+	s, err = r.ReadString_uvarint()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", s)
+
+	r = fragmentedReader(append([]byte{6}, "hello"...))
+	_, err = r.ReadString_uvarint()
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, int64(6), r.Remaining())
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"sort"
 
 	"github.com/pkg/errors"
 )
@@ -21,8 +22,25 @@ import (
 // versa. Use `DeepCopy` to create a completely independent MemView.
 //
 // The zero value is an empty MemView ready to use.
+//
+// Random access (GetByte, SubView, Index with a start offset, and seeking) is
+// logarithmic in the number of underlying byte slices, so parsers can probe
+// views assembled from many small TCP segments without going quadratic.
 type MemView struct {
-	buf    [][]byte
+	// May be shared with the MemView this one is a SubView of, in which case the
+	// first and last slices may hold bytes outside this view. Use bufAt to get
+	// the bytes in the view.
+	buf [][]byte
+
+	// Cumulative lengths of the byte slices in buf, offset by base: ends[i]-base
+	// is the index just past the last byte of buf[i]. Always has the same length
+	// as buf.
+	ends []int64
+
+	// The position in ends of the first byte of the view. Non-zero for a SubView
+	// that shares buf and ends with its parent.
+	base int64
+
 	length int64
 }
 
@@ -32,6 +50,7 @@ type MemView struct {
 func New(data []byte) MemView {
 	return MemView{
 		buf:    [][]byte{data},
+		ends:   []int64{int64(len(data))},
 		length: int64(len(data)),
 	}
 }
@@ -40,31 +59,74 @@ func New(data []byte) MemView {
 func Empty() MemView {
 	return MemView{
 		buf:    [][]byte{},
+		ends:   []int64{},
 		length: 0,
 	}
 }
 
 func (dst *MemView) Append(src MemView) {
-	dst.buf = append(dst.buf, src.buf...)
+	if dst.trimmed() {
+		// The last slice holds bytes past the end of dst, which would end up in
+		// the middle of the result.
+		*dst = dst.DeepCopy()
+	}
+	for i := range src.buf {
+		dst.buf = append(dst.buf, src.bufAt(i))
+		dst.ends = append(dst.ends, dst.length+src.end(i))
+	}
 	dst.length += src.length
 }
 
 // Creates a MemView that is completely independent from the current one.
 func (mv MemView) DeepCopy() MemView {
 	newBuf := make([][]byte, len(mv.buf))
-	copy(newBuf, mv.buf)
+	newEnds := make([]int64, len(mv.ends))
+	for i := range mv.buf {
+		newBuf[i] = mv.bufAt(i)
+		newEnds[i] = mv.end(i)
+	}
 	return MemView{
 		buf:    newBuf,
+		ends:   newEnds,
 		length: mv.length,
 	}
 }
 
+// Returns the bytes of mv held by mv.buf[i].
+func (mv MemView) bufAt(i int) []byte {
+	b := mv.buf[i]
+	if i == 0 {
+		b = b[len(b)-int(mv.ends[0]-mv.base):]
+	}
+	if last := len(mv.buf) - 1; i == last {
+		b = b[:len(b)-int(mv.ends[last]-mv.base-mv.length)]
+	}
+	return b
+}
+
+// Returns the index just past the last byte of mv held by mv.buf[i].
+func (mv MemView) end(i int) int64 {
+	if end := mv.ends[i] - mv.base; end < mv.length {
+		return end
+	}
+	return mv.length
+}
+
+// Returns whether the first or last slice in mv.buf holds bytes outside mv.
+func (mv MemView) trimmed() bool {
+	return mv.base != 0 || (len(mv.ends) > 0 && mv.ends[len(mv.ends)-1] != mv.length)
+}
+
 func (mv *MemView) CreateReader() *MemViewReader {
 	return &MemViewReader{mv: mv}
 }
 
+// Empties mv. Since mv's storage is reused, SubViews of mv must not be used
+// after it is cleared and appended to.
 func (mv *MemView) Clear() {
 	mv.buf = mv.buf[:0] // clear without reallocating memory
+	mv.ends = mv.ends[:0]
+	mv.base = 0
 	mv.length = 0
 }
 
@@ -74,19 +136,27 @@ func (mv MemView) Len() int64 {
 
 // Returns the byte at the given index. Returns 0 if index is out of bounds.
 func (mv MemView) GetByte(index int64) byte {
-	if index < 0 {
+	bufIdx, offset := mv.locate(index)
+	if bufIdx == -1 {
 		return 0
 	}
+	return mv.bufAt(bufIdx)[offset]
+}
 
-	n := index
-	for i := 0; i < len(mv.buf); i++ {
-		lb := int64(len(mv.buf[i]))
-		if n < lb {
-			return mv.buf[i][n]
-		}
-		n -= lb
+// Returns the index of the buffer in mv.buf containing the byte at the given
+// index, and the offset of that byte within mv.bufAt(bufIdx). Returns -1 for
+// the buffer index if index is out of bounds.
+func (mv MemView) locate(index int64) (bufIdx int, offset int) {
+	if index < 0 || index >= mv.length {
+		return -1, 0
 	}
-	return 0
+
+	// Find the first buffer that ends after index. This skips over any empty
+	// buffers.
+	bufIdx = sort.Search(len(mv.ends), func(i int) bool {
+		return mv.ends[i]-mv.base > index
+	})
+	return bufIdx, int(index - mv.end(bufIdx) + int64(len(mv.bufAt(bufIdx))))
 }
 
 // Returns a copy of mv[start:end]. Returns nil if start is negative, start >
@@ -96,32 +166,13 @@ func (mv MemView) getBytes(start, end int64) []byte {
 		return nil
 	}
 
-	result := make([]byte, end-start)
-	resultIdx := int64(0) // Points to the next result byte to be written.
-
-	for bufIdx := 0; bufIdx < len(mv.buf) && start < end; bufIdx++ {
-		bufLen := int64(len(mv.buf[bufIdx]))
-		if start >= bufLen {
-			// Current buffer is before the part to be copied.
-			start -= bufLen
-			end -= bufLen
-			continue
-		}
-
-		copyEnd := end
-		if copyEnd > bufLen {
-			copyEnd = bufLen
-		}
-
-		copy(result[resultIdx:], mv.buf[bufIdx][start:copyEnd])
-
-		copySize := copyEnd - start
-		start = 0
-		end -= bufLen
-		resultIdx += copySize
+	result := make([]byte, 0, end-start)
+	if start == end {
+		return result
 	}
 
-	return result
+	bufIdx, offset := mv.locate(start)
+	return mv.appendFrom(result, bufIdx, offset, int(end-start))
 }
 
 // Returns mv[offset:offset+2], interpreted as a uint16 in network (big endian)
@@ -158,134 +209,266 @@ func (mv MemView) GetUint32(offset int64) uint32 {
 // Returns mv[start:end] (end is not inclusive). Returns an empty MemView if
 // range is invalid.
 func (mv MemView) SubView(start, end int64) MemView {
-	if start >= end {
+	if start >= end || start < 0 || end > mv.length {
 		return MemView{}
 	}
 
-	startBuf := -1
-	endBuf := -1
-	var startOffset, endOffset int
-
-	var n int64
-	for i, b := range mv.buf {
-		lb := int64(len(b))
-		if startBuf == -1 && n+lb > start {
-			startBuf = i
-			startOffset = int(start - n)
-		}
-		if endBuf == -1 && n+lb >= end { // >= because end is not inclusive
-			endBuf = i
-			endOffset = int(end - n)
-			break
-		}
-		n += lb
-	}
-
-	if startBuf == -1 || endBuf == -1 {
-		return MemView{}
-	}
-
-	newBuf := make([][]byte, endBuf+1-startBuf)
-	copy(newBuf, mv.buf[startBuf:endBuf+1])
-	newMS := MemView{
-		buf:    newBuf,
+	// Share the parent's slices, limiting their capacity so that appending to
+	// either view does not overwrite the other.
+	startBuf, _ := mv.locate(start)
+	endBuf, _ := mv.locate(end - 1)
+	return MemView{
+		buf:    mv.buf[startBuf : endBuf+1 : endBuf+1],
+		ends:   mv.ends[startBuf : endBuf+1 : endBuf+1],
+		base:   mv.base + start,
 		length: end - start,
 	}
-	if len(newMS.buf) == 1 {
-		newMS.buf[0] = newMS.buf[0][startOffset:endOffset]
-	} else {
-		newMS.buf[0] = newMS.buf[0][startOffset:]
-		newMS.buf[len(newMS.buf)-1] = newMS.buf[len(newMS.buf)-1][:endOffset]
-	}
-	return newMS
 }
 
 // Index returns the index of the first instance of sep in mv after start index,
-// or -1 if sep is not present in mv.
+// or -1 if sep is not present in mv. Instances of sep may span any number of
+// the underlying buffers.
 func (mv MemView) Index(start int64, sep []byte) int64 {
-	// Find the first buffer to start from.
-	startBuf := -1
-	startOffset := 0
-	var currIndex int64
-	for i, b := range mv.buf {
-		lb := int64(len(b))
-		if currIndex+lb-1 < start { // -1 because start is an index
-			currIndex += lb
-		} else {
-			startBuf = i
-			startOffset = int(start - currIndex)
-			currIndex += int64(startOffset)
-			break
-		}
+	if start < 0 {
+		start = 0
 	}
-
+	startBuf, startOffset := mv.locate(start)
 	if startBuf == -1 {
 		return -1
 	} else if len(sep) == 0 {
 		return start
 	}
 
-	// Iteratively search for the target, keeping in mind that the target may be
-	// spread over multiple slices in mv.buf.
-	//
-	// TODO: this only works correctly for search strings that do not have a repeated
-	// prefix. To work correctly, we would have to back up to the point at which
-	// the needle *could* have started after an incomplete match.
-	//
-	// However, we only use this method to search for strings without a repeated prefix:
-	// GET, POST, DELETE, HEAD, PUT, PATCH, CONNECT, OPTIONS, TRACE, HTTP/1.1 and HTTP/1.0
-	needle := sep
-	needleIndex := 0
+	// Search each buffer in turn with bytes.Index. To find matches that straddle
+	// buffer boundaries, we track the length of the longest prefix of sep that
+	// is a suffix of the bytes searched so far, and continue matching it into
+	// the start of the next buffer using the Knuth-Morris-Pratt algorithm. Such
+	// matches start before any match that lies wholly within the next buffer,
+	// so this finds the earliest match.
+	overlap := len(sep) - 1
+	var fail []int // KMP failure function for sep, computed lazily.
+	matched := 0
+	currIndex := start // Index of the first byte of the current buffer.
 	for b := startBuf; b < len(mv.buf); b++ {
-		haystack := mv.buf[b]
-		// Check remainder of needle if overlap from last buffer
-		var i int = 0
-		for i = startOffset; i < len(haystack) && needleIndex > 0; i++ {
-			if haystack[i] == needle[needleIndex] {
-				needleIndex += 1
-				if needleIndex == len(needle) {
-					// Found, figure out start index.
-					// At the start of the 'i' loop, it points to currentIndex, so we
-					// need to add i and subtract startOffset.  Then move back to the
-					// first character in the needle
-					return currIndex + int64(i-startOffset) - int64(len(needle)-1)
+		haystack := mv.bufAt(b)
+		if b == startBuf {
+			haystack = haystack[startOffset:]
+		}
+
+		// Look for a match that straddles the boundary. It must end within the
+		// first len(sep)-1 bytes of this buffer.
+		prefixLen := overlap
+		if prefixLen > len(haystack) {
+			prefixLen = len(haystack)
+		}
+		scannedPrefix := matched > 0
+		if scannedPrefix {
+			for i := 0; i < prefixLen; i++ {
+				matched = kmpStep(sep, fail, matched, haystack[i])
+				if matched == len(sep) {
+					return currIndex + int64(i+1-len(sep))
 				}
-			} else {
-				needleIndex = 0
 			}
 		}
 
-		// Did we reach the end of the buffer already?
-		if i < len(haystack) {
-			// If not, efficient check of remaining portion of haystack
-			found := bytes.Index(haystack[i:], needle)
-			if found != -1 {
-				return currIndex + int64(found)
-			}
+		if found := bytes.Index(haystack, sep); found != -1 {
+			return currIndex + int64(found)
+		}
+		currIndex += int64(len(haystack))
+
+		if overlap == 0 || b+1 == len(mv.buf) {
+			continue
+		}
 
-			// Check the end of the haystack for the start of the needle
-			// (but not the whole thing, or we would have found it in the call above.)
-			needleStart := len(haystack) - len(needle) + 1
-			if i < needleStart {
-				i = needleStart
+		// Update the matched prefix length for the end of this buffer. Any
+		// partial match is at most len(sep)-1 bytes long.
+		if fail == nil {
+			fail = kmpFailure(sep)
+		}
+		if len(haystack) >= overlap {
+			matched = 0
+			for _, c := range haystack[len(haystack)-overlap:] {
+				matched = kmpStep(sep, fail, matched, c)
 			}
-			for ; i < len(haystack); i++ {
-				if haystack[i] == needle[needleIndex] {
-					needleIndex += 1
-				} else {
-					needleIndex = 0
-				}
+		} else if !scannedPrefix {
+			// The buffer is short and was not scanned above.
+			for _, c := range haystack {
+				matched = kmpStep(sep, fail, matched, c)
+			}
+		}
+	}
+
+	return -1
+}
+
+// Returns the Knuth-Morris-Pratt failure function for sep: fail[i] is the
+// length of the longest proper prefix of sep[:i+1] that is also a suffix of
+// it.
+func kmpFailure(sep []byte) []int {
+	fail := make([]int, len(sep))
+	for i, k := 1, 0; i < len(sep); i++ {
+		for k > 0 && sep[i] != sep[k] {
+			k = fail[k-1]
+		}
+		if sep[i] == sep[k] {
+			k++
+		}
+		fail[i] = k
+	}
+	return fail
+}
+
+// Given that the last matched bytes seen match a prefix of sep, returns the
+// length of the longest prefix of sep matched after also seeing c.
+func kmpStep(sep []byte, fail []int, matched int, c byte) int {
+	for matched > 0 && sep[matched] != c {
+		matched = fail[matched-1]
+	}
+	if sep[matched] == c {
+		matched++
+	}
+	return matched
+}
+
+// Appends to dst up to n bytes of mv, starting at offset in mv.buf[bufIdx].
+func (mv MemView) appendFrom(dst []byte, bufIdx int, offset int, n int) []byte {
+	for ; bufIdx < len(mv.buf) && n > 0; bufIdx++ {
+		b := mv.bufAt(bufIdx)[offset:]
+		offset = 0
+		if len(b) > n {
+			b = b[:n]
+		}
+		dst = append(dst, b...)
+		n -= len(b)
+	}
+	return dst
+}
+
+// LastIndex returns the index of the last instance of sep in mv, or -1 if sep
+// is not present in mv.
+func (mv MemView) LastIndex(sep []byte) int64 {
+	if len(sep) == 0 {
+		return mv.length
+	}
+
+	// This mirrors Index, searching backwards. head holds the first
+	// len(sep)-1 bytes after the current buffer.
+	overlap := len(sep) - 1
+	var head, window []byte
+	currEnd := mv.length // Index just past the last byte of the current buffer.
+	for b := len(mv.buf) - 1; b >= 0; b-- {
+		haystack := mv.bufAt(b)
+
+		if len(head) > 0 {
+			window = mv.appendBefore(window[:0], b, overlap)
+			boundary := len(window)
+			window = append(window, head...)
+			if found := bytes.LastIndex(window, sep); found != -1 && found+len(sep) > boundary {
+				return currEnd - int64(boundary) + int64(found)
 			}
 		}
 
-		// Searched all of buffer
-		currIndex += int64(len(haystack) - startOffset)
+		currEnd -= int64(len(haystack))
+		if found := bytes.LastIndex(haystack, sep); found != -1 {
+			return currEnd + int64(found)
+		}
+
+		if overlap > 0 && b > 0 {
+			// Update head with the bytes at the start of the current buffer.
+			head = mv.appendFrom(head[:0], b, 0, overlap)
+		}
+	}
+
+	return -1
+}
+
+// Appends to dst the up to n bytes of mv that end with mv.buf[bufIdx].
+func (mv MemView) appendBefore(dst []byte, bufIdx int, n int) []byte {
+	remaining := n
+	for first := bufIdx; first >= 0; first-- {
+		b := mv.bufAt(first)
+		if remaining <= len(b) {
+			return mv.appendFrom(dst, first, len(b)-remaining, n)
+		}
+		remaining -= len(b)
+	}
+
+	// There are fewer than n bytes up to the end of mv.buf[bufIdx]. Take them
+	// all, but none after.
+	return mv.appendFrom(dst, 0, 0, n-remaining)
+}
+
+// IndexByte returns the index of the first instance of c in mv after start
+// index, or -1 if c is not present in mv.
+func (mv MemView) IndexByte(start int64, c byte) int64 {
+	if start < 0 {
+		start = 0
+	}
+	startBuf, startOffset := mv.locate(start)
+	if startBuf == -1 {
+		return -1
+	}
+
+	currIndex := start
+	for b := startBuf; b < len(mv.buf); b++ {
+		haystack := mv.bufAt(b)[startOffset:]
 		startOffset = 0
+		if found := bytes.IndexByte(haystack, c); found != -1 {
+			return currIndex + int64(found)
+		}
+		currIndex += int64(len(haystack))
+	}
+	return -1
+}
+
+// IndexAny returns the index of the first instance in mv after start index of
+// any of the UTF-8-encoded code points in chars, or -1 if none is present.
+// Since code points may span buffers, chars should contain only ASCII
+// characters.
+func (mv MemView) IndexAny(start int64, chars string) int64 {
+	if start < 0 {
+		start = 0
+	}
+	startBuf, startOffset := mv.locate(start)
+	if startBuf == -1 {
+		return -1
 	}
 
+	currIndex := start
+	for b := startBuf; b < len(mv.buf); b++ {
+		haystack := mv.bufAt(b)[startOffset:]
+		startOffset = 0
+		if found := bytes.IndexAny(haystack, chars); found != -1 {
+			return currIndex + int64(found)
+		}
+		currIndex += int64(len(haystack))
+	}
 	return -1
 }
 
+// HasPrefix returns whether mv begins with prefix.
+func (mv MemView) HasPrefix(prefix []byte) bool {
+	if int64(len(prefix)) > mv.length {
+		return false
+	}
+
+	for i := range mv.buf {
+		b := mv.bufAt(i)
+		if len(prefix) == 0 {
+			return true
+		}
+		n := len(b)
+		if n > len(prefix) {
+			n = len(prefix)
+		}
+		if !bytes.Equal(b[:n], prefix[:n]) {
+			return false
+		}
+		prefix = prefix[n:]
+	}
+	return len(prefix) == 0
+}
+
 // Returns a string of all the data referenced by this MemView. Note that is
 // creates a COPY of the underlying data.
 func (mv MemView) String() string {
@@ -300,7 +483,7 @@ type MemViewReader struct {
 	// Index for the element from mv.buf to read next.
 	rIndex int
 
-	// Offset into mv.buf[rIndex] for the next read.
+	// Offset into mv.bufAt(rIndex) for the next read.
 	rOffset int
 
 	// Global offset into mv for the next read.
@@ -315,7 +498,7 @@ func (r *MemViewReader) ReadByte() (byte, error) {
 	}
 
 	for i := r.rIndex; i < len(r.mv.buf); i++ {
-		curBuf := r.mv.buf[r.rIndex]
+		curBuf := r.mv.bufAt(r.rIndex)
 		if r.rOffset < len(curBuf) {
 			result := curBuf[r.rOffset]
 			r.rOffset++
@@ -458,7 +641,7 @@ func (r *MemViewReader) Read(out []byte) (int, error) {
 
 	bytesRead := 0
 	for i := r.rIndex; i < len(r.mv.buf); i++ {
-		curr := r.mv.buf[i][r.rOffset:]
+		curr := r.mv.bufAt(i)[r.rOffset:]
 		cp := copy(out[bytesRead:], curr)
 		bytesRead += cp
 		if cp == len(curr) {
@@ -502,45 +685,35 @@ func (r *MemViewReader) Seek(offset int64, whence int) (absoluteOffset int64, er
 		return r.Seek(offset, io.SeekCurrent)
 
 	case io.SeekCurrent:
-		for {
-			if offset == 0 {
-				return r.gOffset, nil
-			}
-
-			// See if we can stay within the current block (if we haven't moved beyond
-			// the last block).
-			if r.rIndex < len(r.mv.buf) {
-				newROffset := int64(r.rOffset) + offset
-				if 0 <= newROffset && newROffset < int64(len(r.mv.buf[r.rIndex])) {
-					r.rOffset += int(offset)
-					r.gOffset += offset
-					return r.gOffset, nil
-				}
-			}
+		if offset == 0 {
+			return r.gOffset, nil
+		}
 
-			if offset < 0 {
-				// Seeking backwards. Go to the end of the previous block.
-				offset += int64(r.rOffset)
-				r.gOffset -= int64(r.rOffset)
-				r.rIndex--
-				if r.rIndex < 0 {
-					return 0, errors.New("MemViewReader.Seek: negative position")
-				}
-				r.rOffset = len(r.mv.buf[r.rIndex])
-			} else if r.rIndex < len(r.mv.buf) {
-				// Seeking forwards. Go to the beginning of the next block.
-				curBuf := r.mv.buf[r.rIndex]
-				numSkipped := len(curBuf) - r.rOffset
-				offset -= int64(numSkipped)
-				r.gOffset += int64(numSkipped)
-				r.rIndex++
-				r.rOffset = 0
-			} else {
-				// Seeking forwards, but we've moved past the last block.
+		// See if we can stay within the current block (if we haven't moved beyond
+		// the last block).
+		if r.rIndex < len(r.mv.buf) {
+			newROffset := int64(r.rOffset) + offset
+			if 0 <= newROffset && newROffset < int64(len(r.mv.bufAt(r.rIndex))) {
+				r.rOffset += int(offset)
+				r.gOffset += offset
 				return r.gOffset, nil
 			}
 		}
 
+		target := r.gOffset + offset
+		if target < 0 {
+			return 0, errors.New("MemViewReader.Seek: negative position")
+		}
+		if target >= r.mv.length {
+			// Seeking to or past the end. Move past the last block.
+			r.rIndex, r.rOffset, r.gOffset = len(r.mv.buf), 0, r.mv.length
+			return r.gOffset, nil
+		}
+
+		r.rIndex, r.rOffset = r.mv.locate(target)
+		r.gOffset = target
+		return r.gOffset, nil
+
 	default:
 		return 0, errors.New("MemViewReader.Seek: invalid whence")
 	}
@@ -562,8 +735,8 @@ func (r *MemViewReader) Truncate(offset int64) (*MemViewReader, error) {
 // Make MemView more efficient as a source in io.Copy.
 func (r *MemViewReader) WriteTo(dst io.Writer) (int64, error) {
 	var bytesWritten int64
-	for _, b := range r.mv.buf {
-		n, err := dst.Write(b)
+	for i := range r.mv.buf {
+		n, err := dst.Write(r.mv.bufAt(i))
 		bytesWritten += int64(n)
 		if err != nil {
 			return bytesWritten, err
@@ -586,16 +759,16 @@ func (left MemView) Equal(right MemView) bool {
 		// any bounds checks on left.buf and right.buf.
 
 		// Seek through the buffers on each side until we find the next byte.
-		for leftBufOffset >= len(left.buf[leftBufIdx]) {
+		for leftBufOffset >= len(left.bufAt(leftBufIdx)) {
 			leftBufIdx++
 			leftBufOffset = 0
 		}
-		for rightBufOffset >= len(right.buf[rightBufIdx]) {
+		for rightBufOffset >= len(right.bufAt(rightBufIdx)) {
 			rightBufIdx++
 			rightBufOffset = 0
 		}
 
-		if left.buf[leftBufIdx][leftBufOffset] != right.buf[rightBufIdx][rightBufOffset] {
+		if left.bufAt(leftBufIdx)[leftBufOffset] != right.bufAt(rightBufIdx)[rightBufOffset] {
 			return false
 		}
 
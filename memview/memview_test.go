@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -646,6 +647,59 @@ func TestSubView(t *testing.T) {
 	}
 }
 
+// Subviews share storage with their parent, but appending to either must not
+// change the other.
+func TestSubViewAppend(t *testing.T) {
+	var mv MemView
+	mv.Append(New([]byte("prince ")))
+	mv.Append(New([]byte("is a ")))
+	mv.Append(New([]byte("good ")))
+	mv.Append(New([]byte("boy")))
+
+	sub := mv.SubView(3, 14)
+	nested := sub.SubView(2, 9)
+	if sub.String() != "nce is a go" || nested.String() != "e is a " {
+		t.Fatalf("unexpected subviews %q and %q", sub.String(), nested.String())
+	}
+
+	sub.Append(New([]byte("!")))
+	nested.Append(New([]byte("dog")))
+	mv.Append(New([]byte("?")))
+
+	if mv.String() != "prince is a good boy?" {
+		t.Errorf("parent changed to %q", mv.String())
+	}
+	if sub.String() != "nce is a go!" {
+		t.Errorf("expected %q, got %q", "nce is a go!", sub.String())
+	}
+	if nested.String() != "e is a dog" {
+		t.Errorf("expected %q, got %q", "e is a dog", nested.String())
+	}
+	if got := nested.LastIndex([]byte("a d")); got != 5 {
+		t.Errorf("LastIndex after append: expected 5, got %d", got)
+	}
+	if !nested.DeepCopy().Equal(nested) {
+		t.Errorf("DeepCopy of %q is not equal to it", nested.String())
+	}
+}
+
+// Taking a subview of a heavily fragmented view should not depend on how many
+// buffers it spans.
+func TestSubViewSharesStorage(t *testing.T) {
+	view := makeRandomView(1000, 10)
+	sub := view.SubView(5, view.Len()-5)
+	if &sub.buf[0] != &view.buf[0] || &sub.ends[0] != &view.ends[0] {
+		t.Errorf("expected subview to share its parent's slices")
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		sub = view.SubView(5, view.Len()-5)
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations, got %v", allocs)
+	}
+}
+
 func TestIndex(t *testing.T) {
 	testCases := []struct {
 		name     string
@@ -731,15 +785,34 @@ func TestIndex(t *testing.T) {
 			start:    int64(len("<pattern> abc <pattern>") + 100),
 			expected: -1,
 		},
-		/*
-			{
-				name:     "partial match",
-				input:    "xxxxxyy",
-				pattern:  "xxxyy",
-				start:    0,
-				expected: 2,
-			},
-		*/
+		{
+			name:     "partial match",
+			input:    "xxxxxyy",
+			pattern:  "xxxyy",
+			start:    0,
+			expected: 2,
+		},
+		{
+			name:     "repeated header terminator",
+			input:    "a\r\n\r\r\n\r\nb",
+			pattern:  "\r\n\r\n",
+			start:    0,
+			expected: 4,
+		},
+		{
+			name:     "multipart boundary",
+			input:    "--b--b--b9580db",
+			pattern:  "--b9580db",
+			start:    0,
+			expected: 6,
+		},
+		{
+			name:     "negative start",
+			input:    "<pattern>",
+			pattern:  "<pattern>",
+			start:    -3,
+			expected: 0,
+		},
 	}
 
 	for _, c := range testCases {
@@ -773,45 +846,331 @@ func TestIndex(t *testing.T) {
 	}
 }
 
-func BenchmarkIndexSmall(b *testing.B) {
+func makeRandomView(numBuffers, bufferSize int) MemView {
 	letterBytes := []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz")
-	bytes1 := make([]byte, 1400)
-	bytes2 := make([]byte, 1400)
-	for i := range bytes1 {
-		bytes1[i] = letterBytes[rand.Intn(len(letterBytes))]
-		bytes2[i] = letterBytes[rand.Intn(len(letterBytes))]
+	view := New([]byte("xxxxxx"))
+	for i := 0; i < numBuffers; i++ {
+		buf := make([]byte, bufferSize)
+		for j := range buf {
+			buf[j] = letterBytes[rand.Intn(len(letterBytes))]
+		}
+		view.Append(New(buf))
 	}
+	return view
+}
 
-	view := New(bytes1)
-	view.Append(New(bytes2))
+func benchmarkIndex(b *testing.B, view MemView, index func(MemView, int64, []byte) int64) {
+	needles := [][]byte{
+		[]byte("POST"),
+		[]byte("GET"),
+		[]byte("DELETE"),
+		[]byte("PUT"),
+		[]byte("OPTION"),
+		[]byte("\r\n\r\n"),
+	}
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		view.Index(0, []byte("POST"))
-		view.Index(0, []byte("GET"))
-		view.Index(0, []byte("DELETE"))
-		view.Index(0, []byte("PUT"))
-		view.Index(0, []byte("OPTION"))
+		for _, needle := range needles {
+			index(view, 0, needle)
+		}
 	}
 }
 
+func currentIndex(mv MemView, start int64, sep []byte) int64 {
+	return mv.Index(start, sep)
+}
+
+func BenchmarkIndexSmall(b *testing.B) {
+	benchmarkIndex(b, makeRandomView(2, 1400), currentIndex)
+}
+
 func BenchmarkIndexLarge(b *testing.B) {
-	letterBytes := []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz")
-	view := New([]byte("xxxxxx"))
+	benchmarkIndex(b, makeRandomView(1000, 1400), currentIndex)
+}
+
+func BenchmarkIndexFragmented(b *testing.B) {
+	benchmarkIndex(b, makeRandomView(10000, 3), currentIndex)
+}
+
+func BenchmarkLegacyIndexSmall(b *testing.B) {
+	benchmarkIndex(b, makeRandomView(2, 1400), legacyIndex)
+}
+
+func BenchmarkLegacyIndexLarge(b *testing.B) {
+	benchmarkIndex(b, makeRandomView(1000, 1400), legacyIndex)
+}
+
+func BenchmarkLegacyIndexFragmented(b *testing.B) {
+	benchmarkIndex(b, makeRandomView(10000, 3), legacyIndex)
+}
+
+// The previous implementation of MemView.Index, kept for benchmark comparison.
+// Incorrect for needles with a repeated prefix.
+func legacyIndex(mv MemView, start int64, sep []byte) int64 {
+	// Find the first buffer to start from.
+	startBuf := -1
+	startOffset := 0
+	var currIndex int64
+	for i, b := range mv.buf {
+		lb := int64(len(b))
+		if currIndex+lb-1 < start { // -1 because start is an index
+			currIndex += lb
+		} else {
+			startBuf = i
+			startOffset = int(start - currIndex)
+			currIndex += int64(startOffset)
+			break
+		}
+	}
+
+	if startBuf == -1 {
+		return -1
+	} else if len(sep) == 0 {
+		return start
+	}
+
+	// Iteratively search for the target, keeping in mind that the target may be
+	// spread over multiple slices in mv.buf.
+	//
+	// TODO: this only works correctly for search strings that do not have a repeated
+	// prefix. To work correctly, we would have to back up to the point at which
+	// the needle *could* have started after an incomplete match.
+	//
+	// However, we only use this method to search for strings without a repeated prefix:
+	// GET, POST, DELETE, HEAD, PUT, PATCH, CONNECT, OPTIONS, TRACE, HTTP/1.1 and HTTP/1.0
+	needle := sep
+	needleIndex := 0
+	for b := startBuf; b < len(mv.buf); b++ {
+		haystack := mv.buf[b]
+		// Check remainder of needle if overlap from last buffer
+		var i int = 0
+		for i = startOffset; i < len(haystack) && needleIndex > 0; i++ {
+			if haystack[i] == needle[needleIndex] {
+				needleIndex += 1
+				if needleIndex == len(needle) {
+					// Found, figure out start index.
+					// At the start of the 'i' loop, it points to currentIndex, so we
+					// need to add i and subtract startOffset.  Then move back to the
+					// first character in the needle
+					return currIndex + int64(i-startOffset) - int64(len(needle)-1)
+				}
+			} else {
+				needleIndex = 0
+			}
+		}
+
+		// Did we reach the end of the buffer already?
+		if i < len(haystack) {
+			// If not, efficient check of remaining portion of haystack
+			found := bytes.Index(haystack[i:], needle)
+			if found != -1 {
+				return currIndex + int64(found)
+			}
+
+			// Check the end of the haystack for the start of the needle
+			// (but not the whole thing, or we would have found it in the call above.)
+			needleStart := len(haystack) - len(needle) + 1
+			if i < needleStart {
+				i = needleStart
+			}
+			for ; i < len(haystack); i++ {
+				if haystack[i] == needle[needleIndex] {
+					needleIndex += 1
+				} else {
+					needleIndex = 0
+				}
+			}
+		}
+
+		// Searched all of buffer
+		currIndex += int64(len(haystack) - startOffset)
+		startOffset = 0
+	}
+
+	return -1
+}
+
+// Returns every way of splitting input into four MemViews, appended together.
+func segment4(input string) []MemView {
+	var result []MemView
+	for i := 0; i <= len(input); i++ {
+		for j := i; j <= len(input); j++ {
+			for k := j; k <= len(input); k++ {
+				var mv MemView
+				mv.Append(New([]byte(input[:i])))
+				mv.Append(New([]byte(input[i:j])))
+				mv.Append(New([]byte(input[j:k])))
+				mv.Append(New([]byte(input[k:])))
+				result = append(result, mv)
+			}
+		}
+	}
+	return result
+}
+
+func TestIndexMatchesBytesIndex(t *testing.T) {
+	inputs := []string{
+		"aaaaaaab",
+		"abababcabab",
+		"--b--b--b9580db--b",
+		"\n\n\r\n\r\n\n\n",
+		"baabab",
+	}
+	patterns := []string{"a", "ab", "aab", "aaab", "abc", "abab", "--b", "--b9580db", "\n\n", "\r\n\r\n", "zz"}
+
+	for _, input := range inputs {
+		for _, pattern := range patterns {
+			for _, mv := range segment4(input) {
+				for start := 0; start <= len(input); start++ {
+					expected := int64(-1)
+					if start < len(input) {
+						if found := strings.Index(input[start:], pattern); found != -1 {
+							expected = int64(start + found)
+						}
+					}
+					if actual := mv.Index(int64(start), []byte(pattern)); actual != expected {
+						t.Errorf("Index(%d, %q) on %q: expected %d, got %d", start, pattern, input, expected, actual)
+					}
+				}
+
+				if expected, actual := int64(strings.LastIndex(input, pattern)), mv.LastIndex([]byte(pattern)); actual != expected {
+					t.Errorf("LastIndex(%q) on %q: expected %d, got %d", pattern, input, expected, actual)
+				}
+			}
+		}
+	}
+}
+
+// Checks Index and LastIndex against the bytes package on random inputs split
+// into random buffers.
+func TestRandomIndexMatchesBytesIndex(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	randomBytes := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = "ab"[r.Intn(2)]
+		}
+		return b
+	}
+
+	for i := 0; i < 10000; i++ {
+		input := randomBytes(r.Intn(12))
+		pattern := randomBytes(1 + r.Intn(5))
+
+		var mv MemView
+		for rest := input; len(rest) > 0 || r.Intn(4) == 0; {
+			n := r.Intn(len(rest) + 1)
+			mv.Append(New(rest[:n]))
+			rest = rest[n:]
+		}
+
+		if expected, actual := int64(bytes.Index(input, pattern)), mv.Index(0, pattern); actual != expected {
+			t.Fatalf("Index(%q) on %q split as %q: expected %d, got %d", pattern, input, mv.buf, expected, actual)
+		}
+		if expected, actual := int64(bytes.LastIndex(input, pattern)), mv.LastIndex(pattern); actual != expected {
+			t.Fatalf("LastIndex(%q) on %q split as %q: expected %d, got %d", pattern, input, mv.buf, expected, actual)
+		}
+	}
+}
+
+func TestIndexByteAndIndexAny(t *testing.T) {
+	input := "key: value\r\n"
+	for _, mv := range segment4(input) {
+		for start := 0; start < len(input); start++ {
+			expected := int64(-1)
+			if found := strings.IndexByte(input[start:], ':'); found != -1 {
+				expected = int64(start + found)
+			}
+			if actual := mv.IndexByte(int64(start), ':'); actual != expected {
+				t.Errorf("IndexByte(%d): expected %d, got %d", start, expected, actual)
+			}
+
+			expected = -1
+			if found := strings.IndexAny(input[start:], "\r\n"); found != -1 {
+				expected = int64(start + found)
+			}
+			if actual := mv.IndexAny(int64(start), "\r\n"); actual != expected {
+				t.Errorf("IndexAny(%d): expected %d, got %d", start, expected, actual)
+			}
+		}
+		if actual := mv.IndexByte(int64(len(input)), ':'); actual != -1 {
+			t.Errorf("IndexByte past end: expected -1, got %d", actual)
+		}
+	}
+}
+
+func TestHasPrefix(t *testing.T) {
+	input := "PRI * HTTP/2.0"
+	prefixes := []string{"", "P", "PRI * ", "PRI * HTTP/2.0", "PRI * HTTP/2.0!", "GET"}
+	for _, mv := range segment4(input) {
+		for _, prefix := range prefixes {
+			if expected, actual := strings.HasPrefix(input, prefix), mv.HasPrefix([]byte(prefix)); actual != expected {
+				t.Errorf("HasPrefix(%q): expected %v, got %v", prefix, expected, actual)
+			}
+		}
+	}
+}
+
+// Checks random access and slicing on a heavily fragmented view against the
+// same operations on a flat copy of the data.
+func TestFragmentedRandomAccess(t *testing.T) {
+	view := makeRandomView(500, 3)
+	view.Append(New([]byte{}))
+	view.Append(makeRandomView(10, 1))
+	flat := []byte(view.String())
+
+	for i := int64(0); i < view.Len(); i++ {
+		if got := view.GetByte(i); got != flat[i] {
+			t.Fatalf("GetByte(%d): expected %q, got %q", i, flat[i], got)
+		}
+	}
+
 	for i := 0; i < 1000; i++ {
-		bytes1 := make([]byte, 1400)
-		for j := range bytes1 {
-			bytes1[j] = letterBytes[rand.Intn(len(letterBytes))]
+		start := rand.Int63n(view.Len())
+		end := start + rand.Int63n(view.Len()-start+1)
+		sub := view.SubView(start, end)
+		if sub.Len() != end-start {
+			t.Fatalf("SubView(%d, %d): expected length %d, got %d", start, end, end-start, sub.Len())
 		}
-		view.Append(New(bytes1))
+		if sub.String() != string(flat[start:end]) {
+			t.Fatalf("SubView(%d, %d): expected %q, got %q", start, end, flat[start:end], sub.String())
+		}
+
+		if sub.Len() > 0 {
+			// Slicing a slice should agree with slicing the original.
+			j := rand.Int63n(sub.Len())
+			if got := sub.GetByte(j); got != flat[start+j] {
+				t.Fatalf("SubView(%d, %d).GetByte(%d): expected %q, got %q", start, end, j, flat[start+j], got)
+			}
+			if got := sub.SubView(j, sub.Len()).String(); got != string(flat[start+j:end]) {
+				t.Fatalf("SubView(%d, %d).SubView(%d, %d): expected %q, got %q", start, end, j, sub.Len(), flat[start+j:end], got)
+			}
+		}
+
+		r := view.CreateReader()
+		if pos, err := r.Seek(start, io.SeekCurrent); err != nil || pos != start {
+			t.Fatalf("Seek(%d): got position %d, error %v", start, pos, err)
+		}
+		if b, err := r.ReadByte(); err != nil || b != flat[start] {
+			t.Fatalf("ReadByte after Seek(%d): expected %q, got %q, error %v", start, flat[start], b, err)
+		}
+	}
+}
+
+func BenchmarkGetByteFragmented(b *testing.B) {
+	view := makeRandomView(10000, 3)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		view.GetByte(int64(i) % view.Len())
 	}
+}
 
+func BenchmarkSubViewFragmented(b *testing.B) {
+	view := makeRandomView(10000, 3)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		view.Index(0, []byte("POST"))
-		view.Index(0, []byte("GET"))
-		view.Index(0, []byte("DELETE"))
-		view.Index(0, []byte("PUT"))
-		view.Index(0, []byte("OPTION"))
+		start := int64(i) % (view.Len() - 100)
+		view.SubView(start, start+100)
 	}
 }
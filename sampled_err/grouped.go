@@ -0,0 +1,318 @@
+package sampled_err
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The number of buckets used to track counts within the rolling window.
+const windowBuckets = 10
+
+// The group that errors are counted under once MaxGroups is reached.
+const OtherGroup = "other"
+
+// An error that errors.Is matches against, together with the name of the group
+// for matching errors.
+type Target struct {
+	Name string
+	Err  error
+}
+
+// Assigns errors to groups: an error matching one of Targets with errors.Is
+// is grouped under the target's name; any other error is grouped by the type
+// of its innermost wrapped error and its message, with variable parts such as
+// numbers, addresses and quoted strings normalized away.
+type Categorizer struct {
+	// Checked in order.
+	Targets []Target
+}
+
+func (c Categorizer) Categorize(err error) string {
+	for _, target := range c.Targets {
+		if errors.Is(err, target.Err) {
+			return target.Name
+		}
+	}
+
+	root := err
+	for {
+		next := errors.Unwrap(root)
+		if next == nil {
+			break
+		}
+		root = next
+	}
+	return fmt.Sprintf("%T: %s", root, NormalizeMessage(err.Error()))
+}
+
+var messageNormalizers = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`"[^"]*"`), "<str>"},
+	{regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`), "<uuid>"},
+	{regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}(:\d+)?\b`), "<addr>"},
+	{regexp.MustCompile(`(?i)\b0x[0-9a-f]+\b`), "<hex>"},
+	{regexp.MustCompile(`\d+`), "<n>"},
+}
+
+// Replaces the variable parts of an error message, such as numbers, addresses
+// and quoted strings, with placeholders, so that errors that differ only in
+// those parts can be grouped together.
+func NormalizeMessage(msg string) string {
+	for _, n := range messageNormalizers {
+		msg = n.pattern.ReplaceAllString(msg, n.replacement)
+	}
+	return msg
+}
+
+// Counts errors by group over a rolling time window, keeping a sample of
+// errors for each group.
+type GroupedErrors struct {
+	// Errors older than this are forgotten. Zero means errors are never
+	// forgotten.
+	Window time.Duration
+
+	// The number of errors to sample in each group.
+	SamplesPerGroup int
+
+	// The most groups to keep, including OtherGroup. Once all but one are in
+	// use, errors in new groups are counted under OtherGroup. Zero means no
+	// limit.
+	MaxGroups int
+
+	// Assigns errors to groups. Defaults to an empty Categorizer.
+	Categorize func(error) string
+
+	// The number of errors added, including those that have left the window.
+	TotalCount int
+
+	groups map[string]*errorGroup
+
+	now func() time.Time
+}
+
+type errorGroup struct {
+	firstSeen time.Time
+	lastSeen  time.Time
+	samples   []error
+
+	// Counts of errors in consecutive intervals, oldest first. When there is no
+	// window, this holds a single bucket.
+	buckets []countBucket
+}
+
+type countBucket struct {
+	start time.Time
+	count int
+}
+
+// A JSON-serializable summary of the errors in a GroupedErrors.
+type GroupedErrorsSummary struct {
+	// The length of the rolling window, in seconds. Zero if there is no window.
+	WindowSeconds float64 `json:"window_seconds"`
+
+	// The number of errors added, including those that have left the window.
+	TotalCount int `json:"total_count"`
+
+	// The number of errors in the window.
+	WindowCount int `json:"window_count"`
+
+	// The groups with errors in the window, most frequent first.
+	Groups []ErrorGroupSummary `json:"groups"`
+}
+
+type ErrorGroupSummary struct {
+	Group     string    `json:"group"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Samples   []string  `json:"samples,omitempty"`
+}
+
+func (es *GroupedErrors) Add(e error) {
+	now := es.currentTime()
+	es.expire(now)
+	es.TotalCount++
+
+	key := es.categorize(e)
+	group, ok := es.groups[key]
+	if !ok && es.MaxGroups > 0 && len(es.groups) >= es.MaxGroups-1 {
+		key = OtherGroup
+		group, ok = es.groups[key]
+	}
+	if !ok {
+		if es.groups == nil {
+			es.groups = make(map[string]*errorGroup)
+		}
+		group = &errorGroup{firstSeen: now}
+		es.groups[key] = group
+	}
+	group.lastSeen = now
+
+	// Count the error.
+	if n := len(group.buckets); n > 0 && (es.Window == 0 || now.Sub(group.buckets[n-1].start) < es.bucketWidth()) {
+		group.buckets[n-1].count++
+	} else {
+		group.buckets = append(group.buckets, countBucket{start: now, count: 1})
+	}
+
+	// Sample the error.
+	if len(group.samples) >= es.SamplesPerGroup {
+		if len(group.samples) > 0 && rand.Intn(2) == 1 {
+			group.samples[rand.Intn(len(group.samples))] = e
+		}
+	} else {
+		group.samples = append(group.samples, e)
+	}
+}
+
+// Returns a summary of the errors in the window.
+func (es *GroupedErrors) Summary() GroupedErrorsSummary {
+	es.expire(es.currentTime())
+
+	result := GroupedErrorsSummary{
+		WindowSeconds: es.Window.Seconds(),
+		TotalCount:    es.TotalCount,
+		Groups:        make([]ErrorGroupSummary, 0, len(es.groups)),
+	}
+	for key, group := range es.groups {
+		summary := ErrorGroupSummary{
+			Group:     key,
+			Count:     group.count(),
+			FirstSeen: group.firstSeen,
+			LastSeen:  group.lastSeen,
+		}
+		for _, sample := range group.samples {
+			summary.Samples = append(summary.Samples, sample.Error())
+		}
+		result.WindowCount += summary.Count
+		result.Groups = append(result.Groups, summary)
+	}
+
+	sort.Slice(result.Groups, func(i, j int) bool {
+		if result.Groups[i].Count != result.Groups[j].Count {
+			return result.Groups[i].Count > result.Groups[j].Count
+		}
+		return result.Groups[i].Group < result.Groups[j].Group
+	})
+	return result
+}
+
+func (es *GroupedErrors) Error() string {
+	summary := es.Summary()
+	if summary.WindowCount == 0 {
+		return "no error"
+	}
+
+	strs := make([]string, 0, len(summary.Groups))
+	for _, group := range summary.Groups {
+		strs = append(strs, fmt.Sprintf("%d x %s", group.Count, group.Group))
+	}
+	return fmt.Sprintf("encountered %d errors in %d groups: %s",
+		summary.WindowCount, len(summary.Groups), strings.Join(strs, ", "))
+}
+
+// Forgets counts that have left the window, and groups with no errors in the
+// window.
+func (es *GroupedErrors) expire(now time.Time) {
+	if es.Window == 0 {
+		return
+	}
+
+	cutoff := now.Add(-es.Window)
+	width := es.bucketWidth()
+	for key, group := range es.groups {
+		i := 0
+		for i < len(group.buckets) && !group.buckets[i].start.Add(width).After(cutoff) {
+			i++
+		}
+		group.buckets = group.buckets[i:]
+		if len(group.buckets) == 0 {
+			delete(es.groups, key)
+		}
+	}
+}
+
+func (es *GroupedErrors) bucketWidth() time.Duration {
+	return es.Window / windowBuckets
+}
+
+func (es *GroupedErrors) categorize(e error) string {
+	if es.Categorize != nil {
+		return es.Categorize(e)
+	}
+	return Categorizer{}.Categorize(e)
+}
+
+func (es *GroupedErrors) currentTime() time.Time {
+	if es.now != nil {
+		return es.now()
+	}
+	return time.Now()
+}
+
+func (g *errorGroup) count() int {
+	result := 0
+	for _, bucket := range g.buckets {
+		result += bucket.count
+	}
+	return result
+}
+
+// A thread-safe version of GroupedErrors.
+type ConcurrentGroupedErrors interface {
+	ConcurrentErrors
+	Summary() GroupedErrorsSummary
+}
+
+type concurrentGroupedErrors struct {
+	err   GroupedErrors
+	mutex sync.Mutex
+}
+
+var _ ConcurrentGroupedErrors = (*concurrentGroupedErrors)(nil)
+
+// Returns a thread-safe GroupedErrors with the given window, number of samples
+// per group, and maximum number of groups, and categorizing errors with the
+// given categorizer. A maxGroups of zero means no limit.
+func NewConcurrentGroupedErrors(window time.Duration, samplesPerGroup int, maxGroups int, categorizer Categorizer) ConcurrentGroupedErrors {
+	return &concurrentGroupedErrors{
+		err: GroupedErrors{
+			Window:          window,
+			SamplesPerGroup: samplesPerGroup,
+			MaxGroups:       maxGroups,
+			Categorize:      categorizer.Categorize,
+		},
+	}
+}
+
+func (errs *concurrentGroupedErrors) Add(err error) {
+	errs.mutex.Lock()
+	defer errs.mutex.Unlock()
+	errs.err.Add(err)
+}
+
+func (errs *concurrentGroupedErrors) GetTotalCount() int {
+	errs.mutex.Lock()
+	defer errs.mutex.Unlock()
+	return errs.err.TotalCount
+}
+
+func (errs *concurrentGroupedErrors) Error() string {
+	errs.mutex.Lock()
+	defer errs.mutex.Unlock()
+	return errs.err.Error()
+}
+
+func (errs *concurrentGroupedErrors) Summary() GroupedErrorsSummary {
+	errs.mutex.Lock()
+	defer errs.mutex.Unlock()
+	return errs.err.Summary()
+}
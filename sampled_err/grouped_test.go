@@ -0,0 +1,110 @@
+package sampled_err
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeMessage(t *testing.T) {
+	assert.Equal(t,
+		`dial tcp <addr>: connect: connection refused after <n> attempts`,
+		NormalizeMessage("dial tcp 10.0.0.1:443: connect: connection refused after 3 attempts"))
+	assert.Equal(t,
+		`unknown service <str> (id <uuid>, flags <hex>)`,
+		NormalizeMessage(`unknown service "foo" (id 123e4567-e89b-12d3-a456-426614174000, flags 0x1f)`))
+}
+
+func TestCategorizer(t *testing.T) {
+	c := Categorizer{
+		Targets: []Target{{Name: "eof", Err: io.EOF}},
+	}
+	assert.Equal(t, "eof", c.Categorize(errors.Wrap(io.EOF, "reading body")))
+	assert.Equal(t,
+		c.Categorize(fmt.Errorf("request %d: %w", 1, errors.New("status 500"))),
+		c.Categorize(fmt.Errorf("request %d: %w", 2, errors.New("status 502"))))
+}
+
+func TestGroupedErrorsWindow(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	es := &GroupedErrors{
+		Window:          time.Minute,
+		SamplesPerGroup: 2,
+		Categorize:      Categorizer{Targets: []Target{{Name: "eof", Err: io.EOF}}}.Categorize,
+		now:             func() time.Time { return now },
+	}
+	assert.Equal(t, "no error", es.Error())
+
+	for i := 0; i < 5; i++ {
+		es.Add(io.EOF)
+	}
+	now = now.Add(30 * time.Second)
+	es.Add(errors.New("timeout after 5s"))
+	es.Add(errors.New("timeout after 10s"))
+
+	summary := es.Summary()
+	assert.Equal(t, 7, summary.TotalCount)
+	assert.Equal(t, 7, summary.WindowCount)
+	if assert.Len(t, summary.Groups, 2) {
+		assert.Equal(t, "eof", summary.Groups[0].Group)
+		assert.Equal(t, 5, summary.Groups[0].Count)
+		assert.Len(t, summary.Groups[0].Samples, 2)
+		assert.Equal(t, 2, summary.Groups[1].Count)
+		assert.Equal(t, now.Add(-30*time.Second), summary.Groups[0].FirstSeen)
+		assert.Equal(t, now, summary.Groups[1].LastSeen)
+	}
+
+	// The EOFs leave the window.
+	now = now.Add(45 * time.Second)
+	summary = es.Summary()
+	assert.Equal(t, 7, summary.TotalCount)
+	assert.Equal(t, 2, summary.WindowCount)
+	assert.Len(t, summary.Groups, 1)
+
+	bs, err := json.Marshal(summary)
+	assert.NoError(t, err)
+	var decoded GroupedErrorsSummary
+	assert.NoError(t, json.Unmarshal(bs, &decoded))
+	assert.Equal(t, summary, decoded)
+}
+
+func TestGroupedErrorsMaxGroups(t *testing.T) {
+	es := &GroupedErrors{MaxGroups: 3}
+	es.Add(errors.New("a"))
+	es.Add(errors.New("b"))
+	es.Add(errors.New("c"))
+	es.Add(errors.New("d"))
+
+	// OtherGroup counts towards the limit.
+	summary := es.Summary()
+	assert.Len(t, summary.Groups, 3)
+	assert.Equal(t, OtherGroup, summary.Groups[0].Group)
+	assert.Equal(t, 2, summary.Groups[0].Count)
+
+	// With a single group, everything is counted under OtherGroup.
+	es = &GroupedErrors{MaxGroups: 1}
+	es.Add(errors.New("a"))
+	es.Add(errors.New("b"))
+	summary = es.Summary()
+	assert.Len(t, summary.Groups, 1)
+	assert.Equal(t, OtherGroup, summary.Groups[0].Group)
+	assert.Equal(t, 2, summary.Groups[0].Count)
+}
+
+func TestConcurrentGroupedErrorsMaxGroups(t *testing.T) {
+	errs := NewConcurrentGroupedErrors(0, 1, 2, Categorizer{})
+	errs.Add(errors.New("a"))
+	errs.Add(errors.New("b"))
+	errs.Add(errors.New("c"))
+
+	summary := errs.Summary()
+	assert.Equal(t, 3, summary.TotalCount)
+	assert.Len(t, summary.Groups, 2)
+	assert.Equal(t, OtherGroup, summary.Groups[0].Group)
+	assert.Equal(t, 2, summary.Groups[0].Count)
+}
@@ -0,0 +1,124 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+// Splits data into chunks whose sizes are taken in turn from chunkSizes. A
+// chunk size of zero produces an empty chunk. If chunkSizes is empty or all
+// zero, data is returned as a single chunk.
+func ChunkInput(data []byte, chunkSizes []byte) []memview.MemView {
+	allZero := true
+	for _, n := range chunkSizes {
+		if n != 0 {
+			allZero = false
+			break
+		}
+	}
+	if allZero {
+		return []memview.MemView{memview.New(data)}
+	}
+
+	var result []memview.MemView
+	for i := 0; len(data) > 0; i++ {
+		n := int(chunkSizes[i%len(chunkSizes)])
+		if n > len(data) {
+			n = len(data)
+		}
+		result = append(result, memview.New(data[:n]))
+		data = data[n:]
+	}
+	return result
+}
+
+// Drives the given factory over data, split into chunks according to
+// chunkSizes, in the same way the agent feeds a TCP flow: input accumulates
+// across calls to Accepts, with isEnd set on the final chunk, and discarded
+// bytes are dropped from the front. If the factory accepts, the remaining
+// input is fed to a parser created by the factory via CheckTCPParser.
+//
+// Fails the test if any invariant of the TCPParserFactory interface is
+// violated.
+func CheckTCPParserFactory(t testing.TB, factory akinet.TCPParserFactory, data []byte, chunkSizes []byte) {
+	chunks := ChunkInput(data, chunkSizes)
+	if len(chunks) == 0 {
+		chunks = []memview.MemView{memview.Empty()}
+	}
+
+	var input memview.MemView
+	for i, chunk := range chunks {
+		isEnd := i == len(chunks)-1
+		input.Append(chunk)
+
+		decision, discardFront := factory.Accepts(input, isEnd)
+		if discardFront < 0 || discardFront > input.Len() {
+			t.Fatalf("%s: discardFront %d out of bounds for input of length %d", factory.Name(), discardFront, input.Len())
+		}
+
+		switch decision {
+		case akinet.Accept:
+			remaining := []memview.MemView{input.SubView(discardFront, input.Len())}
+			remaining = append(remaining, chunks[i+1:]...)
+			CheckTCPParser(t, factory.CreateParser(akinet.TCPBidiID{}, 0, 0), remaining)
+			return
+		case akinet.Reject:
+			if discardFront != input.Len() {
+				t.Fatalf("%s: rejected with discardFront %d, expected %d", factory.Name(), discardFront, input.Len())
+			}
+			input = memview.MemView{}
+		case akinet.NeedMoreData:
+			if isEnd {
+				t.Fatalf("%s: returned NeedMoreData with isEnd set", factory.Name())
+			}
+			input = input.SubView(discardFront, input.Len())
+		default:
+			t.Fatalf("%s: unknown decision %v", factory.Name(), decision)
+		}
+	}
+}
+
+// Feeds the given chunks to the parser, with isEnd set on the final chunk,
+// until the parser returns a result or an error.
+//
+// Fails the test if the parser panics or if its byte accounting is
+// inconsistent: on success, the bytes consumed plus the unused bytes must
+// equal the bytes supplied; on error, the bytes consumed must equal the bytes
+// supplied.
+func CheckTCPParser(t testing.TB, parser akinet.TCPParser, chunks []memview.MemView) {
+	if len(chunks) == 0 {
+		chunks = []memview.MemView{memview.Empty()}
+	}
+
+	var supplied int64
+	for i, chunk := range chunks {
+		isEnd := i == len(chunks)-1
+		supplied += chunk.Len()
+
+		result, unused, consumed, err := parser.Parse(chunk, isEnd)
+		if err != nil {
+			if consumed != supplied {
+				t.Fatalf("%s: consumed %d bytes on error, expected %d", parser.Name(), consumed, supplied)
+			}
+			return
+		}
+		if result != nil {
+			defer result.ReleaseBuffers()
+			if unused.Len() > chunk.Len() {
+				t.Fatalf("%s: %d unused bytes exceeds last input of %d bytes", parser.Name(), unused.Len(), chunk.Len())
+			}
+			if consumed+unused.Len() != supplied {
+				t.Fatalf("%s: consumed %d bytes with %d unused, but %d were supplied", parser.Name(), consumed, unused.Len(), supplied)
+			}
+			return
+		}
+		if isEnd {
+			t.Fatalf("%s: returned neither a result nor an error with isEnd set", parser.Name())
+		}
+		if consumed < 0 || consumed > supplied {
+			t.Fatalf("%s: consumed %d bytes, but only %d were supplied", parser.Name(), consumed, supplied)
+		}
+	}
+}